@@ -7,5 +7,5 @@ import (
 )
 
 func main() {
-	llm.CLI(os.Args[1:])
+	os.Exit(llm.CLI(os.Args[1:]))
 }
@@ -7,11 +7,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/davidhbaek/llm/internal/logging"
 	"github.com/davidhbaek/llm/internal/wire"
 )
 
@@ -19,10 +21,43 @@ type Client struct {
 	config     *Config
 	model      string
 	httpClient *http.Client
+	// Used when the request's context doesn't carry a logger
+	logger *slog.Logger
 }
 
-func NewClient(model string) *Client {
-	return &Client{
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL sends requests to another host, like a proxy or a test server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.config.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithAPIKey authenticates with key instead of the ANTHROPIC_API_KEY environment variable
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.config.apiKey = key
+	}
+}
+
+// WithHTTPClient sends requests with httpClient instead of the default client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithLogger logs to logger instead of slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+func NewClient(model string, opts ...Option) *Client {
+	c := &Client{
 		config: &Config{
 			baseURL: "https://api.anthropic.com",
 			apiKey:  os.Getenv("ANTHROPIC_API_KEY"),
@@ -37,31 +72,56 @@ func NewClient(model string) *Client {
 			},
 		},
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 func (c *Client) Model() string {
 	return c.model
 }
 
-func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, systemPrompt string) (*wire.Response, error) {
+// Maximum tokens to generate when the request doesn't set it, the API requires one
+const defaultMaxTokens = 2048
+
+func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	options := wire.NewOptions(opts...)
+	if options.MaxTokens == 0 {
+		options.MaxTokens = defaultMaxTokens
+	}
+
+	messages, err := toAnthropic(messages)
+	if err != nil {
+		return nil, err
+	}
+
 	reqBody, err := json.Marshal(struct {
-		Model        string         `json:"model"`
-		MaxTokens    int            `json:"max_tokens"`
-		SystemPrompt string         `json:"system"`
-		Messages     []wire.Message `json:"messages"`
-		Stream       bool           `json:"stream"`
+		Model         string         `json:"model"`
+		MaxTokens     int            `json:"max_tokens"`
+		System        []wire.Text    `json:"system,omitempty"`
+		Messages      []wire.Message `json:"messages"`
+		Stream        bool           `json:"stream"`
+		Temperature   *float64       `json:"temperature,omitempty"`
+		TopP          *float64       `json:"top_p,omitempty"`
+		StopSequences []string       `json:"stop_sequences,omitempty"`
 	}{
-		Model:        c.model,
-		MaxTokens:    2048,
-		SystemPrompt: systemPrompt,
-		Messages:     messages,
-		Stream:       true,
+		Model:         c.model,
+		MaxTokens:     options.MaxTokens,
+		System:        system,
+		Messages:      messages,
+		Stream:        true,
+		Temperature:   options.Temperature,
+		TopP:          options.TopP,
+		StopSequences: options.Stop,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/messages"), bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/messages"), bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("sending POST request: %w", err)
 	}
@@ -69,43 +129,115 @@ func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, syste
 	req.Header.Set("x-api-key", c.config.apiKey)
 	req.Header.Set("anthropic-version", "2023-06-01")
 	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Content-Type", "application/json")
 
+	start := time.Now()
 	rsp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	logging.FromContext(ctx, c.logger).Debug("received response headers", "path", req.URL.Path, "status", rsp.StatusCode, "latency", time.Since(start))
 
 	return &wire.Response{
 		StatusCode: rsp.StatusCode,
-		Body:       rsp.Body,
+		Header:     rsp.Header,
+		Body:       &wire.TimedBody{Reader: rsp.Body, Sent: start, Received: time.Now()},
 	}, nil
 }
 
-func (c *Client) ReadBody(body io.Reader) (string, error) {
+// toAnthropic copies messages, converting content in other providers' formats, like OpenAI's image URLs
+func toAnthropic(messages []wire.Message) ([]wire.Message, error) {
+	copied := make([]wire.Message, len(messages))
+	for i, msg := range messages {
+		copied[i] = msg
+		if msg.Content == nil {
+			continue
+		}
+
+		copied[i].Content = make([]wire.Content, len(msg.Content))
+		for j, content := range msg.Content {
+			if image, ok := content.(*wire.OpenAIImage); ok {
+				converted, err := imageFromURL(image.ImageURL.URL)
+				if err != nil {
+					return nil, fmt.Errorf("converting image: %w", err)
+				}
+				content = converted
+			}
+			copied[i].Content[j] = content
+		}
+	}
+
+	return copied, nil
+}
+
+// CountTokens returns the number of input tokens a request would use, as counted by the API
+func (c *Client) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	reqBody, err := json.Marshal(struct {
+		Model    string         `json:"model"`
+		System   []wire.Text    `json:"system,omitempty"`
+		Messages []wire.Message `json:"messages"`
+	}{
+		Model:    c.model,
+		System:   system,
+		Messages: messages,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/messages/count_tokens"), bytes.NewReader(reqBody))
+	if err != nil {
+		return 0, fmt.Errorf("creating count tokens request: %w", err)
+	}
+
+	req.Header.Set("x-api-key", c.config.apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return 0, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	count := struct {
+		InputTokens int `json:"input_tokens"`
+	}{}
+	if err := json.NewDecoder(rsp.Body).Decode(&count); err != nil {
+		return 0, fmt.Errorf("decoding token count: %w", err)
+	}
+
+	return count.InputTokens, nil
+}
+
+// Longest line read from a stream, cited text can make lines longer than bufio's default
+const maxLineSize = 1024 * 1024
+
+func (c *Client) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	stopwatch := wire.StartStopwatch(body)
+	handler = stopwatch.Handler(handler)
+
 	scanner := bufio.NewScanner(body)
 
-	var text string
+	scanner.Buffer(nil, maxLineSize)
+
+	completion := &wire.Completion{Model: c.model}
+
+	// Citations arrive in the stream ahead of the text they support
+	// so they're held until the end of their block to be emitted after it
+	var citations []wire.Citation
+
 	for scanner.Scan() {
 		line := scanner.Text()
 
 		// The Anthropic API doesn't return a msgType key:value pair for errors
-		// Only a JSON body
-		if strings.Contains(line, "error") {
-			errRsp := struct {
-				Type  string `json:"type"`
-				Error struct {
-					Type    string `json:"type"`
-					Message string `json:"message"`
-				} `json:"error"`
-			}{}
-
-			err := json.Unmarshal([]byte(line), &errRsp)
-			if err != nil {
-				return "", err
-			}
-
-			fmt.Printf("error from Anthropic API: type=%s message=%s", errRsp.Error.Type, errRsp.Error.Message)
-			return "", nil
+		// that happen before the stream starts, only a JSON body
+		if strings.HasPrefix(line, "{") {
+			return completion, wire.NewAPIError(0, strings.NewReader(line))
 		}
 
 		parts := strings.SplitN(line, ":", 2)
@@ -120,25 +252,79 @@ func (c *Client) ReadBody(body io.Reader) (string, error) {
 			sseData := SSEData{}
 			err := json.Unmarshal([]byte(payload), &sseData)
 			if err != nil {
-				return "", err
+				return completion, err
 			}
 
+			var event *wire.Event
 			switch sseData.Type {
+			case "error":
+				return completion, wire.NewAPIError(0, strings.NewReader(payload))
+			case "message_start":
+				start := MessageStart{}
+				err := json.Unmarshal([]byte(payload), &start)
+				if err != nil {
+					return completion, err
+				}
+				completion.Model = start.Message.Model
+				completion.Usage = wire.Usage{
+					InputTokens:              start.Message.Usage.InputTokens,
+					OutputTokens:             start.Message.Usage.OutputTokens,
+					CacheCreationInputTokens: start.Message.Usage.CacheCreationInputTokens,
+					CacheReadInputTokens:     start.Message.Usage.CacheReadInputTokens,
+				}
+				usage := completion.Usage
+				event = &wire.Event{Type: wire.EventStart, Model: completion.Model, Usage: &usage}
 			case "content_block_delta":
 				content := ContentBlockDelta{}
 				err := json.Unmarshal([]byte(payload), &content)
 				if err != nil {
-					return "", err
+					return completion, err
+				}
+				if content.Delta.Type == "citations_delta" {
+					if content.Delta.Citation != nil {
+						citations = append(citations, *content.Delta.Citation)
+					}
+					break
+				}
+				completion.Text += content.Delta.Text
+				event = &wire.Event{Type: wire.EventText, Text: content.Delta.Text}
+			case "content_block_stop":
+				for _, citation := range citations {
+					completion.Citations = append(completion.Citations, citation)
+					// Handlers may keep the event, each needs its own copy of the loop variable
+					c := citation
+					if err := handler.Emit(wire.Event{Type: wire.EventCitation, Citation: &c}); err != nil {
+						return completion, err
+					}
+				}
+				citations = nil
+			case "message_delta":
+				delta := MessageDelta{}
+				err := json.Unmarshal([]byte(payload), &delta)
+				if err != nil {
+					return completion, err
+				}
+				// The output token count in a message_delta is cumulative
+				completion.StopReason = delta.Delta.StopReason
+				completion.Usage.OutputTokens = delta.Usage.OutputTokens
+				usage := completion.Usage
+				event = &wire.Event{Type: wire.EventStop, StopReason: completion.StopReason, Usage: &usage}
+			}
+
+			if event != nil {
+				if err := handler.Emit(*event); err != nil {
+					return completion, err
 				}
-				fmt.Printf("%s", content.Delta.Text)
-				text += content.Delta.Text
 			}
 
 		}
 
 	}
 
-	fmt.Println()
+	if err := scanner.Err(); err != nil {
+		return completion, fmt.Errorf("reading response stream: %w", err)
+	}
 
-	return text, nil
+	completion.Timing = stopwatch.Timing(completion.Usage.OutputTokens)
+	return completion, nil
 }
@@ -2,33 +2,278 @@ package anthropic_test
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/davidhbaek/llm/internal/anthropic"
+	"github.com/davidhbaek/llm/internal/replay"
 	"github.com/davidhbaek/llm/internal/wire"
 	"github.com/stretchr/testify/require"
 )
 
-func TestSendMessage(t *testing.T) {
-	client := anthropic.NewClient("claude-3-haiku-20240307")
+var record = flag.Bool("record", false, "record the fixtures in testdata from the real API, needs ANTHROPIC_API_KEY")
 
+// newTestClient replays the API's responses from testdata/<fixture>.json, or records them with -record
+func newTestClient(t *testing.T, fixture string) *anthropic.Client {
+	transport := replay.NewTransport(filepath.Join("testdata", fixture+".json"), *record)
+	t.Cleanup(func() {
+		require.NoError(t, transport.Save())
+	})
+
+	return anthropic.NewClient("claude-3-haiku-20240307", anthropic.WithHTTPClient(&http.Client{Transport: transport}))
+}
+
+func TestSendMessage(t *testing.T) {
 	tests := []struct {
 		Name               string
+		Fixture            string
 		ExpectedStatusCode int
+		ExpectedText       string
 		InputMsg           []wire.Message
-		SystemPrompt       string
+		SystemPrompt       []wire.Text
 	}{
-		{Name: "Hello Claude", ExpectedStatusCode: http.StatusOK, InputMsg: []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello Claude"}}}}},
-		{Name: "Empty input should return bad request", ExpectedStatusCode: http.StatusBadRequest, InputMsg: []wire.Message{{}}}, // empty prompt
-
+		{
+			Name:               "Hello Claude",
+			Fixture:            "send_message",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedText:       "Hello! How can I help you today?",
+			InputMsg:           []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello Claude"}}}},
+		},
+		{
+			Name:               "System prompt",
+			Fixture:            "send_message_system",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedText:       "Ahoy, matey!",
+			InputMsg:           []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Say hello"}}}},
+			SystemPrompt:       wire.SystemPrompt("Talk like a pirate"),
+		},
+		{
+			Name:               "Empty input should return bad request",
+			Fixture:            "send_message_empty",
+			ExpectedStatusCode: http.StatusBadRequest,
+			InputMsg:           []wire.Message{{}},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
+			client := newTestClient(t, test.Fixture)
+
 			rsp, err := client.SendMessage(context.Background(), test.InputMsg, test.SystemPrompt)
 			require.NoError(t, err)
 			require.Equal(t, test.ExpectedStatusCode, rsp.StatusCode)
+
+			if rsp.StatusCode != http.StatusOK {
+				return
+			}
+
+			completion, err := client.ReadBody(rsp.Body, nil)
+			require.NoError(t, err)
+			require.Equal(t, test.ExpectedText, completion.Text)
+			require.Equal(t, "end_turn", completion.StopReason)
+		})
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	client := newTestClient(t, "count_tokens")
+
+	messages := []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello Claude"}}}}
+	tokens, err := client.CountTokens(context.Background(), messages, nil)
+	require.NoError(t, err)
+	require.Equal(t, 10, tokens)
+}
+
+func TestReadBody(t *testing.T) {
+	client := anthropic.NewClient("claude-3-haiku-20240307")
+
+	tests := []struct {
+		Name         string
+		Stream       string
+		ExpectedText string
+		ExpectedErr  bool
+	}{
+		{
+			Name: "text deltas are joined",
+			Stream: strings.Join([]string{
+				`event: message_start`,
+				`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-haiku-20240307","usage":{"input_tokens":10,"output_tokens":1}}}`,
+				`event: content_block_delta`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+				`event: content_block_delta`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" error"}}`,
+				`event: message_delta`,
+				`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+				`event: message_stop`,
+				`data: {"type":"message_stop"}`,
+			}, "\n"),
+			ExpectedText: "Hello error",
+		},
+		{
+			Name: "error mid-stream keeps partial text",
+			Stream: strings.Join([]string{
+				`event: content_block_delta`,
+				`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+				`event: error`,
+				`data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+			}, "\n"),
+			ExpectedText: "Hel",
+			ExpectedErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			completion, err := client.ReadBody(strings.NewReader(test.Stream), nil)
+			if test.ExpectedErr {
+				var apiErr *wire.APIError
+				require.ErrorAs(t, err, &apiErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, test.ExpectedText, completion.Text)
 		})
 	}
 }
+
+func TestReadBodyCitations(t *testing.T) {
+	client := anthropic.NewClient("claude-3-5-sonnet-20241022")
+
+	stream := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-5-sonnet-20241022","usage":{"input_tokens":1200,"output_tokens":1}}}`,
+		`event: content_block_start`,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"According to the report, "}}`,
+		`event: content_block_stop`,
+		`data: {"type":"content_block_stop","index":0}`,
+		`event: content_block_start`,
+		`data: {"type":"content_block_start","index":1,"content_block":{"type":"text","text":"","citations":[]}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"citations_delta","citation":{"type":"page_location","cited_text":"Revenue grew 12% in 2023.","document_index":0,"document_title":"report.pdf","start_page_number":3,"end_page_number":4}}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"revenue grew 12%"}}`,
+		`event: content_block_stop`,
+		`data: {"type":"content_block_stop","index":1}`,
+		`event: message_delta`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":12}}`,
+	}, "\n")
+
+	var events []wire.Event
+	completion, err := client.ReadBody(strings.NewReader(stream), func(event wire.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	require.NoError(t, err)
+
+	expected := wire.Citation{
+		Type:            "page_location",
+		CitedText:       "Revenue grew 12% in 2023.",
+		DocumentTitle:   "report.pdf",
+		StartPageNumber: 3,
+		EndPageNumber:   4,
+	}
+	require.Equal(t, "According to the report, revenue grew 12%", completion.Text)
+	require.Equal(t, []wire.Citation{expected}, completion.Citations)
+	require.Equal(t, "p. 3", expected.Location())
+
+	// The citation follows the text it supports
+	var types []wire.EventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	require.Equal(t, []wire.EventType{wire.EventStart, wire.EventText, wire.EventText, wire.EventCitation, wire.EventStop}, types)
+	require.Equal(t, &expected, events[3].Citation)
+}
+
+func TestReadBodyCitationsInOneBlock(t *testing.T) {
+	client := anthropic.NewClient("claude-3-5-sonnet-20241022")
+
+	stream := strings.Join([]string{
+		`event: message_start`,
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-3-5-sonnet-20241022","usage":{"input_tokens":1200,"output_tokens":1}}}`,
+		`event: content_block_start`,
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":"","citations":[]}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"citations_delta","citation":{"type":"char_location","cited_text":"A","document_index":0,"start_char_index":0,"end_char_index":1}}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"citations_delta","citation":{"type":"char_location","cited_text":"B","document_index":0,"start_char_index":1,"end_char_index":2}}}`,
+		`event: content_block_delta`,
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"A and B"}}`,
+		`event: content_block_stop`,
+		`data: {"type":"content_block_stop","index":0}`,
+		`event: message_delta`,
+		`data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":4}}`,
+	}, "\n")
+
+	// Handlers like the cache keep the events they're given
+	var events []wire.Event
+	completion, err := client.ReadBody(strings.NewReader(stream), func(event wire.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var cited []string
+	for _, event := range events {
+		if event.Type == wire.EventCitation {
+			cited = append(cited, event.Citation.CitedText)
+		}
+	}
+	require.Len(t, completion.Citations, 2)
+	require.Equal(t, []string{"A", "B"}, cited)
+}
+
+func TestSendMessageImageURLs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request shouldn't be sent")
+	}))
+	defer ts.Close()
+	client := anthropic.NewClient("claude-3-haiku-20240307", anthropic.WithBaseURL(ts.URL))
+
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	require.NoError(t, os.WriteFile(secret, []byte("TOPSECRET-KEY"), 0o600))
+
+	// Images in OpenAI's format are never read from disk or downloaded, only data and https URLs are passed on
+	for _, url := range []string{secret, "file://" + secret, "http://169.254.169.254/latest/meta-data/"} {
+		image := &wire.OpenAIImage{Type: "image_url"}
+		image.ImageURL.URL = url
+
+		_, err := client.SendMessage(context.Background(), []wire.Message{{Role: "user", Content: []wire.Content{image}}}, nil)
+		require.ErrorContains(t, err, "only base64 data URLs and https URLs are supported", url)
+	}
+}
+
+func TestSendMessageImageURLPassedOn(t *testing.T) {
+	var sent struct {
+		Messages []struct {
+			Content []json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&sent))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+	client := anthropic.NewClient("claude-3-haiku-20240307", anthropic.WithBaseURL(ts.URL))
+
+	native := &wire.AnthropicImage{Type: "image"}
+	native.Source.Type = "url"
+	native.Source.URL = "https://example.com/cat.png"
+	openAI := &wire.OpenAIImage{Type: "image_url"}
+	openAI.ImageURL.URL = "https://example.com/dog.png"
+
+	_, err := client.SendMessage(context.Background(), []wire.Message{{Role: "user", Content: []wire.Content{native, openAI}}}, nil)
+	require.NoError(t, err)
+
+	// Anthropic fetches the images itself
+	require.JSONEq(t, `{"type":"image","source":{"type":"url","url":"https://example.com/cat.png"}}`, string(sent.Messages[0].Content[0]))
+	require.JSONEq(t, `{"type":"image","source":{"type":"url","url":"https://example.com/dog.png"}}`, string(sent.Messages[0].Content[1]))
+}
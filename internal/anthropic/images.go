@@ -2,18 +2,20 @@ package anthropic
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/davidhbaek/llm/internal/wire"
 	"github.com/nfnt/resize"
 )
 
@@ -32,6 +34,8 @@ func (f *fileList) Set(value string) error {
 	return nil
 }
 
+// DownloadImage reads an image from a file or an https URL
+// Only for paths given on the command line, never for ones in requests from the server's callers
 func DownloadImage(path string) ([]byte, error) {
 	buffer := bytes.Buffer{}
 
@@ -71,7 +75,7 @@ func DownloadImage(path string) ([]byte, error) {
 			return buffer.Bytes(), nil
 		}
 
-		log.Printf("re-sizing photo at path=%s", path)
+		slog.Debug("resizing image", "path", path)
 
 		targetSize := float64(maxSize) / float64(fileInfo.Size())
 
@@ -84,8 +88,7 @@ func DownloadImage(path string) ([]byte, error) {
 
 			err = jpeg.Encode(&buffer, resizeImg(img, targetSize), &jpeg.Options{Quality: jpeg.DefaultQuality})
 			if err != nil {
-				fmt.Println("Error creating output file:", err)
-				return nil, err
+				return nil, fmt.Errorf("resizing image: %w", err)
 			}
 
 		case "png":
@@ -97,8 +100,7 @@ func DownloadImage(path string) ([]byte, error) {
 			encoder := png.Encoder{CompressionLevel: png.BestCompression}
 			err = encoder.Encode(&buffer, resizeImg(img, targetSize))
 			if err != nil {
-				fmt.Println("Error creating output file:", err)
-				return nil, err
+				return nil, fmt.Errorf("resizing image: %w", err)
 			}
 
 		}
@@ -108,6 +110,31 @@ func DownloadImage(path string) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// imageFromURL creates an image block from a base64 data URL, or an https URL that Anthropic fetches itself
+// Images in requests are never downloaded or read from disk here, since requests can come from the server's callers
+func imageFromURL(url string) (*wire.AnthropicImage, error) {
+	image := &wire.AnthropicImage{Type: "image"}
+	if strings.HasPrefix(url, "https://") {
+		image.Source.Type = "url"
+		image.Source.URL = url
+		return image, nil
+	}
+
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return nil, errors.New("only base64 data URLs and https URLs are supported")
+	}
+	mediaType, data, ok := strings.Cut(rest, ";base64,")
+	if !ok {
+		return nil, errors.New("only base64 data URLs and https URLs are supported")
+	}
+
+	image.Source.Type = "base64"
+	image.Source.MediaType = mediaType
+	image.Source.Data = data
+	return image, nil
+}
+
 func resizeImg(img image.Image, size float64) image.Image {
 	width := uint(float64(img.Bounds().Dx()) * size)
 	height := uint(float64(img.Bounds().Dy()) * size)
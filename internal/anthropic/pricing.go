@@ -1,5 +1,11 @@
 package anthropic
 
+import (
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
 // Price is shown as $USD per 1M tokens
 const (
 	HAIKU_INPUT_COST  = 0.25 / 1000000
@@ -10,20 +16,26 @@ const (
 
 	OPUS_INPUT_COST  = 15.00 / 1000000
 	OPUS_OUTPUT_COST = 75.00 / 1000000
+
+	// Prompt cache writes and reads are priced relative to the model's input cost
+	CACHE_WRITE_MULTIPLIER = 1.25
+	CACHE_READ_MULTIPLIER  = 0.10
 )
 
-// func getCost(model string, usage Usage) float64 {
-// 	var cost float64
-// 	switch model {
-// 	case HAIKU:
-// 		cost = float64(usage.InputTokens)*HAIKU_INPUT_COST + float64(usage.OutputTokens)*HAIKU_OUTPUT_COST
-// 	case SONNET:
-// 		cost = float64(usage.InputTokens)*SONNET_INPUT_COST + float64(usage.OutputTokens)*SONNET_OUTPUT_COST
-// 	case OPUS:
-// 		cost = float64(usage.InputTokens)*OPUS_INPUT_COST + float64(usage.OutputTokens)*OPUS_OUTPUT_COST
-// 	}
-
-// 	log.Printf("cost of query: $%f", cost)
-
-// 	return cost
-// }
+// Cost returns the price in $USD of a request to model, zero for unknown models
+func Cost(model string, usage wire.Usage) float64 {
+	var inputCost, outputCost float64
+	switch {
+	case strings.Contains(model, "haiku"):
+		inputCost, outputCost = HAIKU_INPUT_COST, HAIKU_OUTPUT_COST
+	case strings.Contains(model, "sonnet"):
+		inputCost, outputCost = SONNET_INPUT_COST, SONNET_OUTPUT_COST
+	case strings.Contains(model, "opus"):
+		inputCost, outputCost = OPUS_INPUT_COST, OPUS_OUTPUT_COST
+	}
+
+	return float64(usage.InputTokens)*inputCost +
+		float64(usage.CacheCreationInputTokens)*inputCost*CACHE_WRITE_MULTIPLIER +
+		float64(usage.CacheReadInputTokens)*inputCost*CACHE_READ_MULTIPLIER +
+		float64(usage.OutputTokens)*outputCost
+}
@@ -1,5 +1,7 @@
 package anthropic
 
+import "github.com/davidhbaek/llm/internal/wire"
+
 // Server-Sent-Events (SSE)
 type SSEMessage struct {
 	Event string `json:"event"`
@@ -16,5 +18,25 @@ type ContentBlockDelta struct {
 	Delta struct {
 		Type string `json:"type"`
 		Text string `json:"text"`
+		// Set when Type is citations_delta
+		Citation *wire.Citation `json:"citation"`
 	} `json:"Delta"`
 }
+
+type MessageStart struct {
+	Type    string `json:"type"`
+	Message struct {
+		ID    string `json:"id"`
+		Model string `json:"model"`
+		Usage Usage  `json:"usage"`
+	} `json:"message"`
+}
+
+type MessageDelta struct {
+	Type  string `json:"type"`
+	Delta struct {
+		StopReason   string `json:"stop_reason"`
+		StopSequence string `json:"stop_sequence"`
+	} `json:"delta"`
+	Usage Usage `json:"usage"`
+}
@@ -0,0 +1,158 @@
+// Package cache stores complete responses on disk and replays them for identical requests
+//
+// Requests are keyed by a hash of the model, messages, system prompt and options.
+// Only responses that streamed to the end with a stop reason are stored, errors are never cached
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Client is the llm.Client being cached
+type Client interface {
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error)
+	Model() string
+}
+
+// CachedClient wraps a Client, answering requests it has seen before from the store
+type CachedClient struct {
+	client Client
+	store  *Store
+}
+
+func Wrap(client Client, store *Store) *CachedClient {
+	return &CachedClient{client: client, store: store}
+}
+
+// Middleware caches responses in store
+func Middleware(store *Store) middleware.Middleware {
+	return func(next middleware.Client) middleware.Client {
+		return Wrap(next, store)
+	}
+}
+
+func (c *CachedClient) Model() string {
+	return c.client.Model()
+}
+
+func (c *CachedClient) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return c.client.CountTokens(ctx, messages, system)
+}
+
+// hitBody is the body of a response answered from the cache
+type hitBody struct {
+	*bytes.Reader
+	entry *Entry
+}
+
+// missBody is the body of a response from the provider, stored once it's read to the end
+type missBody struct {
+	io.Reader
+	key    string
+	logger *slog.Logger
+}
+
+func (b *missBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *CachedClient) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	key, err := Key(c.client.Model(), messages, system, wire.NewOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.FromContext(ctx, nil)
+	if entry, ok := c.store.Get(key); ok {
+		logger.Debug("cache hit", "key", key[:12])
+		if err := c.store.count(true); err != nil {
+			logger.Warn("counting cache hit", "error", err)
+		}
+		return &wire.Response{StatusCode: http.StatusOK, Body: &hitBody{Reader: bytes.NewReader(nil), entry: entry}}, nil
+	}
+
+	logger.Debug("cache miss", "key", key[:12])
+	if err := c.store.count(false); err != nil {
+		logger.Warn("counting cache miss", "error", err)
+	}
+
+	rsp, err := c.client.SendMessage(ctx, messages, system, opts...)
+	if err != nil || rsp.StatusCode != http.StatusOK {
+		return rsp, err
+	}
+
+	return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: &missBody{Reader: rsp.Body, key: key, logger: logger}}, nil
+}
+
+// ReadBody replays a cached response's events without delay, or reads and stores the provider's response
+func (c *CachedClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	switch b := body.(type) {
+	case *hitBody:
+		for _, event := range b.entry.Events {
+			if err := handler.Emit(event); err != nil {
+				return b.entry.Completion, err
+			}
+		}
+		return b.entry.Completion, nil
+	case *missBody:
+		var events []wire.Event
+		completion, err := c.client.ReadBody(b.Reader, func(event wire.Event) error {
+			events = append(events, event)
+			return handler.Emit(event)
+		})
+		if err != nil {
+			return completion, err
+		}
+		// A stream that ended without saying why may have been cut short
+		if completion.StopReason == "" {
+			b.logger.Debug("not caching a response without a stop reason", "key", b.key[:12])
+			return completion, nil
+		}
+
+		// Replays aren't timed, the original response's timing would be misleading
+		stored := *completion
+		stored.Timing = nil
+		entry := &Entry{Key: b.key, Created: time.Now().UTC(), Events: events, Completion: &stored}
+		if err := c.store.Put(entry); err != nil {
+			// A response that can't be cached is still a response
+			b.logger.Warn("caching response", "error", err)
+		}
+		return completion, nil
+	default:
+		return c.client.ReadBody(body, handler)
+	}
+}
+
+// Key hashes everything about a request that changes its response
+func Key(model string, messages []wire.Message, system []wire.Text, options wire.Options) (string, error) {
+	bytes, err := json.Marshal(struct {
+		Model    string         `json:"model"`
+		Messages []wire.Message `json:"messages"`
+		System   []wire.Text    `json:"system"`
+		Options  wire.Options   `json:"options"`
+	}{model, messages, system, options})
+	if err != nil {
+		return "", fmt.Errorf("hashing request: %w", err)
+	}
+
+	sum := sha256.Sum256(bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,144 @@
+package cache_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/cache"
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func userMessage(text string) []wire.Message {
+	return []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}}
+}
+
+// send sends a request through the client and reads the whole response
+func send(t *testing.T, client *cache.CachedClient, text string, opts ...wire.Option) (*wire.Completion, []wire.Event) {
+	rsp, err := client.SendMessage(context.Background(), userMessage(text), wire.SystemPrompt("Be brief"), opts...)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	var events []wire.Event
+	completion, err := client.ReadBody(rsp.Body, func(event wire.Event) error {
+		events = append(events, event)
+		return nil
+	})
+	require.NoError(t, err)
+	return completion, events
+}
+
+func TestCachedClient(t *testing.T) {
+	store := cache.NewStore(t.TempDir(), time.Hour, 0)
+	inner := fake.NewClient(fake.Echo)
+	client := cache.Wrap(inner, store)
+
+	first, firstEvents := send(t, client, "Hello there")
+	second, secondEvents := send(t, client, "Hello there")
+	require.Len(t, inner.Calls(), 1)
+	// Only the provider's response is timed
+	require.NotNil(t, first.Timing)
+	require.Nil(t, second.Timing)
+	first.Timing = nil
+	require.Equal(t, first, second)
+	require.Equal(t, firstEvents, secondEvents)
+
+	// Anything else about the request is a different key
+	send(t, client, "Hello there", wire.WithTemperature(0))
+	send(t, client, "General Kenobi")
+	require.Len(t, inner.Calls(), 3)
+
+	stats, err := store.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Entries)
+	require.Equal(t, int64(1), stats.Hits)
+	require.Equal(t, int64(3), stats.Misses)
+
+	cleared, err := store.Clear()
+	require.NoError(t, err)
+	require.Equal(t, 3, cleared)
+
+	send(t, client, "Hello there")
+	require.Len(t, inner.Calls(), 4)
+}
+
+func TestErrorsAreNotCached(t *testing.T) {
+	store := cache.NewStore(t.TempDir(), time.Hour, 0)
+
+	limited := cache.Wrap(fake.NewClient(fake.RateLimited), store)
+	for i := 0; i < 2; i++ {
+		rsp, err := limited.SendMessage(context.Background(), userMessage("hi"), nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusTooManyRequests, rsp.StatusCode)
+	}
+
+	disconnect := fake.NewClient(fake.Disconnect)
+	client := cache.Wrap(disconnect, store)
+	for i := 0; i < 2; i++ {
+		rsp, err := client.SendMessage(context.Background(), userMessage("hi"), nil)
+		require.NoError(t, err)
+		_, err = client.ReadBody(rsp.Body, nil)
+		require.Error(t, err)
+	}
+	require.Len(t, disconnect.Calls(), 2)
+
+	stats, err := store.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Entries)
+}
+
+// unfinishedClient's streams end cleanly without saying why, like a stream missing its message_stop
+type unfinishedClient struct {
+	*fake.Client
+}
+
+func (c unfinishedClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	completion, err := c.Client.ReadBody(body, handler)
+	if completion != nil {
+		completion.StopReason = ""
+	}
+	return completion, err
+}
+
+func TestUnfinishedAreNotCached(t *testing.T) {
+	store := cache.NewStore(t.TempDir(), time.Hour, 0)
+	inner := fake.NewClient(fake.Echo)
+	client := cache.Wrap(unfinishedClient{inner}, store)
+
+	send(t, client, "Hello there")
+	send(t, client, "Hello there")
+	require.Len(t, inner.Calls(), 2)
+
+	stats, err := store.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Entries)
+}
+
+func TestStoreExpiresAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	store := cache.NewStore(dir, time.Hour, 0)
+
+	require.NoError(t, store.Put(&cache.Entry{Key: "old", Created: time.Now().Add(-2 * time.Hour), Completion: &wire.Completion{Text: "old"}}))
+	_, ok := store.Get("old")
+	require.False(t, ok)
+
+	// With room for about two entries, the oldest is deleted to make room for a third
+	store = cache.NewStore(dir, time.Hour, 400)
+	for i, key := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Put(&cache.Entry{Key: key, Created: time.Now(), Completion: &wire.Completion{Text: "some response text"}}))
+		// Entries are aged by their file's modification time
+		mtime := time.Now().Add(time.Duration(i-3) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, key+".json"), mtime, mtime))
+	}
+
+	_, ok = store.Get("a")
+	require.False(t, ok)
+	_, ok = store.Get("c")
+	require.True(t, ok)
+}
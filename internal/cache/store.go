@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Entry is a complete response stored in the cache
+type Entry struct {
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	// Every event of the response in order, replayed on a hit
+	Events     []wire.Event     `json:"events"`
+	Completion *wire.Completion `json:"completion"`
+}
+
+// Store keeps responses on disk, one file per entry
+type Store struct {
+	dir string
+	// Entries older than this are ignored and deleted
+	ttl time.Duration
+	// Oldest entries are deleted once the store is larger than this, by when they were stored
+	// since hits don't touch their files, so it's first in first out rather than least recently used
+	maxBytes int64
+}
+
+// Defaults for the CLI's cache
+const (
+	DefaultTTL      = 7 * 24 * time.Hour
+	DefaultMaxBytes = 100 * 1024 * 1024
+)
+
+// Dir is where responses are cached, LLM_CACHE_DIR overrides the default in the user's cache directory
+func Dir() (string, error) {
+	if dir := os.Getenv("LLM_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "llm", "responses"), nil
+}
+
+func NewStore(dir string, ttl time.Duration, maxBytes int64) *Store {
+	return &Store{dir: dir, ttl: ttl, maxBytes: maxBytes}
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// Get returns the entry for key, or false when it's missing or expired
+func (s *Store) Get(key string) (*Entry, bool) {
+	bytes, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	entry := &Entry{}
+	if err := json.Unmarshal(bytes, entry); err != nil {
+		return nil, false
+	}
+
+	if s.expired(entry.Created) {
+		os.Remove(s.path(key))
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (s *Store) expired(created time.Time) bool {
+	return s.ttl > 0 && time.Since(created) > s.ttl
+}
+
+// Put stores an entry, then deletes the oldest entries if the store is over its size limit
+func (s *Store) Put(entry *Entry) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a concurrent Get never reads half an entry
+	tmp, err := os.CreateTemp(s.dir, entry.Key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(bytes); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(entry.Key)); err != nil {
+		return err
+	}
+
+	return s.prune()
+}
+
+type file struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// entries lists the files of every entry, the earliest stored first
+func (s *Store) entries() ([]file, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []file
+	for _, d := range dirEntries {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".json") || d.Name() == statsFile {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{path: filepath.Join(s.dir, d.Name()), size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	return files, nil
+}
+
+// prune deletes expired entries, then the oldest ones until the store fits in its size limit
+func (s *Store) prune() error {
+	files, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var kept []file
+	for _, f := range files {
+		if s.expired(f.modTime) {
+			os.Remove(f.path)
+			continue
+		}
+		total += f.size
+		kept = append(kept, f)
+	}
+
+	for _, f := range kept {
+		if s.maxBytes <= 0 || total <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		total -= f.size
+	}
+
+	return nil
+}
+
+// Clear deletes every entry and the hit counts, returning how many entries there were
+func (s *Store) Clear() (int, error) {
+	files, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, f := range files {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+	os.Remove(filepath.Join(s.dir, statsFile))
+
+	return len(files), nil
+}
+
+// Stats describe what's in the store and how often it's been used
+type Stats struct {
+	Dir     string `json:"dir"`
+	Entries int    `json:"entries"`
+	Expired int    `json:"expired"`
+	Bytes   int64  `json:"bytes"`
+	Hits    int64  `json:"hits"`
+	Misses  int64  `json:"misses"`
+}
+
+func (s *Store) Stats() (Stats, error) {
+	stats := Stats{Dir: s.dir}
+
+	files, err := s.entries()
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		if s.expired(f.modTime) {
+			stats.Expired++
+			continue
+		}
+		stats.Entries++
+		stats.Bytes += f.size
+	}
+
+	counts := s.readCounts()
+	stats.Hits, stats.Misses = counts.Hits, counts.Misses
+
+	return stats, nil
+}
+
+// Hits and misses are counted across runs in a file next to the entries
+const statsFile = "stats.json"
+
+type counts struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func (s *Store) readCounts() counts {
+	var c counts
+	if bytes, err := os.ReadFile(filepath.Join(s.dir, statsFile)); err == nil {
+		json.Unmarshal(bytes, &c)
+	}
+	return c
+}
+
+// count adds a hit or a miss to the counts
+// Concurrent processes can lose a count, which is fine for stats
+func (s *Store) count(hit bool) error {
+	c := s.readCounts()
+	if hit {
+		c.Hits++
+	} else {
+		c.Misses++
+	}
+
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, statsFile), bytes, 0o644); err != nil {
+		return fmt.Errorf("writing cache stats: %w", err)
+	}
+	return nil
+}
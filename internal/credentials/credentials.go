@@ -0,0 +1,258 @@
+// Package credentials finds the API keys of LLM providers
+//
+// Keys are looked up in a chain of sources and the first one with a provider's key wins.
+// The default chain, for a provider like anthropic, is:
+//
+//	env      the ANTHROPIC_API_KEY environment variable
+//	.env     the same variable in a .env file in the working directory
+//	command  the output of the command in LLM_ANTHROPIC_KEY_COMMAND, e.g. a password manager
+//	file     ~/.config/llm/keys/anthropic, which only its owner may read
+//	keyring  ~/.config/llm/keyring.json, encrypted with the passphrase in LLM_KEYRING_PASSPHRASE
+//
+// A source that has a key but can't hand it over, like a key file other users can read, is an
+// error rather than being skipped, so a key is never silently taken from somewhere else
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// ErrNotFound is returned by a source that doesn't have a provider's key
+var ErrNotFound = errors.New("no API key found")
+
+// Source is somewhere API keys are kept
+type Source interface {
+	// Key returns the provider's key, or ErrNotFound
+	Key(provider string) (string, error)
+	// Describe says where the source looks for the provider's key, without revealing the key
+	Describe(provider string) string
+}
+
+// EnvVar is the environment variable holding the provider's key, e.g. ANTHROPIC_API_KEY
+func EnvVar(provider string) string {
+	return strings.ToUpper(provider) + "_API_KEY"
+}
+
+// Env reads keys from environment variables named by EnvVar
+type Env struct{}
+
+func (Env) Key(provider string) (string, error) {
+	if key := strings.TrimSpace(os.Getenv(EnvVar(provider))); key != "" {
+		return key, nil
+	}
+	return "", ErrNotFound
+}
+
+func (Env) Describe(provider string) string {
+	return "environment variable " + EnvVar(provider)
+}
+
+// DotEnv reads keys from a .env file, in the variables named by EnvVar
+type DotEnv struct {
+	Path string
+}
+
+func (d DotEnv) Key(provider string) (string, error) {
+	vars, err := godotenv.Read(d.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", d.Path, err)
+	}
+
+	if key := strings.TrimSpace(vars[EnvVar(provider)]); key != "" {
+		return key, nil
+	}
+	return "", ErrNotFound
+}
+
+func (d DotEnv) Describe(provider string) string {
+	return fmt.Sprintf("%s in %s", EnvVar(provider), d.Path)
+}
+
+// CommandVar is the environment variable holding the command that prints the provider's key, e.g. LLM_ANTHROPIC_KEY_COMMAND
+func CommandVar(provider string) string {
+	return "LLM_" + strings.ToUpper(provider) + "_KEY_COMMAND"
+}
+
+// How long a key command may take, e.g. for a password manager to be unlocked
+const commandTimeout = time.Minute
+
+// Command runs the shell command in the variable named by CommandVar and reads the key from its output
+type Command struct{}
+
+func (Command) Key(provider string) (string, error) {
+	command := os.Getenv(CommandVar(provider))
+	if command == "" {
+		return "", ErrNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	// Password managers may ask for their passphrase
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s: %w", CommandVar(provider), err)
+	}
+
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", fmt.Errorf("running %s: the command didn't print a key", CommandVar(provider))
+	}
+	return key, nil
+}
+
+func (Command) Describe(provider string) string {
+	return "output of the command in " + CommandVar(provider)
+}
+
+// KeyFile reads the provider's key from a file named after it in Dir
+// The file must only be readable by its owner, like SSH keys
+type KeyFile struct {
+	Dir string
+}
+
+func (f KeyFile) path(provider string) string {
+	return filepath.Join(f.Dir, provider)
+}
+
+func (f KeyFile) Key(provider string) (string, error) {
+	path := f.path(provider)
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Windows doesn't have Unix permissions to check
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("key file %s can be accessed by other users, restrict it with: chmod 600 %s", path, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("key file %s is empty", path)
+	}
+	return key, nil
+}
+
+func (f KeyFile) Describe(provider string) string {
+	return "key file " + f.path(provider)
+}
+
+// Resolver looks up keys in a chain of sources, remembering the keys it found
+type Resolver struct {
+	sources []Source
+
+	mu    sync.Mutex
+	found map[string]found
+}
+
+type found struct {
+	key    string
+	source string
+}
+
+// NewResolver looks up keys in the sources, in order
+func NewResolver(sources ...Source) *Resolver {
+	return &Resolver{sources: sources, found: map[string]found{}}
+}
+
+// ConfigDir is where key files and the keyring are kept, llm in the user's config directory
+func ConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "llm"), nil
+}
+
+// PassphraseVar is the environment variable holding the keyring's passphrase
+const PassphraseVar = "LLM_KEYRING_PASSPHRASE"
+
+// Default is the standard chain of sources, see the package docs
+// Key files and the keyring are left out when there's no config directory
+func Default() *Resolver {
+	sources := []Source{Env{}, DotEnv{Path: ".env"}, Command{}}
+
+	if dir, err := ConfigDir(); err == nil {
+		sources = append(sources,
+			KeyFile{Dir: filepath.Join(dir, "keys")},
+			DefaultKeyring(dir),
+		)
+	}
+
+	return NewResolver(sources...)
+}
+
+// DefaultKeyring is the keyring in dir, unlocked with the passphrase in PassphraseVar
+func DefaultKeyring(dir string) *Keyring {
+	return &Keyring{
+		Path: filepath.Join(dir, "keyring.json"),
+		Passphrase: func() (string, error) {
+			if passphrase := os.Getenv(PassphraseVar); passphrase != "" {
+				return passphrase, nil
+			}
+			return "", fmt.Errorf("the keyring is locked, set %s", PassphraseVar)
+		},
+	}
+}
+
+// Lookup returns the provider's key and a description of the source it came from
+// When no source has it the error is ErrNotFound, explaining where to put the key
+func (r *Resolver) Lookup(provider string) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.found[provider]; ok {
+		return f.key, f.source, nil
+	}
+
+	for _, source := range r.sources {
+		key, err := source.Key(provider)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", source.Describe(provider), err
+		}
+
+		r.found[provider] = found{key: key, source: source.Describe(provider)}
+		return key, source.Describe(provider), nil
+	}
+
+	return "", "", fmt.Errorf("%w for %s, set %s or see llm auth status", ErrNotFound, provider, EnvVar(provider))
+}
+
+// Key returns the provider's key
+func (r *Resolver) Key(provider string) (string, error) {
+	key, _, err := r.Lookup(provider)
+	return key, err
+}
@@ -0,0 +1,155 @@
+package credentials_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/credentials"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnv(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", " sk-env\n")
+
+	key, err := credentials.Env{}.Key("anthropic")
+	require.NoError(t, err)
+	require.Equal(t, "sk-env", key)
+
+	t.Setenv("OPENAI_API_KEY", "")
+	_, err = credentials.Env{}.Key("openai")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+}
+
+func TestDotEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	require.NoError(t, os.WriteFile(path, []byte("# keys\nANTHROPIC_API_KEY=\"sk-dotenv\"\n"), 0o600))
+
+	key, err := credentials.DotEnv{Path: path}.Key("anthropic")
+	require.NoError(t, err)
+	require.Equal(t, "sk-dotenv", key)
+
+	_, err = credentials.DotEnv{Path: path}.Key("openai")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+
+	_, err = credentials.DotEnv{Path: filepath.Join(t.TempDir(), ".env")}.Key("anthropic")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+}
+
+func TestCommand(t *testing.T) {
+	t.Setenv("LLM_ANTHROPIC_KEY_COMMAND", "echo sk-command")
+	key, err := credentials.Command{}.Key("anthropic")
+	require.NoError(t, err)
+	require.Equal(t, "sk-command", key)
+
+	t.Setenv("LLM_ANTHROPIC_KEY_COMMAND", "exit 1")
+	_, err = credentials.Command{}.Key("anthropic")
+	require.ErrorContains(t, err, "LLM_ANTHROPIC_KEY_COMMAND")
+
+	t.Setenv("LLM_ANTHROPIC_KEY_COMMAND", "true")
+	_, err = credentials.Command{}.Key("anthropic")
+	require.ErrorContains(t, err, "didn't print a key")
+
+	t.Setenv("LLM_ANTHROPIC_KEY_COMMAND", "")
+	_, err = credentials.Command{}.Key("anthropic")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "anthropic")
+	require.NoError(t, os.WriteFile(path, []byte("sk-file\n"), 0o600))
+
+	source := credentials.KeyFile{Dir: dir}
+	key, err := source.Key("anthropic")
+	require.NoError(t, err)
+	require.Equal(t, "sk-file", key)
+
+	// Other users mustn't be able to read it
+	require.NoError(t, os.Chmod(path, 0o644))
+	_, err = source.Key("anthropic")
+	require.ErrorContains(t, err, "chmod 600")
+
+	_, err = source.Key("openai")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "llm", "keyring.json")
+	passphrase := "correct horse"
+	keyring := &credentials.Keyring{
+		Path:       path,
+		Passphrase: func() (string, error) { return passphrase, nil },
+		Iterations: 10,
+	}
+
+	_, err := keyring.Key("anthropic")
+	require.ErrorIs(t, err, credentials.ErrNotFound)
+
+	require.NoError(t, keyring.Set("anthropic", "sk-ant"))
+	require.NoError(t, keyring.Set("openai", "sk-oai"))
+
+	keys, err := keyring.Keys()
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"anthropic": "sk-ant", "openai": "sk-oai"}, keys)
+
+	// Only the owner can read it and the keys aren't in the clear
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "sk-ant")
+
+	passphrase = "wrong"
+	_, err = keyring.Key("anthropic")
+	require.ErrorContains(t, err, "wrong passphrase")
+}
+
+// source is a source with a fixed key, or error
+type source struct {
+	key string
+	err error
+}
+
+func (s source) Key(string) (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	if s.key == "" {
+		return "", credentials.ErrNotFound
+	}
+	return s.key, nil
+}
+
+func (s source) Describe(string) string {
+	return "source " + s.key
+}
+
+func TestResolver(t *testing.T) {
+	tests := []struct {
+		name       string
+		sources    []credentials.Source
+		wantKey    string
+		wantSource string
+		wantErr    error
+	}{
+		{name: "first wins", sources: []credentials.Source{source{}, source{key: "a"}, source{key: "b"}}, wantKey: "a", wantSource: "source a"},
+		{name: "none", sources: []credentials.Source{source{}}, wantErr: credentials.ErrNotFound},
+		{name: "error stops the chain", sources: []credentials.Source{source{err: os.ErrPermission}, source{key: "b"}}, wantErr: os.ErrPermission},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, from, err := credentials.NewResolver(tt.sources...).Lookup("anthropic")
+			if tt.wantErr != nil {
+				require.True(t, errors.Is(err, tt.wantErr), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantKey, key)
+			require.Equal(t, tt.wantSource, from)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// DefaultIterations of PBKDF2 deriving the keyring's encryption key, as recommended by OWASP for HMAC-SHA256
+const DefaultIterations = 600_000
+
+// Keyring is a file of keys encrypted with a passphrase, for machines without a password manager
+// The keys are encrypted with AES-256-GCM, using a key derived from the passphrase with PBKDF2
+type Keyring struct {
+	Path string
+	// Asked for the passphrase only when the keyring is opened
+	Passphrase func() (string, error)
+	// Of PBKDF2 for new keyrings, DefaultIterations when 0
+	Iterations int
+}
+
+// The keyring as it's stored, everything but the keys is in the clear
+type keyringFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+const (
+	keyringVersion = 1
+	keyringKDF     = "pbkdf2-sha256"
+)
+
+func (k *Keyring) Key(provider string) (string, error) {
+	keys, err := k.Keys()
+	if err != nil {
+		return "", err
+	}
+
+	if key := keys[provider]; key != "" {
+		return key, nil
+	}
+	return "", ErrNotFound
+}
+
+func (k *Keyring) Describe(provider string) string {
+	return "keyring " + k.Path
+}
+
+// Keys decrypts every key in the keyring by provider, it's ErrNotFound when there's no keyring
+func (k *Keyring) Keys() (map[string]string, error) {
+	data, err := os.ReadFile(k.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing keyring %s: %w", k.Path, err)
+	}
+	if file.Version != keyringVersion || file.KDF != keyringKDF {
+		return nil, fmt.Errorf("keyring %s: unsupported version %d with %s", k.Path, file.Version, file.KDF)
+	}
+
+	aead, err := k.cipher(file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("keyring %s: bad nonce", k.Path)
+	}
+
+	plaintext, err := aead.Open(nil, file.Nonce, file.Ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: wrong passphrase or corrupted file", k.Path)
+	}
+
+	keys := map[string]string{}
+	if err := json.Unmarshal(plaintext, &keys); err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", k.Path, err)
+	}
+	return keys, nil
+}
+
+// Set stores the provider's key, creating the keyring if needed
+// The keyring is re-encrypted with a new salt and nonce every time
+func (k *Keyring) Set(provider, key string) error {
+	keys, err := k.Keys()
+	if errors.Is(err, ErrNotFound) {
+		keys = map[string]string{}
+	} else if err != nil {
+		return err
+	}
+	keys[provider] = key
+
+	plaintext, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	file := keyringFile{
+		Version:    keyringVersion,
+		KDF:        keyringKDF,
+		Iterations: k.Iterations,
+		Salt:       make([]byte, 16),
+	}
+	if file.Iterations <= 0 {
+		file.Iterations = DefaultIterations
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+
+	aead, err := k.cipher(file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, plaintext, nil)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivate(k.Path, data)
+}
+
+// cipher derives the keyring's encryption key from the passphrase
+func (k *Keyring) cipher(salt []byte, iterations int) (cipher.AEAD, error) {
+	if k.Passphrase == nil {
+		return nil, errors.New("no keyring passphrase")
+	}
+	passphrase, err := k.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+	if iterations <= 0 {
+		return nil, fmt.Errorf("keyring %s: bad iteration count %d", k.Path, iterations)
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writePrivate replaces the file at path with data only its owner can read
+// It's written to a temporary file first so a failed write doesn't lose the keys
+func writePrivate(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp already makes the file 0600, this is in case of an unusual umask
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,96 @@
+package document
+
+import (
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/tokenizer"
+)
+
+// Chunk is a piece of a document that fits within a token budget
+type Chunk struct {
+	Source    string
+	FirstPage int
+	LastPage  int
+	Text      string
+}
+
+// Split breaks a document into chunks of at most maxTokens (estimated)
+// Chunks end on page boundaries where possible, then on paragraphs, then on lines
+// A single line longer than maxTokens is cut at the budget
+func Split(doc *Document, maxTokens int) []Chunk {
+	var chunks []Chunk
+	current := Chunk{Source: doc.Source}
+	var sb strings.Builder
+
+	flush := func() {
+		if strings.TrimSpace(sb.String()) != "" {
+			current.Text = sb.String()
+			chunks = append(chunks, current)
+		}
+		current = Chunk{Source: doc.Source}
+		sb.Reset()
+	}
+
+	add := func(page int, text string) {
+		if sb.Len() > 0 && tokenizer.Estimate(sb.String()+text) > maxTokens {
+			flush()
+		}
+		if current.FirstPage == 0 {
+			current.FirstPage = page
+		}
+		current.LastPage = page
+		sb.WriteString(text)
+	}
+
+	for _, page := range doc.Pages {
+		text := doc.pageText(page.Number, page.Text)
+		if tokenizer.Estimate(text) <= maxTokens {
+			add(page.Number, text)
+			continue
+		}
+
+		for _, piece := range splitText(page.Text, maxTokens) {
+			add(page.Number, doc.pageText(page.Number, piece))
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// splitText breaks text that's over the budget into pieces that fit, keeping their separators
+func splitText(text string, maxTokens int) []string {
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		// Text ending in the separator splits into itself and an empty part, which would never get shorter
+		var parts []string
+		for _, part := range strings.SplitAfter(text, sep) {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) < 2 {
+			continue
+		}
+
+		var pieces []string
+		for _, part := range parts {
+			if tokenizer.Estimate(part) > maxTokens {
+				pieces = append(pieces, splitText(part, maxTokens)...)
+				continue
+			}
+			pieces = append(pieces, part)
+		}
+		return pieces
+	}
+
+	// Nothing left to split on, cut it at the budget
+	var pieces []string
+	runes := []rune(text)
+	size := max(1, maxTokens*4)
+	for len(runes) > 0 {
+		n := min(size, len(runes))
+		pieces = append(pieces, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return pieces
+}
@@ -0,0 +1,81 @@
+package document_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/document"
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplit(t *testing.T) {
+	// Each page is 10 tokens
+	page := strings.Repeat("word ", 8)
+
+	tests := []struct {
+		Name      string
+		Doc       *document.Document
+		MaxTokens int
+		Expected  [][2]int
+	}{
+		{
+			Name:      "pages are grouped up to the budget",
+			Doc:       &document.Document{Pages: []document.Page{{1, page}, {2, page}, {3, page}, {4, page}, {5, page}}},
+			MaxTokens: 20,
+			Expected:  [][2]int{{1, 2}, {3, 4}, {5, 5}},
+		},
+		{
+			Name:      "a page over the budget is split on paragraphs",
+			Doc:       &document.Document{Pages: []document.Page{{1, page + "\n\n" + page + "\n\n" + page}, {2, page}}},
+			MaxTokens: 12,
+			Expected:  [][2]int{{1, 1}, {1, 1}, {1, 1}, {2, 2}},
+		},
+		{
+			Name:      "empty pages are skipped",
+			Doc:       &document.Document{Pages: []document.Page{{1, ""}, {2, "  "}}},
+			MaxTokens: 12,
+			Expected:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			chunks := document.Split(test.Doc, test.MaxTokens)
+
+			var pages [][2]int
+			for _, chunk := range chunks {
+				pages = append(pages, [2]int{chunk.FirstPage, chunk.LastPage})
+				require.LessOrEqual(t, tokenizer.Estimate(chunk.Text), test.MaxTokens)
+			}
+			require.Equal(t, test.Expected, pages)
+		})
+	}
+}
+
+func TestSplitLongLine(t *testing.T) {
+	tests := []struct {
+		Name string
+		Text string
+	}{
+		{Name: "no separators", Text: strings.Repeat("a", 100)},
+		{Name: "ends with a separator", Text: strings.Repeat("a", 100) + "\n"},
+		{Name: "ends with a paragraph", Text: strings.Repeat("a", 100) + "\n\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			doc := document.FromText("stdin", test.Text)
+
+			chunks := document.Split(doc, 10)
+			require.Len(t, chunks, 3)
+
+			var text string
+			for _, chunk := range chunks {
+				require.LessOrEqual(t, tokenizer.Estimate(chunk.Text), 10)
+				text += chunk.Text
+			}
+			require.Equal(t, doc.Text(), text)
+		})
+	}
+}
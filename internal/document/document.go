@@ -0,0 +1,168 @@
+// Package document extracts text from documents given as context and splits it into chunks
+package document
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"rsc.io/pdf"
+)
+
+type Page struct {
+	Number int
+	Text   string
+}
+
+type Document struct {
+	// Where the document came from, e.g. its filepath
+	Source string
+	Pages  []Page
+	// Whether the pages are real pages, the text is wrapped in <page> tags when they are
+	Paged bool
+}
+
+// Text returns the text of every page in the document
+func (d *Document) Text() string {
+	var sb strings.Builder
+	for _, page := range d.Pages {
+		sb.WriteString(d.pageText(page.Number, page.Text))
+	}
+	return sb.String()
+}
+
+func (d *Document) pageText(number int, text string) string {
+	if !d.Paged {
+		return text
+	}
+	return fmt.Sprintf("<page number=\"%d\">\n%s</page>\n", number, text)
+}
+
+// FromText wraps text that didn't come from a paged document
+func FromText(source, text string) *Document {
+	return &Document{Source: source, Pages: []Page{{Number: 1, Text: text}}}
+}
+
+// Open extracts the text of the document at source
+// The pages to read can be selected with a fragment, e.g. report.pdf#pages=3-10
+func Open(source string) (*Document, error) {
+	path, pages, err := ParseSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return ExtractPDF(path, pages)
+}
+
+// ExtractPDF reads the text from the selected pages of the PDF at path, every page if pages is empty
+func ExtractPDF(path string, pages PageRanges) (*Document, error) {
+	file, err := pdf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file at path=%s: %w", path, err)
+	}
+
+	doc := &Document{Source: path, Paged: true}
+	for i := 1; i <= file.NumPage(); i++ {
+		if !pages.Contains(i) {
+			continue
+		}
+
+		var glyphs []glyph
+		for _, t := range file.Page(i).Content().Text {
+			glyphs = append(glyphs, glyph{X: t.X, Y: t.Y, W: t.W, Size: t.FontSize, S: t.S})
+		}
+
+		doc.Pages = append(doc.Pages, Page{Number: i, Text: layout(glyphs)})
+	}
+
+	if len(doc.Pages) == 0 {
+		return nil, fmt.Errorf("no pages selected from path=%s with %d pages", path, file.NumPage())
+	}
+
+	return doc, nil
+}
+
+// PageRange is an inclusive range of page numbers, a Last of zero means the end of the document
+type PageRange struct {
+	First int
+	Last  int
+}
+
+type PageRanges []PageRange
+
+// Contains reports whether page is selected, no ranges selects every page
+func (p PageRanges) Contains(page int) bool {
+	if len(p) == 0 {
+		return true
+	}
+
+	for _, r := range p {
+		if page >= r.First && (r.Last == 0 || page <= r.Last) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSource splits a page selection like #pages=1,3-5,10- off the end of a path
+// Any other # is part of the path, e.g. Q#3 report.pdf
+func ParseSource(source string) (string, PageRanges, error) {
+	i := strings.LastIndex(source, "#")
+	if i < 0 {
+		return source, nil, nil
+	}
+	// #page= is still taken as a selection, to point out the typo rather than look for a file named after it
+	path, fragment := source[:i], source[i+1:]
+	if !strings.HasPrefix(fragment, "page") {
+		return source, nil, nil
+	}
+
+	value, ok := strings.CutPrefix(fragment, "pages=")
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported document fragment %q, expected #pages=", fragment)
+	}
+
+	pages, err := ParsePageRanges(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing pages of %s: %w", path, err)
+	}
+
+	return path, pages, nil
+}
+
+// ParsePageRanges parses comma separated page numbers and ranges, e.g. 1,3-5,10-
+func ParsePageRanges(s string) (PageRanges, error) {
+	var ranges PageRanges
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 1 {
+			return nil, fmt.Errorf("invalid page %q", part)
+		}
+
+		r := PageRange{First: start, Last: start}
+		if isRange {
+			r.Last = 0
+			if last != "" {
+				end, err := strconv.Atoi(last)
+				if err != nil || end < start {
+					return nil, fmt.Errorf("invalid page range %q", part)
+				}
+				r.Last = end
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errors.New("no pages given")
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,269 @@
+package document
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// glyph is a piece of text drawn at a position on the page, usually a single character
+type glyph struct {
+	X, Y, W float64
+	Size    float64
+	S       string
+}
+
+func (g glyph) right() float64 {
+	return g.X + g.W
+}
+
+// line is a run of glyphs that share a baseline
+type line struct {
+	Y      float64
+	Size   float64
+	glyphs []glyph
+}
+
+func (l *line) left() float64 {
+	return l.glyphs[0].X
+}
+
+// Layout thresholds, relative to the font size
+const (
+	// Glyphs whose baselines are closer than this are on the same line
+	sameLine = 0.5
+	// A gap between glyphs wider than this separates two words
+	wordGap = 0.2
+	// A gap between lines taller than this separates two paragraphs
+	paragraphGap = 1.8
+	// Columns must be separated by a gutter at least this wide, in points
+	minGutter = 8.0
+	// Fraction of lines that can cross a gutter, e.g. headings spanning both columns
+	gutterCrossings = 0.1
+)
+
+// layout rebuilds the reading order of a page's text from the position of its glyphs
+// Glyphs are grouped into words and lines, and two column pages are read one column at a time
+func layout(glyphs []glyph) string {
+	lines := groupLines(glyphs)
+	if len(lines) == 0 {
+		return ""
+	}
+
+	gutter, ok := findGutter(lines)
+	if !ok {
+		return joinLines(lines)
+	}
+
+	// Lines that cross the gutter, like titles, are kept where they are
+	// Between them, the whole left column is read before the right one
+	var sections []string
+	var left, right []*line
+	flush := func() {
+		if len(left) > 0 {
+			sections = append(sections, joinLines(left))
+		}
+		if len(right) > 0 {
+			sections = append(sections, joinLines(right))
+		}
+		left, right = nil, nil
+	}
+
+	for _, l := range lines {
+		var l1, l2 []glyph
+		crosses := false
+		for _, g := range l.glyphs {
+			switch {
+			case g.right() <= gutter[0]+0.5:
+				l1 = append(l1, g)
+			case g.X >= gutter[1]-0.5:
+				l2 = append(l2, g)
+			default:
+				crosses = true
+			}
+		}
+
+		if crosses {
+			flush()
+			sections = append(sections, joinLines([]*line{l}))
+			continue
+		}
+
+		if len(l1) > 0 {
+			left = append(left, &line{Y: l.Y, Size: l.Size, glyphs: l1})
+		}
+		if len(l2) > 0 {
+			right = append(right, &line{Y: l.Y, Size: l.Size, glyphs: l2})
+		}
+	}
+	flush()
+
+	return strings.Join(sections, "\n")
+}
+
+// groupLines clusters glyphs by baseline, top of the page first, each sorted left to right
+func groupLines(glyphs []glyph) []*line {
+	sorted := make([]glyph, 0, len(glyphs))
+	for _, g := range glyphs {
+		if g.S == "" {
+			continue
+		}
+		if g.Size <= 0 {
+			g.Size = 10
+		}
+		// Not every font reports widths
+		if g.W <= 0 {
+			g.W = g.Size * 0.5 * float64(utf8.RuneCountInString(g.S))
+		}
+		sorted = append(sorted, g)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Y > sorted[j].Y
+	})
+
+	var lines []*line
+	var current *line
+	for _, g := range sorted {
+		if current == nil || math.Abs(current.Y-g.Y) > sameLine*math.Max(current.Size, g.Size) {
+			current = &line{Y: g.Y, Size: g.Size}
+			lines = append(lines, current)
+		}
+		current.glyphs = append(current.glyphs, g)
+		current.Size = math.Max(current.Size, g.Size)
+	}
+
+	for _, l := range lines {
+		sort.SliceStable(l.glyphs, func(i, j int) bool {
+			return l.glyphs[i].X < l.glyphs[j].X
+		})
+		l.glyphs = dedupe(l.glyphs)
+	}
+
+	return lines
+}
+
+// dedupe drops glyphs drawn on top of an identical glyph, which some PDFs do to fake bold text
+func dedupe(glyphs []glyph) []glyph {
+	var kept []glyph
+	for _, g := range glyphs {
+		if n := len(kept); n > 0 {
+			prev := kept[n-1]
+			if prev.S == g.S && math.Abs(prev.X-g.X) < 0.1*g.Size && math.Abs(prev.Y-g.Y) < 0.1*g.Size {
+				continue
+			}
+		}
+		kept = append(kept, g)
+	}
+	return kept
+}
+
+// findGutter looks for a vertical strip through the middle of the page that almost no line crosses
+func findGutter(lines []*line) ([2]float64, bool) {
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	for _, l := range lines {
+		for _, g := range l.glyphs {
+			minX = math.Min(minX, g.X)
+			maxX = math.Max(maxX, g.right())
+		}
+	}
+
+	width := maxX - minX
+	if width < 4*minGutter || len(lines) < 4 {
+		return [2]float64{}, false
+	}
+
+	// Count how many lines cover each 1pt wide strip of the page
+	bins := int(math.Ceil(width))
+	coverage := make([]int, bins+1)
+	for _, l := range lines {
+		covered := make([]bool, bins+1)
+		for i, g := range l.glyphs {
+			end := g.right()
+			// Gaps within a word or between words are covered too, only wide gaps aren't
+			if i+1 < len(l.glyphs) && l.glyphs[i+1].X-end < l.Size {
+				end = l.glyphs[i+1].X
+			}
+			for x := int(g.X - minX); x < int(math.Ceil(end-minX)) && x <= bins; x++ {
+				covered[x] = true
+			}
+		}
+		for x, c := range covered {
+			if c {
+				coverage[x]++
+			}
+		}
+	}
+
+	// Find the widest run of strips in the middle half of the page crossed by few lines
+	limit := int(gutterCrossings * float64(len(lines)))
+	best, bestStart, start := 0, 0, -1
+	for x := bins / 4; x <= 3*bins/4; x++ {
+		if coverage[x] <= limit {
+			if start < 0 {
+				start = x
+			}
+			if x-start+1 > best {
+				best, bestStart = x-start+1, start
+			}
+		} else {
+			start = -1
+		}
+	}
+
+	if float64(best) < minGutter {
+		return [2]float64{}, false
+	}
+
+	gutter := [2]float64{minX + float64(bestStart), minX + float64(bestStart+best)}
+
+	// Both columns need a fair share of the lines, otherwise it's just indentation
+	var leftLines, rightLines int
+	for _, l := range lines {
+		if l.left() < gutter[0] {
+			leftLines++
+		}
+		if l.glyphs[len(l.glyphs)-1].right() > gutter[1] {
+			rightLines++
+		}
+	}
+	if leftLines < len(lines)/4 || rightLines < len(lines)/4 {
+		return [2]float64{}, false
+	}
+
+	return gutter, true
+}
+
+// joinLines writes lines as text, with a blank line between paragraphs
+func joinLines(lines []*line) string {
+	var sb strings.Builder
+	for i, l := range lines {
+		if i > 0 {
+			sb.WriteString("\n")
+			if lines[i-1].Y-l.Y > paragraphGap*math.Max(l.Size, lines[i-1].Size) {
+				sb.WriteString("\n")
+			}
+		}
+		sb.WriteString(words(l.glyphs))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// words joins glyphs into text, adding spaces where the gap between them is wide enough
+func words(glyphs []glyph) string {
+	var sb strings.Builder
+	for i, g := range glyphs {
+		if i > 0 {
+			prev := glyphs[i-1]
+			gap := g.X - prev.right()
+			endsInSpace := strings.HasSuffix(prev.S, " ") || strings.HasPrefix(g.S, " ")
+			if gap > wordGap*math.Max(g.Size, prev.Size) && !endsInSpace {
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString(g.S)
+	}
+	return strings.TrimSpace(sb.String())
+}
@@ -0,0 +1,107 @@
+package document
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// text lays out s one glyph per character, 5pt wide at 10pt, starting at x on baseline y
+func text(s string, x, y float64) []glyph {
+	var glyphs []glyph
+	for _, r := range s {
+		if r != ' ' {
+			glyphs = append(glyphs, glyph{X: x, Y: y, W: 5, Size: 10, S: string(r)})
+		}
+		x += 5
+	}
+	return glyphs
+}
+
+func page(parts ...[]glyph) []glyph {
+	var glyphs []glyph
+	// Reverse the parts to make sure the order glyphs are drawn in doesn't matter
+	for i := len(parts) - 1; i >= 0; i-- {
+		glyphs = append(glyphs, parts[i]...)
+	}
+	return glyphs
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Glyphs   []glyph
+		Expected string
+	}{
+		{
+			Name:     "words and lines",
+			Glyphs:   page(text("Hello world", 0, 700), text("second line", 0, 688)),
+			Expected: "Hello world\nsecond line\n",
+		},
+		{
+			Name:     "paragraphs",
+			Glyphs:   page(text("first", 0, 700), text("second", 0, 660)),
+			Expected: "first\n\nsecond\n",
+		},
+		{
+			Name:     "overprinted bold text",
+			Glyphs:   page(text("bold", 0, 700), text("bold", 0.2, 700)),
+			Expected: "bold\n",
+		},
+		{
+			Name: "two columns are read one at a time",
+			Glyphs: page(
+				text("A title across both columns", 0, 720),
+				text("left one", 0, 700), text("right one", 200, 700),
+				text("left two", 0, 688), text("right two", 200, 688),
+				text("left three", 0, 676), text("right three", 200, 676),
+				text("left four", 0, 664), text("right four", 200, 664),
+			),
+			Expected: "A title across both columns\n\n" +
+				"left one\nleft two\nleft three\nleft four\n\n" +
+				"right one\nright two\nright three\nright four\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.Equal(t, test.Expected, layout(test.Glyphs))
+		})
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		Source       string
+		ExpectedPath string
+		Expected     PageRanges
+		ExpectedErr  bool
+	}{
+		{Source: "report.pdf", ExpectedPath: "report.pdf"},
+		{Source: "report.pdf#pages=3-10", ExpectedPath: "report.pdf", Expected: PageRanges{{First: 3, Last: 10}}},
+		{Source: "report.pdf#pages=1,4,7-", ExpectedPath: "report.pdf", Expected: PageRanges{{First: 1, Last: 1}, {First: 4, Last: 4}, {First: 7}}},
+		{Source: "report.pdf#pages=5-2", ExpectedErr: true},
+		{Source: "report.pdf#page=1", ExpectedErr: true},
+		{Source: "Q#3 report.pdf", ExpectedPath: "Q#3 report.pdf"},
+		{Source: "Q#3 report.pdf#pages=2", ExpectedPath: "Q#3 report.pdf", Expected: PageRanges{{First: 2, Last: 2}}},
+		{Source: "reports/#1/summary.pdf", ExpectedPath: "reports/#1/summary.pdf"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Source, func(t *testing.T) {
+			path, pages, err := ParseSource(test.Source)
+			if test.ExpectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.ExpectedPath, path)
+			require.Equal(t, test.Expected, pages)
+		})
+	}
+
+	pages := PageRanges{{First: 2, Last: 3}, {First: 7}}
+	require.False(t, pages.Contains(1))
+	require.True(t, pages.Contains(3))
+	require.True(t, pages.Contains(100))
+}
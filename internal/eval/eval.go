@@ -0,0 +1,283 @@
+package eval
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/davidhbaek/llm/internal/anthropic"
+	"github.com/davidhbaek/llm/internal/document"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Client is the part of llm.Client the cases are run with
+type Client interface {
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	Model() string
+}
+
+// Runner runs the cases of suites
+type Runner struct {
+	// Grades judge checks, only needed for suites that have them
+	Judge Client
+	// Prices a response's usage, responses cost nothing when it's nil
+	Cost func(model string, usage wire.Usage) float64
+	// Maximum cases run at once, across every model
+	Concurrency int
+}
+
+// Result is how a case fared against a model
+type Result struct {
+	Case   string `json:"case"`
+	Model  string `json:"model"`
+	Passed bool   `json:"passed"`
+	// Set when the model couldn't be prompted, every check fails
+	Error  string        `json:"error,omitempty"`
+	Checks []CheckResult `json:"checks"`
+	Text   string        `json:"text"`
+	Usage  wire.Usage    `json:"usage"`
+	// Of the response and of grading it with the judge, in $USD
+	Cost      float64 `json:"cost_usd"`
+	LatencyMS int64   `json:"latency_ms"`
+}
+
+type CheckResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	// Why the check failed, or the judge's reasoning
+	Reason string `json:"reason,omitempty"`
+}
+
+// Run runs every case of the suite against every client
+// A case that fails, or can't be run, is reported in its result, the error is only for a canceled run
+func (r *Runner) Run(ctx context.Context, suite *Suite, clients []Client) (*Report, error) {
+	report := &Report{Suite: suite.Name, Started: time.Now().UTC()}
+
+	var opts []wire.Option
+	if suite.MaxTokens > 0 {
+		opts = append(opts, wire.WithMaxTokens(suite.MaxTokens))
+	}
+	if suite.Temperature != nil {
+		opts = append(opts, wire.WithTemperature(*suite.Temperature))
+	}
+
+	results := make([]Result, len(suite.Cases)*len(clients))
+
+	var eg errgroup.Group
+	eg.SetLimit(max(1, r.Concurrency))
+	for i := range suite.Cases {
+		c := &suite.Cases[i]
+
+		// Attachments are read once and sent to every model
+		messages, system, err := c.messages()
+		for j, client := range clients {
+			idx, client := i*len(clients)+j, client
+			if err != nil {
+				results[idx] = failed(c, client.Model(), err)
+				continue
+			}
+
+			eg.Go(func() error {
+				results[idx] = r.runCase(ctx, c, client, messages, system, opts)
+				return nil
+			})
+		}
+	}
+	eg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report.Results = results
+	return report, nil
+}
+
+// messages builds the request for the case, reading its attachments
+func (c *Case) messages() ([]wire.Message, []wire.Text, error) {
+	content := []wire.Content{&wire.Text{Type: "text", Text: c.prompt}}
+	for _, path := range c.Images {
+		imgBytes, err := anthropic.DownloadImage(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading image: %w", err)
+		}
+
+		image := &wire.AnthropicImage{Type: "image"}
+		image.Source.Type = "base64"
+		image.Source.MediaType = http.DetectContentType(imgBytes)
+		image.Source.Data = base64.StdEncoding.EncodeToString(imgBytes)
+		content = append(content, image)
+	}
+
+	// Documents are sent as text in the system prompt, the same as the CLI does without --pdf-mode native
+	system := wire.SystemPrompt(c.system)
+	if len(c.Documents) > 0 {
+		var docs strings.Builder
+		for _, path := range c.Documents {
+			doc, err := openDocument(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("reading document: %w", err)
+			}
+			fmt.Fprintf(&docs, "<document>%s</document>\n", doc.Text())
+		}
+		system = append(system, wire.Text{Type: "text", Text: fmt.Sprintf("<documents>%s</documents>", docs.String())})
+	}
+
+	return []wire.Message{{Role: "user", Content: content}}, system, nil
+}
+
+// openDocument extracts the text of a PDF, any other file is read as text
+func openDocument(path string) (*document.Document, error) {
+	if strings.EqualFold(filepath.Ext(path), ".pdf") || strings.Contains(path, ".pdf#") {
+		return document.Open(path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return document.FromText(path, string(data)), nil
+}
+
+func (r *Runner) runCase(ctx context.Context, c *Case, client Client, messages []wire.Message, system []wire.Text, opts []wire.Option) Result {
+	start := time.Now()
+	completion, err := complete(ctx, client, messages, system, opts)
+	if err != nil {
+		return failed(c, client.Model(), err)
+	}
+
+	result := Result{
+		Case:      c.Name,
+		Model:     client.Model(),
+		Passed:    true,
+		Text:      completion.Text,
+		Usage:     completion.Usage,
+		Cost:      r.cost(completion),
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	for _, check := range c.Checks {
+		checked, cost := r.check(ctx, check, c.prompt, completion.Text)
+		result.Checks = append(result.Checks, checked)
+		result.Cost += cost
+		result.Passed = result.Passed && checked.Passed
+	}
+
+	return result
+}
+
+// failed is the result of a case that couldn't be run
+func failed(c *Case, model string, err error) Result {
+	result := Result{Case: c.Name, Model: model, Error: err.Error()}
+	for _, check := range c.Checks {
+		result.Checks = append(result.Checks, CheckResult{Check: check.String(), Reason: "not run"})
+	}
+	return result
+}
+
+func (r *Runner) cost(completion *wire.Completion) float64 {
+	if r.Cost == nil {
+		return 0
+	}
+	return r.Cost(completion.Model, completion.Usage)
+}
+
+// check runs a check on the response to prompt, returning what it cost to grade
+func (r *Runner) check(ctx context.Context, check Check, prompt, text string) (CheckResult, float64) {
+	result := CheckResult{Check: check.String()}
+
+	switch {
+	case check.Contains != "":
+		result.Passed = strings.Contains(text, check.Contains)
+		if !result.Passed {
+			result.Reason = "not found in the response"
+		}
+	case check.regex != nil:
+		result.Passed = check.regex.MatchString(text)
+		if !result.Passed {
+			result.Reason = "no match in the response"
+		}
+	case check.Exact != nil:
+		result.Passed = strings.TrimSpace(text) == strings.TrimSpace(*check.Exact)
+		if !result.Passed {
+			result.Reason = fmt.Sprintf("got %q", truncate(strings.TrimSpace(text), 80))
+		}
+	case check.JSONSchema != nil:
+		value, err := parseJSON(text)
+		if err == nil {
+			err = validate(check.JSONSchema, value, "")
+		}
+		result.Passed = err == nil
+		if err != nil {
+			result.Reason = err.Error()
+		}
+	case check.Judge != "":
+		passed, reason, completion, err := r.judge(ctx, check.Judge, prompt, text)
+		result.Passed, result.Reason = passed, reason
+		if err != nil {
+			result.Reason = fmt.Sprintf("judging: %v", err)
+		}
+		if completion != nil {
+			return result, r.cost(completion)
+		}
+	}
+
+	return result, 0
+}
+
+const judgeSystem = `You grade responses from an AI assistant against a rubric.
+Reply with PASS or FAIL on the first line, followed by a sentence or two explaining why.
+Only reply PASS if the response fully meets the rubric.`
+
+// judge asks the judge model whether the response meets the rubric
+func (r *Runner) judge(ctx context.Context, rubric, prompt, text string) (bool, string, *wire.Completion, error) {
+	if r.Judge == nil {
+		return false, "", nil, fmt.Errorf("no judge model")
+	}
+
+	request := fmt.Sprintf("<prompt>\n%s\n</prompt>\n\n<response>\n%s\n</response>\n\n<rubric>\n%s\n</rubric>", prompt, text, rubric)
+	messages := []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: request}}}}
+
+	completion, err := complete(ctx, r.Judge, messages, wire.SystemPrompt(judgeSystem), []wire.Option{wire.WithTemperature(0)})
+	if err != nil {
+		return false, "", completion, err
+	}
+
+	// Models like to dress up the verdict, e.g. **PASS**: ...
+	reply := strings.TrimLeft(strings.TrimSpace(completion.Text), "*# ")
+	if len(reply) >= 4 {
+		verdict, reason := strings.ToUpper(reply[:4]), strings.TrimSpace(strings.TrimLeft(reply[4:], "*.:,- \n"))
+		switch verdict {
+		case "PASS":
+			return true, reason, completion, nil
+		case "FAIL":
+			return false, reason, completion, nil
+		}
+	}
+	return false, "", completion, fmt.Errorf("judge didn't reply PASS or FAIL: %q", truncate(completion.Text, 80))
+}
+
+// complete prompts the model and reads its whole reply
+func complete(ctx context.Context, client Client, messages []wire.Message, system []wire.Text, opts []wire.Option) (*wire.Completion, error) {
+	rsp, err := client.SendMessage(ctx, messages, system, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Closing frees the request's rate limit slot and lets the connection be reused, even if reading fails
+	if closer, ok := rsp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	return client.ReadBody(rsp.Body, nil)
+}
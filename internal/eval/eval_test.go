@@ -0,0 +1,161 @@
+package eval_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/eval"
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSuite writes the suite and the files it refers to into a temporary directory
+func writeSuite(t *testing.T, suite string, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	path := filepath.Join(dir, "suite.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(suite), 0o644))
+	return path
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		suite string
+	}{
+		{name: "no cases", suite: "name: empty"},
+		{name: "unknown field", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{contains: hi}]\n    promt: typo"},
+		{name: "no prompt", suite: "cases:\n  - name: a\n    checks: [{contains: hi}]"},
+		{name: "no checks", suite: "cases:\n  - name: a\n    prompt: hi"},
+		{name: "duplicate names", suite: "cases:\n  - {name: a, prompt: hi, checks: [{contains: hi}]}\n  - {name: a, prompt: hi, checks: [{contains: hi}]}"},
+		{name: "two kinds in a check", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{contains: hi, regex: hi}]"},
+		{name: "bad regex", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{regex: \"(\"}]"},
+		{name: "unsupported schema keyword", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{json_schema: {type: object, properties: {a: {anyOf: [{type: string}]}}}}]"},
+		{name: "nested unsupported schema keyword", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{json_schema: {type: array, items: {type: string, format: email}}}]"},
+		{name: "additionalProperties schema", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{json_schema: {type: object, additionalProperties: {type: string}}}]"},
+		{name: "unknown schema type", suite: "cases:\n  - name: a\n    prompt: hi\n    checks: [{json_schema: {type: text}}]"},
+		{name: "missing variable", suite: "cases:\n  - name: a\n    prompt: \"hi {{.name}}\"\n    checks: [{contains: hi}]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := eval.Load(writeSuite(t, tt.suite, nil))
+			require.Error(t, err)
+		})
+	}
+}
+
+const suite = `
+name: greetings
+system_file: system.txt
+vars: {greeting: Hello}
+cases:
+  - name: greet
+    prompt: "{{.greeting}} {{.name}}"
+    vars: {name: there}
+    documents: [notes.txt]
+    checks:
+      - contains: Hello
+      - regex: "^Hello \\w+$"
+      - exact: "  Hello there "
+      - judge: The response is a greeting
+  - name: json
+    prompt: '{"greeting": "hi", "count": 2}'
+    checks:
+      - json_schema:
+          type: object
+          required: [greeting, count]
+          properties:
+            greeting: {type: string}
+            count: {type: integer, maximum: 1}
+`
+
+func TestRun(t *testing.T) {
+	path := writeSuite(t, suite, map[string]string{"system.txt": "Be nice", "notes.txt": "some notes"})
+	s, err := eval.Load(path)
+	require.NoError(t, err)
+	require.Equal(t, "greetings", s.Name)
+	require.True(t, s.NeedsJudge())
+
+	model := fake.NewClient(fake.Echo)
+	judge := fake.NewClient(fake.Echo, fake.WithResponses(fake.Response{Text: "**PASS**: it says hello"}))
+	runner := &eval.Runner{
+		Judge: judge,
+		Cost:  func(model string, usage wire.Usage) float64 { return 0.5 },
+	}
+
+	report, err := runner.Run(context.Background(), s, []eval.Client{model})
+	require.NoError(t, err)
+	require.Len(t, report.Results, 2)
+
+	// The prompt is rendered and the document sent in the system prompt
+	calls := model.Calls()
+	require.Len(t, calls, 2)
+	require.Len(t, calls[0].System, 2)
+	require.Equal(t, "Be nice", calls[0].System[0].Text)
+	require.Contains(t, calls[0].System[1].Text, "<document>some notes</document>")
+
+	greet := report.Results[0]
+	require.Equal(t, "greet", greet.Case)
+	require.Equal(t, "Hello there", greet.Text)
+	require.True(t, greet.Passed)
+	require.Equal(t, "it says hello", greet.Checks[3].Reason)
+	// The judge's cost is added to the response's
+	require.Equal(t, 1.0, greet.Cost)
+
+	json := report.Results[1]
+	require.False(t, json.Passed)
+	require.Equal(t, "$.count: expected at most 1, got 2", json.Checks[0].Reason)
+
+	require.Equal(t, 1, report.Passed())
+	require.Equal(t, 1.5, report.Cost())
+}
+
+func TestRunErrors(t *testing.T) {
+	s, err := eval.Load(writeSuite(t, "cases:\n  - {name: a, prompt: hi, checks: [{contains: hi}]}", nil))
+	require.NoError(t, err)
+
+	report, err := (&eval.Runner{}).Run(context.Background(), s, []eval.Client{fake.NewClient(fake.RateLimited)})
+	require.NoError(t, err)
+	require.False(t, report.Results[0].Passed)
+	require.Contains(t, report.Results[0].Error, "rate_limit_error")
+}
+
+func TestCompare(t *testing.T) {
+	previous := &eval.Report{Results: []eval.Result{
+		{Case: "a", Model: "m", Passed: true, Text: "one\ntwo\nthree"},
+		{Case: "b", Model: "m", Passed: false, Text: "same"},
+		{Case: "c", Model: "m", Passed: true, Text: "old"},
+	}}
+	current := &eval.Report{Results: []eval.Result{
+		{Case: "a", Model: "m", Passed: false, Text: "one\n2\nthree"},
+		{Case: "b", Model: "m", Passed: true, Text: "same"},
+		{Case: "c", Model: "m", Passed: true, Text: "new"},
+		{Case: "d", Model: "m", Passed: true},
+	}}
+
+	changes := eval.Compare(previous, current)
+	require.Equal(t, []eval.Change{
+		{Case: "a", Model: "m", Was: "pass", Now: "fail", Diff: "- two\n+ 2\n"},
+		{Case: "b", Model: "m", Was: "fail", Now: "pass"},
+		{Case: "d", Model: "m", Was: "new", Now: "pass"},
+	}, changes)
+	require.True(t, changes[0].Regression())
+	require.False(t, changes[1].Regression())
+}
+
+func TestReportRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results", "suite.json")
+	report := &eval.Report{Suite: "s", Results: []eval.Result{{Case: "a", Model: "m", Passed: true, Text: "hi"}}}
+	require.NoError(t, report.Save(path))
+
+	loaded, err := eval.LoadReport(path)
+	require.NoError(t, err)
+	require.Equal(t, report.Results, loaded.Results)
+}
@@ -0,0 +1,161 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report is the outcome of running a suite, saved to compare the next run with
+type Report struct {
+	Suite   string    `json:"suite"`
+	Started time.Time `json:"started"`
+	// One per case and model, in the order of the suite's cases
+	Results []Result `json:"results"`
+}
+
+// Passed counts the results that passed every check
+func (r *Report) Passed() int {
+	var n int
+	for _, result := range r.Results {
+		if result.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+// Cost is the total cost of the run in $USD, judging included
+func (r *Report) Cost() float64 {
+	var cost float64
+	for _, result := range r.Results {
+		cost += result.Cost
+	}
+	return cost
+}
+
+// Save writes the report to path as JSON
+func (r *Report) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// LoadReport reads a report saved by Save
+func LoadReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("parsing report %s: %w", path, err)
+	}
+	return report, nil
+}
+
+// Change is a result that's different from the previous run
+type Change struct {
+	Case  string `json:"case"`
+	Model string `json:"model"`
+	// pass, fail or new, when the case or model wasn't run before
+	Was string `json:"was"`
+	Now string `json:"now"`
+	// Line diff of the previous response and this one, empty when the text is the same
+	Diff string `json:"diff,omitempty"`
+}
+
+// Regression reports whether a result that passed before fails now
+func (c Change) Regression() bool {
+	return c.Was == statusPass && c.Now == statusFail
+}
+
+const (
+	statusPass = "pass"
+	statusFail = "fail"
+	statusNew  = "new"
+)
+
+func status(result Result) string {
+	if result.Passed {
+		return statusPass
+	}
+	return statusFail
+}
+
+// Compare lists the results whose outcome changed since the previous report
+// Results that pass or fail the same as before aren't changes, even when their text is different
+func Compare(previous, current *Report) []Change {
+	type key struct{ suiteCase, model string }
+	before := map[key]Result{}
+	for _, result := range previous.Results {
+		before[key{result.Case, result.Model}] = result
+	}
+
+	var changes []Change
+	for _, result := range current.Results {
+		change := Change{Case: result.Case, Model: result.Model, Was: statusNew, Now: status(result)}
+
+		old, ok := before[key{result.Case, result.Model}]
+		if ok {
+			change.Was = status(old)
+			if change.Was == change.Now {
+				continue
+			}
+			if old.Text != result.Text {
+				change.Diff = diffLines(old.Text, result.Text)
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// diffLines returns the lines removed from a with a - and the lines added in b with a +, shared lines are left out
+func diffLines(a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&sb, "- %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "+ %s\n", y[j])
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,296 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The fenced code block a model may put its JSON in
+var fencedJSON = regexp.MustCompile("(?s)```(?:json)?\\s*\\n(.*?)\\n\\s*```")
+
+// parseJSON decodes the JSON in a response, from its first fenced code block if it has one
+func parseJSON(text string) (any, error) {
+	if match := fencedJSON.FindStringSubmatch(text); match != nil {
+		text = match[1]
+	}
+
+	var value any
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("not JSON: %w", err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("not JSON: more than one value")
+	}
+	return value, nil
+}
+
+// validate checks value against a JSON schema, returning the first problem found
+//
+// Only the keywords useful for checking a model's output are supported: type, enum, const,
+// properties, required, additionalProperties, items, minItems, maxItems, minLength, maxLength,
+// pattern, minimum and maximum. checkSchema rejects schemas using any others when a suite is loaded
+func validate(schema map[string]any, value any, path string) error {
+	if path == "" {
+		path = "$"
+	}
+
+	if types, ok := schema["type"]; ok {
+		if !hasType(value, types) {
+			return fmt.Errorf("%s: expected %v, got %s", path, types, typeOf(value))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if equal(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v isn't one of %v", path, value, enum)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !equal(constant, value) {
+		return fmt.Errorf("%s: expected %v, got %v", path, constant, value)
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return validateObject(schema, v, path)
+	case []any:
+		if n, ok := number(schema["minItems"]); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items, got %d", path, n, len(v))
+		}
+		if n, ok := number(schema["maxItems"]); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items, got %d", path, n, len(v))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := number(schema["minLength"]); ok && length < n {
+			return fmt.Errorf("%s: expected at least %v characters, got %v", path, n, length)
+		}
+		if n, ok := number(schema["maxLength"]); ok && length > n {
+			return fmt.Errorf("%s: expected at most %v characters, got %v", path, n, length)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern in schema: %w", path, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s: %q doesn't match /%s/", path, v, pattern)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n, ok := number(schema["minimum"]); ok && f < n {
+			return fmt.Errorf("%s: expected at least %v, got %v", path, n, v)
+		}
+		if n, ok := number(schema["maximum"]); ok && f > n {
+			return fmt.Errorf("%s: expected at most %v, got %v", path, n, v)
+		}
+	}
+
+	return nil
+}
+
+func validateObject(schema map[string]any, object map[string]any, path string) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if _, ok := object[fmt.Sprint(name)]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+
+	// Sorted so the same problem is reported every time
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		property, ok := properties[key].(map[string]any)
+		if !ok {
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: unexpected property %q", path, key)
+			}
+			continue
+		}
+		if err := validate(property, object[key], path+"."+key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Keywords that only describe a schema, validate doesn't need them
+var annotations = map[string]bool{"$schema": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true}
+
+// checkSchema makes sure validate understands every keyword in a schema, so a check can't pass
+// output that the schema would reject by relying on a keyword that's silently skipped
+func checkSchema(schema map[string]any, path string) error {
+	if path == "" {
+		path = "$"
+	}
+
+	// Sorted so the same problem is reported every time
+	keywords := make([]string, 0, len(schema))
+	for keyword := range schema {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		value := schema[keyword]
+		switch keyword {
+		case "type":
+			list, ok := value.([]any)
+			if !ok {
+				list = []any{value}
+			}
+			for _, t := range list {
+				switch t {
+				case "null", "boolean", "string", "integer", "number", "array", "object":
+				default:
+					return fmt.Errorf("%s: unknown type %v", path, t)
+				}
+			}
+		case "enum", "required":
+			if _, ok := value.([]any); !ok {
+				return fmt.Errorf("%s: %s must be a list", path, keyword)
+			}
+		case "const":
+		case "properties":
+			properties, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: properties must be a map of schemas", path)
+			}
+			for name, property := range properties {
+				property, ok := property.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s.%s: must be a schema", path, name)
+				}
+				if err := checkSchema(property, path+"."+name); err != nil {
+					return err
+				}
+			}
+		case "additionalProperties":
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("%s: additionalProperties must be true or false, schemas aren't supported", path)
+			}
+		case "items":
+			items, ok := value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: items must be a schema", path)
+			}
+			if err := checkSchema(items, path+"[]"); err != nil {
+				return err
+			}
+		case "minItems", "maxItems", "minLength", "maxLength", "minimum", "maximum":
+			if _, ok := number(value); !ok {
+				return fmt.Errorf("%s: %s must be a number", path, keyword)
+			}
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s: pattern must be a string", path)
+			}
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("%s: invalid pattern: %w", path, err)
+			}
+		default:
+			if !annotations[keyword] {
+				return fmt.Errorf("%s: unsupported keyword %q", path, keyword)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasType reports whether value is of the schema type, or one of the list of types
+func hasType(value any, types any) bool {
+	list, ok := types.([]any)
+	if !ok {
+		list = []any{types}
+	}
+
+	actual := typeOf(value)
+	for _, t := range list {
+		switch {
+		case t == actual:
+			return true
+		case t == "number" && actual == "integer":
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf names the JSON type of a decoded value, numbers without a fraction are integers
+func typeOf(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// number converts a number from a schema, decoded from YAML, or a response, decoded from JSON
+func number(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// equal compares a value from a schema with one from a response, whose numbers are decoded differently
+func equal(schemaValue, value any) bool {
+	if a, ok := number(schemaValue); ok {
+		b, ok := number(value)
+		return ok && a == b
+	}
+	return reflect.DeepEqual(schemaValue, value)
+}
@@ -0,0 +1,73 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidate(t *testing.T) {
+	// Schemas are written in YAML in suites
+	const schemaYAML = `
+type: object
+required: [title, tags]
+additionalProperties: false
+properties:
+  title: {type: string, minLength: 1, maxLength: 10}
+  rating: {type: number, minimum: 0, maximum: 5}
+  status: {enum: [draft, published]}
+  tags: {type: array, minItems: 1, items: {type: string, pattern: "^[a-z]+$"}}
+  author: {type: [string, "null"]}
+`
+	schema := map[string]any{}
+	require.NoError(t, yaml.Unmarshal([]byte(schemaYAML), &schema))
+
+	tests := []struct {
+		response string
+		wantErr  string
+	}{
+		{response: `{"title": "Go", "tags": ["lang"], "rating": 4.5, "status": "draft", "author": null}`},
+		{response: "Here you go:\n```json\n{\"title\": \"Go\", \"tags\": [\"lang\"]}\n```"},
+		{response: `not json`, wantErr: "not JSON"},
+		{response: `{"title": "Go"}`, wantErr: `$: missing required property "tags"`},
+		{response: `{"title": "Go", "tags": [], "x": 1}`, wantErr: `$.tags: expected at least 1 items, got 0`},
+		{response: `{"title": "Go", "tags": ["a"], "x": 1}`, wantErr: `$: unexpected property "x"`},
+		{response: `{"title": "", "tags": ["a"]}`, wantErr: `$.title: expected at least 1 characters, got 0`},
+		{response: `{"title": 1, "tags": ["a"]}`, wantErr: `$.title: expected string, got integer`},
+		{response: `{"title": "Go", "tags": ["A"]}`, wantErr: `$.tags[0]: "A" doesn't match /^[a-z]+$/`},
+		{response: `{"title": "Go", "tags": ["a"], "rating": 6}`, wantErr: `$.rating: expected at most 5, got 6`},
+		{response: `{"title": "Go", "tags": ["a"], "status": "gone"}`, wantErr: `$.status: gone isn't one of [draft published]`},
+		{response: `{"title": "Go", "tags": ["a"], "author": 1}`, wantErr: `$.author: expected [string null], got integer`},
+		{response: `[1, 2]`, wantErr: `$: expected object, got array`},
+	}
+
+	for _, tt := range tests {
+		value, err := parseJSON(tt.response)
+		if err == nil {
+			err = validate(schema, value, "")
+		}
+
+		if tt.wantErr == "" {
+			require.NoError(t, err, tt.response)
+		} else {
+			require.ErrorContains(t, err, tt.wantErr, tt.response)
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{a: "same", b: "same", want: ""},
+		{a: "a\nb\nc", b: "a\nc", want: "- b\n"},
+		{a: "a\nc", b: "a\nb\nc", want: "+ b\n"},
+		{a: "a\nb", b: "a\nx\ny", want: "- b\n+ x\n+ y\n"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, diffLines(tt.a, tt.b))
+	}
+}
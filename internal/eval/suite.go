@@ -0,0 +1,292 @@
+// Package eval runs suites of test cases against models, to catch regressions when prompts change
+//
+// A suite is a YAML file of cases. Each case is a prompt, rendered as a text/template with its
+// variables, with optional documents and images attached and the checks its response must pass:
+//
+//	name: summary
+//	models: [haiku]
+//	judge: sonnet
+//	system_file: system.txt
+//	cases:
+//	  - name: takeaways
+//	    prompt: "Summarize the {{.kind}} and list its key takeaways"
+//	    vars: {kind: article}
+//	    documents: [testdata/article.txt]
+//	    checks:
+//	      - contains: takeaways
+//	      - regex: "(?i)^#+ summary"
+//	      - judge: The summary only mentions facts from the article
+//
+// Paths are relative to the suite file
+package eval
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Suite is a set of cases run against the same models
+type Suite struct {
+	Name string `yaml:"name"`
+	// Models the cases are run against, unless others are given when running the suite
+	Models []string `yaml:"models"`
+	// Model grading judge checks
+	Judge string `yaml:"judge"`
+	// System prompt of every case, the file is read when the text isn't given
+	System     string `yaml:"system"`
+	SystemFile string `yaml:"system_file"`
+	// Template variables of every case, a case's own take precedence
+	Vars map[string]string `yaml:"vars"`
+	// Generation parameters of every request, the provider's defaults when unset
+	MaxTokens   int      `yaml:"max_tokens"`
+	Temperature *float64 `yaml:"temperature"`
+	Cases       []Case   `yaml:"cases"`
+}
+
+// Case is a prompt and the checks its response must pass
+type Case struct {
+	Name string `yaml:"name"`
+	// The prompt template, the file is read when the text isn't given
+	Prompt     string `yaml:"prompt"`
+	PromptFile string `yaml:"prompt_file"`
+	// Overrides the suite's system prompt
+	System     string            `yaml:"system"`
+	SystemFile string            `yaml:"system_file"`
+	Vars       map[string]string `yaml:"vars"`
+	// PDFs or text files whose text is sent with the prompt
+	Documents []string `yaml:"documents"`
+	// Image files or URLs
+	Images []string `yaml:"images"`
+	Checks []Check  `yaml:"checks"`
+
+	// The rendered prompts
+	prompt string
+	system string
+}
+
+// Check is one expectation of a response, exactly one of its fields is set
+type Check struct {
+	// The response contains the text
+	Contains string `yaml:"contains,omitempty"`
+	// The response matches the regular expression
+	Regex string `yaml:"regex,omitempty"`
+	// The response is the text, ignoring surrounding whitespace
+	Exact *string `yaml:"exact,omitempty"`
+	// The response is JSON valid against the schema, it may be in a fenced code block
+	JSONSchema map[string]any `yaml:"json_schema,omitempty"`
+	// The judge model decides whether the response meets the rubric
+	Judge string `yaml:"judge,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// String describes the check in reports
+func (c Check) String() string {
+	switch {
+	case c.Contains != "":
+		return fmt.Sprintf("contains %q", c.Contains)
+	case c.Regex != "":
+		return fmt.Sprintf("matches /%s/", c.Regex)
+	case c.Exact != nil:
+		return fmt.Sprintf("is exactly %q", truncate(*c.Exact, 40))
+	case c.JSONSchema != nil:
+		return "is valid JSON for the schema"
+	default:
+		return fmt.Sprintf("judged %q", truncate(c.Judge, 40))
+	}
+}
+
+// Load reads the suite at path, rendering the prompts of its cases
+func Load(path string) (*Suite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	suite := &Suite{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(suite); err != nil {
+		return nil, fmt.Errorf("parsing suite %s: %w", path, err)
+	}
+
+	if suite.Name == "" {
+		suite.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if err := suite.prepare(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("suite %s: %w", path, err)
+	}
+
+	return suite, nil
+}
+
+// NeedsJudge reports whether any case has a judge check
+func (s *Suite) NeedsJudge() bool {
+	for _, c := range s.Cases {
+		for _, check := range c.Checks {
+			if check.Judge != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepare checks the suite is well formed, reading its files relative to dir and rendering its prompts
+func (s *Suite) prepare(dir string) error {
+	if len(s.Cases) == 0 {
+		return errors.New("no cases")
+	}
+
+	system, err := readText(dir, s.System, s.SystemFile)
+	if err != nil {
+		return fmt.Errorf("reading system prompt: %w", err)
+	}
+
+	names := map[string]bool{}
+	for i := range s.Cases {
+		c := &s.Cases[i]
+		if c.Name == "" {
+			return fmt.Errorf("case %d has no name", i+1)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("case %q is defined twice", c.Name)
+		}
+		names[c.Name] = true
+
+		if err := c.prepare(dir, system, s.Vars); err != nil {
+			return fmt.Errorf("case %q: %w", c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Case) prepare(dir, system string, suiteVars map[string]string) error {
+	vars := map[string]string{}
+	for k, v := range suiteVars {
+		vars[k] = v
+	}
+	for k, v := range c.Vars {
+		vars[k] = v
+	}
+
+	prompt, err := readText(dir, c.Prompt, c.PromptFile)
+	if err != nil {
+		return fmt.Errorf("reading prompt: %w", err)
+	}
+	if prompt == "" {
+		return errors.New("no prompt, set prompt or prompt_file")
+	}
+	c.prompt, err = render(prompt, vars)
+	if err != nil {
+		return fmt.Errorf("rendering prompt: %w", err)
+	}
+
+	if c.System != "" || c.SystemFile != "" {
+		system, err = readText(dir, c.System, c.SystemFile)
+		if err != nil {
+			return fmt.Errorf("reading system prompt: %w", err)
+		}
+	}
+	c.system, err = render(system, vars)
+	if err != nil {
+		return fmt.Errorf("rendering system prompt: %w", err)
+	}
+
+	for i, path := range c.Documents {
+		c.Documents[i] = resolve(dir, path)
+	}
+	for i, path := range c.Images {
+		c.Images[i] = resolve(dir, path)
+	}
+
+	if len(c.Checks) == 0 {
+		return errors.New("no checks")
+	}
+	for i := range c.Checks {
+		if err := c.Checks[i].prepare(); err != nil {
+			return fmt.Errorf("check %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Check) prepare() error {
+	set := 0
+	for _, isSet := range []bool{c.Contains != "", c.Regex != "", c.Exact != nil, c.JSONSchema != nil, c.Judge != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("must have exactly one of contains, regex, exact, json_schema or judge")
+	}
+
+	if c.Regex != "" {
+		var err error
+		c.regex, err = regexp.Compile(c.Regex)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.JSONSchema != nil {
+		if err := checkSchema(c.JSONSchema, ""); err != nil {
+			return fmt.Errorf("json_schema: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// readText returns text, or the contents of the file when text is empty
+func readText(dir, text, file string) (string, error) {
+	if text != "" || file == "" {
+		return text, nil
+	}
+
+	data, err := os.ReadFile(resolve(dir, file))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// render executes text as a template, a missing variable is an error
+func render(text string, vars map[string]string) (string, error) {
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, vars); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// resolve makes path relative to dir, URLs and absolute paths are left alone
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) || strings.Contains(path, "://") {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,326 @@
+// Package fake is a deterministic stand in for an LLM provider, for testing code built on llm.Client
+//
+// The model name picks how the fake replies when no responses are scripted:
+//
+//	fake:echo        repeats the last user message back
+//	fake:error-429   fails with a rate limit error
+//	fake:error-529   fails with an overloaded error
+//	fake:disconnect  drops the connection halfway through the reply
+//	fake:<text>      replies with text
+//
+// Adding ?delay=50ms to the name waits between each streamed chunk, e.g. fake:echo?delay=50ms
+package fake
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Prefix marks a model name as one handled by the fake provider
+const Prefix = "fake:"
+
+// Behaviors selected by the model name
+const (
+	Echo        = Prefix + "echo"
+	RateLimited = Prefix + "error-429"
+	Overloaded  = Prefix + "error-529"
+	Disconnect  = Prefix + "disconnect"
+)
+
+// Response is a scripted reply
+type Response struct {
+	Text string
+	// Defaults to end_turn
+	StopReason string
+	// Anything other than 200 is sent back as an API error instead of a stream
+	StatusCode int
+	// Drops the connection after this many chunks of Text have been streamed, zero streams all of it
+	DisconnectAfter int
+	// Response headers, like the rate limit headers providers send
+	Header http.Header
+}
+
+// Call is a request the fake received
+type Call struct {
+	Messages []wire.Message
+	System   []wire.Text
+	Options  wire.Options
+}
+
+type Client struct {
+	model string
+	// Time to wait before each chunk of the stream
+	delay     time.Duration
+	responses []Response
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithResponses replies to requests with responses in order, the last one is repeated once they run out
+func WithResponses(responses ...Response) Option {
+	return func(c *Client) {
+		c.responses = append(c.responses, responses...)
+	}
+}
+
+// WithDelay waits between each streamed chunk, to simulate a slow model
+func WithDelay(delay time.Duration) Option {
+	return func(c *Client) {
+		c.delay = delay
+	}
+}
+
+// NewClient creates a fake for the model, see the package docs for the names it understands
+// An invalid delay in the model name is ignored
+func NewClient(model string, opts ...Option) *Client {
+	c := &Client{model: model}
+
+	if name, query, ok := strings.Cut(model, "?"); ok {
+		c.model = name
+		if values, err := url.ParseQuery(query); err == nil {
+			c.delay, _ = time.ParseDuration(values.Get("delay"))
+		}
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (c *Client) Model() string {
+	return c.model
+}
+
+// Calls returns every request sent to the fake so far
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Call(nil), c.calls...)
+}
+
+// SendMessage replies to the request, options are recorded but don't change the reply
+func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+
+	c.mu.Lock()
+	call := len(c.calls)
+	c.calls = append(c.calls, Call{Messages: messages, System: system, Options: wire.NewOptions(opts...)})
+	c.mu.Unlock()
+
+	rsp := c.respond(call, messages)
+	if rsp.StatusCode != http.StatusOK {
+		return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: strings.NewReader(errorBody(rsp.StatusCode))}, nil
+	}
+
+	usage := wire.Usage{InputTokens: countTokens(messages, system), OutputTokens: tokenizer.Estimate(rsp.Text)}
+	events := []wire.Event{{Type: wire.EventStart, Model: c.model}}
+	for _, chunk := range chunks(rsp.Text) {
+		events = append(events, wire.Event{Type: wire.EventText, Text: chunk})
+	}
+	events = append(events, wire.Event{Type: wire.EventStop, StopReason: rsp.StopReason, Usage: &usage})
+
+	// Leave the start event, and the stop event too when disconnecting
+	if rsp.DisconnectAfter > 0 {
+		events = events[:min(len(events)-1, rsp.DisconnectAfter+1)]
+	}
+
+	r, w := io.Pipe()
+	// The writer may be blocked on a reader that's gone, canceling the request unblocks it
+	stop := context.AfterFunc(ctx, func() { w.CloseWithError(ctx.Err()) })
+	go func() {
+		defer stop()
+
+		enc := json.NewEncoder(w)
+		for _, event := range events {
+			if c.delay > 0 {
+				select {
+				case <-ctx.Done():
+					w.CloseWithError(ctx.Err())
+					return
+				case <-time.After(c.delay):
+				}
+			}
+			if err := enc.Encode(event); err != nil {
+				return
+			}
+		}
+
+		if rsp.DisconnectAfter > 0 {
+			w.CloseWithError(io.ErrUnexpectedEOF)
+			return
+		}
+		w.Close()
+	}()
+	body := &pipeBody{PipeReader: r}
+
+	return &wire.Response{StatusCode: http.StatusOK, Header: rsp.Header, Body: &wire.TimedBody{Reader: body, Sent: sent, Received: time.Now()}}, nil
+}
+
+var errBodyClosed = errors.New("fake: response body closed")
+
+// pipeBody is a streamed reply, closing it stops the writer from sending the rest
+type pipeBody struct {
+	*io.PipeReader
+}
+
+func (b *pipeBody) Close() error {
+	return b.CloseWithError(errBodyClosed)
+}
+
+// respond picks the reply to the call'th request
+func (c *Client) respond(call int, messages []wire.Message) Response {
+	var rsp Response
+	switch {
+	case len(c.responses) > 0:
+		rsp = c.responses[min(call, len(c.responses)-1)]
+	case c.model == Echo:
+		rsp = Response{Text: lastUserText(messages)}
+	case c.model == RateLimited:
+		rsp = Response{StatusCode: http.StatusTooManyRequests}
+	case c.model == Overloaded:
+		rsp = Response{StatusCode: 529}
+	case c.model == Disconnect:
+		rsp = Response{Text: "This reply is cut off before it finishes, it never gets to the end"}
+		rsp.DisconnectAfter = len(chunks(rsp.Text)) / 2
+	default:
+		rsp = Response{Text: strings.TrimPrefix(c.model, Prefix)}
+	}
+
+	if rsp.StatusCode == 0 {
+		rsp.StatusCode = http.StatusOK
+	}
+	if rsp.StopReason == "" {
+		rsp.StopReason = "end_turn"
+	}
+
+	return rsp
+}
+
+func (c *Client) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	// Stop the writer when the reply isn't read to the end, e.g. when the handler fails
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	stopwatch := wire.StartStopwatch(body)
+	handler = stopwatch.Handler(handler)
+
+	scanner := bufio.NewScanner(body)
+
+	completion := &wire.Completion{Model: c.model}
+	for scanner.Scan() {
+		event := wire.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return completion, fmt.Errorf("unmarshaling response: %w", err)
+		}
+
+		switch event.Type {
+		case wire.EventText:
+			completion.Text += event.Text
+		case wire.EventStop:
+			completion.StopReason = event.StopReason
+			if event.Usage != nil {
+				completion.Usage = *event.Usage
+			}
+		}
+
+		if err := handler.Emit(event); err != nil {
+			return completion, err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return completion, fmt.Errorf("reading response stream: %w", err)
+	}
+
+	completion.Timing = stopwatch.Timing(completion.Usage.OutputTokens)
+	return completion, nil
+}
+
+// CountTokens estimates the tokens in a request from the length of its text
+func (c *Client) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return countTokens(messages, system), nil
+}
+
+func countTokens(messages []wire.Message, system []wire.Text) int {
+	var tokens int
+	for _, block := range system {
+		tokens += tokenizer.Estimate(block.Text)
+	}
+	for _, msg := range messages {
+		for _, content := range msg.Content {
+			if text, ok := content.(*wire.Text); ok {
+				tokens += tokenizer.Estimate(text.Text)
+			}
+		}
+	}
+	return tokens
+}
+
+func lastUserText(messages []wire.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+
+		var parts []string
+		for _, content := range messages[i].Content {
+			if text, ok := content.(*wire.Text); ok && text.Text != "" {
+				parts = append(parts, text.Text)
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// chunks splits text into the pieces it's streamed in, a word at a time
+func chunks(text string) []string {
+	var pieces []string
+	for text != "" {
+		end := strings.IndexByte(text, ' ') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// errorBody is the body of an error response in the shape both providers use
+func errorBody(statusCode int) string {
+	errType, message := "api_error", "Internal server error"
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		errType, message = "rate_limit_error", "Number of requests has exceeded your rate limit"
+	case 529:
+		errType, message = "overloaded_error", "Overloaded"
+	case http.StatusBadRequest:
+		errType, message = "invalid_request_error", "Invalid request"
+	}
+
+	return fmt.Sprintf(`{"type":"error","error":{"type":%q,"message":%q}}`, errType, message)
+}
@@ -0,0 +1,197 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func userMessage(text string) []wire.Message {
+	return []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}}
+}
+
+func TestClient(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Model        string
+		Options      []fake.Option
+		ExpectedText string
+		ExpectedCode int
+		ExpectedErr  error
+	}{
+		{Name: "echo", Model: fake.Echo, ExpectedText: "Hello there", ExpectedCode: http.StatusOK},
+		{Name: "text from the model name", Model: "fake:General Kenobi", ExpectedText: "General Kenobi", ExpectedCode: http.StatusOK},
+		{Name: "rate limited", Model: fake.RateLimited, ExpectedCode: http.StatusTooManyRequests},
+		{Name: "overloaded", Model: fake.Overloaded, ExpectedCode: 529},
+		{Name: "disconnect", Model: fake.Disconnect, ExpectedText: "This reply is cut off before it ", ExpectedCode: http.StatusOK, ExpectedErr: io.ErrUnexpectedEOF},
+		{
+			Name:         "scripted",
+			Model:        fake.Echo,
+			Options:      []fake.Option{fake.WithResponses(fake.Response{Text: "Scripted reply"})},
+			ExpectedText: "Scripted reply",
+			ExpectedCode: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := fake.NewClient(test.Model, test.Options...)
+
+			rsp, err := client.SendMessage(context.Background(), userMessage("Hello there"), nil)
+			require.NoError(t, err)
+			require.Equal(t, test.ExpectedCode, rsp.StatusCode)
+
+			if rsp.StatusCode != http.StatusOK {
+				apiErr := wire.NewAPIError(rsp.StatusCode, rsp.Body)
+				require.NotEmpty(t, apiErr.Type)
+				return
+			}
+
+			completion, err := client.ReadBody(rsp.Body, nil)
+			if test.ExpectedErr != nil {
+				require.ErrorIs(t, err, test.ExpectedErr)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, "end_turn", completion.StopReason)
+			}
+			require.Equal(t, test.ExpectedText, completion.Text)
+		})
+	}
+}
+
+func TestScriptedResponsesInOrder(t *testing.T) {
+	client := fake.NewClient("fake:scripted", fake.WithResponses(
+		fake.Response{StatusCode: http.StatusTooManyRequests},
+		fake.Response{Text: "first"},
+		fake.Response{Text: "second"},
+	))
+
+	var codes []int
+	var texts []string
+	for i := 0; i < 4; i++ {
+		rsp, err := client.SendMessage(context.Background(), userMessage("hi"), wire.SystemPrompt("be brief"))
+		require.NoError(t, err)
+		codes = append(codes, rsp.StatusCode)
+		if rsp.StatusCode == http.StatusOK {
+			completion, err := client.ReadBody(rsp.Body, nil)
+			require.NoError(t, err)
+			texts = append(texts, completion.Text)
+		}
+	}
+
+	require.Equal(t, []int{429, 200, 200, 200}, codes)
+	require.Equal(t, []string{"first", "second", "second"}, texts)
+
+	calls := client.Calls()
+	require.Len(t, calls, 4)
+	require.Equal(t, "be brief", calls[0].System[0].Text)
+}
+
+func TestStreamingDelay(t *testing.T) {
+	client := fake.NewClient("fake:one two three?delay=20ms")
+	require.Equal(t, "fake:one two three", client.Model())
+
+	rsp, err := client.SendMessage(context.Background(), userMessage("hi"), nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	var arrivals []time.Duration
+	completion, err := client.ReadBody(rsp.Body, func(event wire.Event) error {
+		if event.Type == wire.EventText {
+			arrivals = append(arrivals, time.Since(start))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "one two three", completion.Text)
+	require.Len(t, arrivals, 3)
+	require.GreaterOrEqual(t, arrivals[2]-arrivals[0], 40*time.Millisecond)
+	require.Greater(t, completion.Usage.OutputTokens, 0)
+}
+
+func TestCanceledStream(t *testing.T) {
+	client := fake.NewClient(fake.Echo, fake.WithDelay(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rsp, err := client.SendMessage(ctx, userMessage("hi"), nil)
+	require.NoError(t, err)
+	cancel()
+
+	_, err = client.ReadBody(rsp.Body, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestAbandonedStream(t *testing.T) {
+	long := fake.Response{Text: strings.Repeat("word ", 100)}
+	errStop := errors.New("stop")
+
+	tests := []struct {
+		name    string
+		abandon func(rsp *wire.Response, client *fake.Client, cancel context.CancelFunc)
+	}{
+		{
+			name: "handler fails",
+			abandon: func(rsp *wire.Response, client *fake.Client, cancel context.CancelFunc) {
+				_, err := client.ReadBody(rsp.Body, func(wire.Event) error { return errStop })
+				require.ErrorIs(t, err, errStop)
+			},
+		},
+		{
+			name: "body closed",
+			abandon: func(rsp *wire.Response, client *fake.Client, cancel context.CancelFunc) {
+				require.NoError(t, rsp.Body.(io.Closer).Close())
+			},
+		},
+		{
+			name: "request canceled",
+			abandon: func(rsp *wire.Response, client *fake.Client, cancel context.CancelFunc) {
+				cancel()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			client := fake.NewClient(fake.Echo, fake.WithResponses(long))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rsp, err := client.SendMessage(ctx, userMessage("hi"), nil)
+			require.NoError(t, err)
+
+			// The writer stops instead of blocking forever on a reader that's gone
+			tt.abandon(rsp, client, cancel)
+			// Polled here since require.Eventually starts goroutines of its own
+			for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+				require.True(t, time.Now().Before(deadline), "the writer is still running")
+			}
+		})
+	}
+}
+
+func TestTiming(t *testing.T) {
+	client := fake.NewClient("fake:one two three", fake.WithDelay(20*time.Millisecond))
+
+	rsp, err := client.SendMessage(context.Background(), userMessage("hi"), nil)
+	require.NoError(t, err)
+	completion, err := client.ReadBody(rsp.Body, nil)
+	require.NoError(t, err)
+
+	// The start event and first chunk are each delayed
+	timing := completion.Timing
+	require.NotNil(t, timing)
+	require.Less(t, timing.TimeToFirstByte, 20*time.Millisecond)
+	require.GreaterOrEqual(t, timing.TimeToFirstToken, 40*time.Millisecond)
+	require.GreaterOrEqual(t, timing.Total, timing.TimeToFirstToken+40*time.Millisecond)
+	require.Greater(t, timing.OutputTokensPerSecond, 0.0)
+}
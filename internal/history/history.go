@@ -0,0 +1,192 @@
+// Package history keeps a chat's conversation history within a token budget
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/davidhbaek/llm/internal/wire"
+	"rsc.io/pdf"
+)
+
+// Strategy decides what happens to a conversation once it's over its token budget
+type Strategy string
+
+const (
+	// Drop the oldest turns, except a first turn with attachments
+	DropOldest Strategy = "drop-oldest"
+	// Keep the first turns of the conversation and drop the oldest turns after them
+	PinPrefix Strategy = "pin-prefix"
+	// Have the model summarize the oldest turns into a running summary
+	Summarize Strategy = "summarize"
+)
+
+func ParseStrategy(s string) (Strategy, error) {
+	switch strategy := Strategy(s); strategy {
+	case DropOldest, PinPrefix, Summarize:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("context strategy must be one of [drop-oldest, pin-prefix, summarize], got %q", s)
+	}
+}
+
+// Summarizer condenses a previous summary and the turns that followed it into a new summary
+type Summarizer func(ctx context.Context, summary string, turns []wire.Message) (string, error)
+
+// Rough token costs used when the provider's tokenizer isn't available, text is estimated by tokenizer.Estimate
+const (
+	messageOverhead = 4
+	imageTokens     = 1600
+	// PDFs are sent as each page's text and an image of it
+	pdfPageTokens = 3000
+)
+
+var ErrOverBudget = errors.New("latest message alone is over the context budget")
+
+type Manager struct {
+	// Maximum number of tokens the conversation can use
+	Budget   int
+	Strategy Strategy
+	// Messages at the start of the conversation kept by PinPrefix
+	Pinned int
+	// Tokens used by anything sent alongside the conversation, like the system prompt
+	Reserved  int
+	Summarize Summarizer
+
+	messages []wire.Message
+	// Estimated tokens of each message, worked out once when it's added since documents are costly to read
+	tokens  []int
+	summary string
+}
+
+func NewManager(budget int, strategy Strategy) *Manager {
+	return &Manager{
+		Budget:   budget,
+		Strategy: strategy,
+		Pinned:   2,
+	}
+}
+
+// Add appends a message to the conversation, call Fit before sending it
+func (m *Manager) Add(msg wire.Message) {
+	m.messages = append(m.messages, msg)
+	m.tokens = append(m.tokens, EstimateTokens(msg))
+}
+
+// Messages returns the conversation to send, with the running summary folded into the first message
+func (m *Manager) Messages() []wire.Message {
+	if m.summary == "" || len(m.messages) == 0 {
+		return m.messages
+	}
+
+	messages := make([]wire.Message, len(m.messages))
+	copy(messages, m.messages)
+
+	first := messages[0]
+	summary := &wire.Text{Type: "text", Text: fmt.Sprintf("<conversation_summary>%s</conversation_summary>", m.summary)}
+	messages[0] = wire.Message{Role: first.Role, Content: append([]wire.Content{summary}, first.Content...)}
+
+	return messages
+}
+
+// Tokens estimates how many tokens the conversation currently uses
+func (m *Manager) Tokens() int {
+	tokens := m.Reserved + tokenizer.Estimate(m.summary)
+	for _, t := range m.tokens {
+		tokens += t
+	}
+	return tokens
+}
+
+// Summary returns the running summary of turns that no longer fit in the budget
+func (m *Manager) Summary() string {
+	return m.summary
+}
+
+// Fit applies the strategy until the conversation is back within its budget
+func (m *Manager) Fit(ctx context.Context) error {
+	if m.Budget <= 0 || m.Tokens() <= m.Budget {
+		return nil
+	}
+
+	start := 0
+	if m.Strategy == PinPrefix {
+		start = m.Pinned
+	}
+	// Documents and images only come with the first prompt, so its turn is kept for the rest of the conversation
+	if start < 2 && len(m.messages) > 0 && hasAttachments(m.messages[0]) {
+		start = 2
+	}
+
+	// Turns are removed in user/assistant pairs so the conversation still starts with a user message
+	var dropped []wire.Message
+	for m.Tokens() > m.Budget && len(m.messages)-start > 2 {
+		dropped = append(dropped, m.messages[start:start+2]...)
+		m.messages = append(m.messages[:start:start], m.messages[start+2:]...)
+		m.tokens = append(m.tokens[:start:start], m.tokens[start+2:]...)
+	}
+
+	if m.Strategy == Summarize && len(dropped) > 0 {
+		if m.Summarize == nil {
+			return errors.New("summarize strategy needs a summarizer")
+		}
+
+		summary, err := m.Summarize(ctx, m.summary, dropped)
+		if err != nil {
+			return fmt.Errorf("summarizing conversation: %w", err)
+		}
+		m.summary = summary
+	}
+
+	if m.Tokens() > m.Budget {
+		return ErrOverBudget
+	}
+
+	return nil
+}
+
+// hasAttachments reports whether a message has anything besides text, like documents or images
+func hasAttachments(msg wire.Message) bool {
+	for _, content := range msg.Content {
+		if _, ok := content.(*wire.Text); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// EstimateTokens approximates the tokens a message uses without calling a tokenizer
+func EstimateTokens(msg wire.Message) int {
+	tokens := messageOverhead
+	for _, content := range msg.Content {
+		switch c := content.(type) {
+		case *wire.Text:
+			tokens += tokenizer.Estimate(c.Text)
+		case *wire.Document:
+			tokens += documentTokens(c.Source)
+		default:
+			tokens += imageTokens
+		}
+	}
+	return tokens
+}
+
+// documentTokens approximates a document by its pages, or by its size when it can't be read
+func documentTokens(source wire.DocumentSource) int {
+	if source.Type != "base64" {
+		return tokenizer.Estimate(source.Data)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(source.Data)
+	if err != nil {
+		return tokenizer.Estimate(source.Data)
+	}
+	if r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data))); err == nil {
+		return r.NumPage() * pdfPageTokens
+	}
+	return tokenizer.Estimate(string(data))
+}
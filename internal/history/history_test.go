@@ -0,0 +1,174 @@
+package history_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/history"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func msg(role, text string) wire.Message {
+	return wire.Message{Role: role, Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}
+}
+
+func text(msg wire.Message) string {
+	var parts []string
+	for _, c := range msg.Content {
+		parts = append(parts, c.(*wire.Text).Text)
+	}
+	return strings.Join(parts, " ")
+}
+
+// conversation adds turns of 40 characters, roughly 14 tokens per message
+func conversation(m *history.Manager, turns int) {
+	for i := 0; i < turns; i++ {
+		m.Add(msg("user", strings.Repeat(string(rune('a'+i)), 40)))
+		m.Add(msg("assistant", strings.Repeat(string(rune('A'+i)), 40)))
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Strategy      history.Strategy
+		Budget        int
+		ExpectedFirst []string
+		ExpectedLen   int
+	}{
+		{Name: "under budget keeps everything", Strategy: history.DropOldest, Budget: 1000, ExpectedFirst: []string{"a", "A"}, ExpectedLen: 8},
+		{Name: "drop oldest turns", Strategy: history.DropOldest, Budget: 60, ExpectedFirst: []string{"c", "C"}, ExpectedLen: 4},
+		{Name: "pinned prefix is kept", Strategy: history.PinPrefix, Budget: 60, ExpectedFirst: []string{"a", "A", "d"}, ExpectedLen: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			m := history.NewManager(test.Budget, test.Strategy)
+			conversation(m, 4)
+
+			require.NoError(t, m.Fit(context.Background()))
+			messages := m.Messages()
+			require.Len(t, messages, test.ExpectedLen)
+			require.Equal(t, "user", messages[0].Role)
+			for i, prefix := range test.ExpectedFirst {
+				require.True(t, strings.HasPrefix(text(messages[i]), prefix))
+			}
+			require.LessOrEqual(t, m.Tokens(), test.Budget)
+		})
+	}
+}
+
+func TestFitSummarize(t *testing.T) {
+	m := history.NewManager(70, history.Summarize)
+	var summarized []wire.Message
+	m.Summarize = func(ctx context.Context, summary string, turns []wire.Message) (string, error) {
+		summarized = append(summarized, turns...)
+		return "earlier turns", nil
+	}
+	conversation(m, 4)
+
+	require.NoError(t, m.Fit(context.Background()))
+	require.Len(t, summarized, 4)
+	require.Equal(t, "earlier turns", m.Summary())
+
+	messages := m.Messages()
+	require.Len(t, messages, 4)
+	require.True(t, strings.HasPrefix(text(messages[0]), "<conversation_summary>earlier turns</conversation_summary> c"))
+}
+
+func TestFitKeepsAttachments(t *testing.T) {
+	for _, strategy := range []history.Strategy{history.DropOldest, history.Summarize} {
+		t.Run(string(strategy), func(t *testing.T) {
+			m := history.NewManager(1690, strategy)
+			m.Summarize = func(ctx context.Context, summary string, turns []wire.Message) (string, error) {
+				return "earlier turns", nil
+			}
+			image := &wire.AnthropicImage{Type: "image"}
+			m.Add(wire.Message{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "What's this?"}, image}})
+			m.Add(msg("assistant", "A cat"))
+			conversation(m, 4)
+
+			require.NoError(t, m.Fit(context.Background()))
+			messages := m.Messages()
+			require.Contains(t, messages[0].Content, image)
+			require.Less(t, len(messages), 10)
+		})
+	}
+}
+
+func TestFitOverBudget(t *testing.T) {
+	m := history.NewManager(5, history.DropOldest)
+	conversation(m, 1)
+
+	require.ErrorIs(t, m.Fit(context.Background()), history.ErrOverBudget)
+}
+
+// makePDF builds a minimal PDF with blank pages
+func makePDF(pages int) []byte {
+	var kids []string
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	for i := 0; i < pages; i++ {
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)+1))
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>")
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages)
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestEstimateTokensDocuments(t *testing.T) {
+	document := func(source wire.DocumentSource) wire.Message {
+		return wire.Message{Role: "user", Content: []wire.Content{&wire.Document{Type: "document", Source: source}}}
+	}
+
+	tests := []struct {
+		name   string
+		source wire.DocumentSource
+		want   int
+	}{
+		{
+			name:   "pdf pages",
+			source: wire.DocumentSource{Type: "base64", MediaType: "application/pdf", Data: base64.StdEncoding.EncodeToString(makePDF(200))},
+			want:   4 + 200*3000,
+		},
+		{
+			name:   "unreadable pdf by size",
+			source: wire.DocumentSource{Type: "base64", MediaType: "application/pdf", Data: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("x"), 4000))},
+			want:   4 + 1000,
+		},
+		{
+			name:   "text",
+			source: wire.DocumentSource{Type: "text", MediaType: "text/plain", Data: strings.Repeat("x", 400)},
+			want:   4 + 100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, history.EstimateTokens(document(tt.source)))
+		})
+	}
+
+	// A long PDF alone is over a chat's budget
+	m := history.NewManager(100_000, history.DropOldest)
+	m.Add(document(tests[0].source))
+	require.ErrorIs(t, m.Fit(context.Background()), history.ErrOverBudget)
+}
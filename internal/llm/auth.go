@@ -0,0 +1,121 @@
+package llm
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/davidhbaek/llm/internal/credentials"
+)
+
+// Providers needing an API key
+var providers = []string{"anthropic", "openai"}
+
+// authCommand shows where API keys come from and stores them in the keyring
+// llm auth status
+// llm auth set <provider> < key
+func authCommand(args []string, stdin io.Reader, stdout io.Writer) int {
+	fl := flag.NewFlagSet("auth", flag.ContinueOnError)
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	switch fl.Arg(0) {
+	case "status":
+		if fl.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "parsing args: auth status takes no arguments")
+			return exitUsage
+		}
+		return authStatus(credentials.Default(), stdout)
+	case "set":
+		if fl.NArg() != 2 || !isProvider(fl.Arg(1)) {
+			fmt.Fprintf(os.Stderr, "parsing args: auth set needs a provider, one of %v\n", providers)
+			return exitUsage
+		}
+		return authSet(fl.Arg(1), stdin, stdout)
+	case "":
+		fmt.Fprintln(os.Stderr, "parsing args: auth needs a command, one of [status, set]")
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "parsing args: unknown auth command %q, want one of [status, set]\n", fl.Arg(0))
+		return exitUsage
+	}
+}
+
+// authStatus lists the source of each provider's key with a fingerprint, to tell keys apart without showing them
+func authStatus(resolver *credentials.Resolver, stdout io.Writer) int {
+	code := exitOK
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "provider\tsource\tkey")
+	for _, provider := range providers {
+		key, source, err := resolver.Lookup(provider)
+		switch {
+		case errors.Is(err, credentials.ErrNotFound):
+			fmt.Fprintf(w, "%s\tnot set\t-\n", provider)
+		case err != nil:
+			fmt.Fprintf(w, "%s\t%s\terror: %v\n", provider, source, err)
+			code = exitRuntime
+		default:
+			fmt.Fprintf(w, "%s\t%s\tsha256:%s\n", provider, source, fingerprint(key))
+		}
+	}
+	w.Flush()
+
+	return code
+}
+
+// fingerprint identifies a key without revealing it
+func fingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// authSet stores the key read from stdin in the keyring
+func authSet(provider string, stdin io.Reader, stdout io.Writer) int {
+	dir, err := credentials.ConfigDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: finding the config directory: %v\n", err)
+		return exitRuntime
+	}
+	keyring := credentials.DefaultKeyring(dir)
+
+	if isTerminal(os.Stdin) {
+		fmt.Fprintf(os.Stderr, "paste the %s API key and press enter: ", provider)
+	}
+	key, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintf(os.Stderr, "runtime error: reading the key: %v\n", err)
+		return exitRuntime
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		fmt.Fprintln(os.Stderr, "parsing args: auth set reads the key from stdin, and it was empty")
+		return exitUsage
+	}
+
+	if err := keyring.Set(provider, key); err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitRuntime
+	}
+
+	fmt.Fprintf(stdout, "stored the %s key sha256:%s in %s\n", provider, fingerprint(key), keyring.Path)
+	return exitOK
+}
+
+func isProvider(name string) bool {
+	for _, provider := range providers {
+		if provider == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package llm
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/davidhbaek/llm/internal/ratelimit"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// benchCommand sends a prompt to each model n times and prints percentiles of how fast they responded
+// Responses are never cached, every run goes to the provider
+// llm bench -m haiku [-m gpt4] [-n 10] [--concurrency 2] -p prompt
+func benchCommand(args []string, stdout io.Writer) int {
+	fl := flag.NewFlagSet("bench", flag.ContinueOnError)
+
+	var names fileList
+	fl.Var(&names, "m", "list of models to benchmark")
+	fl.Var(&names, "model", "list of models to benchmark")
+
+	var prompt string
+	fl.StringVar(&prompt, "p", "", "user prompt to send on every run")
+	fl.StringVar(&prompt, "prompt", "", "user prompt to send on every run")
+
+	var runs int
+	fl.IntVar(&runs, "n", 10, "number of times to send the prompt to each model")
+
+	var concurrency int
+	fl.IntVar(&concurrency, "concurrency", 1, "number of runs against a model at once")
+
+	var maxTokens int
+	fl.IntVar(&maxTokens, "max-tokens", 0, "maximum tokens in each response, the provider's default when 0")
+
+	limits := limitFlags(fl)
+	logs := logFlags(fl, "warn")
+
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	logger, err := logs.setup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	limits.Logger = logger
+
+	switch {
+	case prompt == "":
+		err = fmt.Errorf("bench needs a prompt, pass it with -p")
+	case len(names) == 0:
+		err = fmt.Errorf("bench needs at least one model, pass it with -m")
+	case runs < 1:
+		err = fmt.Errorf("-n must be at least 1, got %d", runs)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	registry := ratelimit.NewRegistry(*limits)
+	clients := make([]Client, len(names))
+	for i, name := range names {
+		model, err := resolveModel(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+			return exitUsage
+		}
+
+		client, err := setupClient(model)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+			return exitUsage
+		}
+		clients[i] = registry.Wrap(providerOf(model), instrument(client, logger))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var opts []wire.Option
+	if maxTokens > 0 {
+		opts = append(opts, wire.WithMaxTokens(maxTokens))
+	}
+
+	// Models are run one after the other so they don't slow each other down
+	results := make([]benchResult, len(clients))
+	for i, client := range clients {
+		fmt.Fprintf(os.Stderr, "benchmarking %s\n", client.Model())
+		results[i] = bench(ctx, logger, client, prompt, runs, concurrency, opts)
+	}
+
+	if err := printBench(stdout, results); err != nil {
+		fmt.Fprintf(os.Stderr, "writing output: %v\n", err)
+		return exitRuntime
+	}
+
+	if ctx.Err() != nil {
+		return exitRuntime
+	}
+	for _, result := range results {
+		if len(result.timings) > 0 {
+			return exitOK
+		}
+	}
+	// Nothing was measured
+	return exitRuntime
+}
+
+// benchResult is the timing of every successful run against a model
+type benchResult struct {
+	model   string
+	timings []*wire.Timing
+	errors  int
+}
+
+// bench sends prompt to client runs times, at most concurrency at once
+// Failed runs are counted and logged rather than stopping the benchmark
+func bench(ctx context.Context, logger *slog.Logger, client Client, prompt string, runs, concurrency int, opts []wire.Option) benchResult {
+	timings := make([]*wire.Timing, runs)
+
+	var eg errgroup.Group
+	eg.SetLimit(max(1, concurrency))
+	for i := 0; i < runs; i++ {
+		i := i
+		eg.Go(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			timing, err := benchRun(ctx, client, prompt, opts)
+			if err != nil {
+				logger.Warn("run failed", "model", client.Model(), "run", i+1, "error", err)
+				return nil
+			}
+			timings[i] = timing
+			return nil
+		})
+	}
+	eg.Wait()
+
+	result := benchResult{model: client.Model()}
+	for _, timing := range timings {
+		if timing == nil {
+			result.errors++
+			continue
+		}
+		result.timings = append(result.timings, timing)
+	}
+	return result
+}
+
+// benchRun sends prompt once and reads the whole response
+func benchRun(ctx context.Context, client Client, prompt string, opts []wire.Option) (*wire.Timing, error) {
+	rsp, err := client.SendMessage(ctx, []wire.Message{userMessage(prompt)}, nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// Closing frees the request's rate limit slot and lets the connection be reused, even if reading fails
+	if closer, ok := rsp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	completion, err := client.ReadBody(rsp.Body, nil)
+	if err != nil {
+		return nil, err
+	}
+	if completion.Timing == nil {
+		return nil, fmt.Errorf("%s didn't time its response", client.Model())
+	}
+	return completion.Timing, nil
+}
+
+// Percentiles shown for each metric
+var benchPercentiles = []float64{50, 90, 99}
+
+// printBench writes a table of percentiles for each model
+func printBench(w io.Writer, results []benchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for i, result := range results {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s: %d runs, %d errors\n", result.model, len(result.timings)+result.errors, result.errors)
+		if len(result.timings) == 0 {
+			continue
+		}
+
+		header := []string{""}
+		for _, p := range benchPercentiles {
+			header = append(header, fmt.Sprintf("p%g", p))
+		}
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+		durations := []struct {
+			name  string
+			value func(*wire.Timing) time.Duration
+		}{
+			{"time to first byte", func(t *wire.Timing) time.Duration { return t.TimeToFirstByte }},
+			{"time to first token", func(t *wire.Timing) time.Duration { return t.TimeToFirstToken }},
+			{"total", func(t *wire.Timing) time.Duration { return t.Total }},
+		}
+		for _, metric := range durations {
+			values := make([]float64, len(result.timings))
+			for j, timing := range result.timings {
+				values[j] = float64(metric.value(timing))
+			}
+			row := []string{metric.name}
+			for _, p := range benchPercentiles {
+				row = append(row, time.Duration(percentile(values, p)).Round(time.Millisecond).String())
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+
+		values := make([]float64, len(result.timings))
+		for j, timing := range result.timings {
+			values[j] = timing.OutputTokensPerSecond
+		}
+		// A higher throughput is better, so its percentiles are taken from the slow end
+		row := []string{"output tokens/s"}
+		for _, p := range benchPercentiles {
+			row = append(row, fmt.Sprintf("%.1f", percentile(values, 100-p)))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// percentile returns the nearest rank pth percentile of values, 0 when there are none
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
@@ -0,0 +1,59 @@
+package llm
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/davidhbaek/llm/internal/cache"
+)
+
+// cacheCommand manages the cache of responses
+// llm cache clear|stats
+func cacheCommand(args []string, stdout io.Writer) int {
+	fl := flag.NewFlagSet("cache", flag.ContinueOnError)
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	if fl.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "parsing args: cache needs a command, one of [clear, stats]")
+		return exitUsage
+	}
+
+	dir, err := cache.Dir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: finding the cache directory: %v\n", err)
+		return exitRuntime
+	}
+	store := cache.NewStore(dir, cache.DefaultTTL, cache.DefaultMaxBytes)
+
+	switch fl.Arg(0) {
+	case "clear":
+		cleared, err := store.Clear()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+			return exitRuntime
+		}
+		fmt.Fprintf(stdout, "cleared %d cached responses from %s\n", cleared, dir)
+	case "stats":
+		stats, err := store.Stats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+			return exitRuntime
+		}
+
+		hitRate := 0.0
+		if lookups := stats.Hits + stats.Misses; lookups > 0 {
+			hitRate = float64(stats.Hits) / float64(lookups) * 100
+		}
+		fmt.Fprintf(stdout, "dir: %s\nentries: %d\nexpired: %d\nsize: %.1f MB of %d MB\nhits: %d\nmisses: %d\nhit rate: %.1f%%\n",
+			stats.Dir, stats.Entries, stats.Expired, float64(stats.Bytes)/(1024*1024), cache.DefaultMaxBytes/(1024*1024), stats.Hits, stats.Misses, hitRate)
+	default:
+		fmt.Fprintf(os.Stderr, "parsing args: unknown cache command %q, want one of [clear, stats]\n", fl.Arg(0))
+		return exitUsage
+	}
+
+	return exitOK
+}
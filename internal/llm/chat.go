@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/history"
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// runChatSession reads prompts from stdin until it's closed
+// attachments, like documents and images, are sent with the first prompt
+func (app *env) runChatSession(ctx context.Context, system []wire.Text, attachments []wire.Content) error {
+	slog.Debug("beginning chat session", "model", app.client.Model())
+	chatHistory := history.NewManager(app.contextBudget, app.contextStrategy)
+	chatHistory.Summarize = app.summarize
+	for _, block := range system {
+		chatHistory.Reserved += tokenizer.Estimate(block.Text)
+	}
+
+	input := bufio.NewReader(app.stdin)
+	var lastRsp string
+
+	for {
+		prompt, err := input.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// /save-code [dir] writes the code blocks from the last answer to disk
+		if cmd := strings.Fields(prompt); len(cmd) > 0 && cmd[0] == "/save-code" {
+			dir := app.codeDir
+			if len(cmd) > 1 {
+				dir = cmd[1]
+			}
+			if dir == "" {
+				dir = "."
+			}
+
+			if err := app.saveCode(dir, lastRsp); err != nil {
+				fmt.Fprintf(os.Stderr, "saving code: %v\n", err)
+			}
+			continue
+		}
+
+		content := append([]wire.Content{&wire.Text{Type: "text", Text: prompt}}, attachments...)
+		attachments = nil
+		chatHistory.Add(wire.Message{Role: "user", Content: content})
+
+		err = chatHistory.Fit(ctx)
+		if errors.Is(err, history.ErrOverBudget) {
+			fmt.Fprintf(os.Stderr, "warning: %v, sending it anyway\n", err)
+		} else if err != nil {
+			return fmt.Errorf("fitting chat history in context: %w", err)
+		}
+
+		chatRsp, err := app.send(ctx, chatHistory.Messages(), system)
+		if err != nil {
+			return fmt.Errorf("sending chat prompt: %w", err)
+		}
+
+		chatHistory.Add(wire.Message{Role: "assistant", Content: []wire.Content{&wire.Text{Type: "text", Text: chatRsp}}})
+		lastRsp = chatRsp
+
+		fmt.Fprintf(os.Stderr, "[context: ~%d/%d tokens, strategy=%s]\n", chatHistory.Tokens(), chatHistory.Budget, chatHistory.Strategy)
+	}
+}
+
+const summarizePrompt = `Summarize the conversation so far in a few short paragraphs.
+Keep any facts, decisions, names and open questions that later turns may refer back to.
+Only respond with the summary.`
+
+// summarize has the model condense turns that no longer fit in the chat's context budget
+func (app *env) summarize(ctx context.Context, summary string, turns []wire.Message) (string, error) {
+	slog.Debug("summarizing chat history", "messages", len(turns))
+
+	prompt := summarizePrompt
+	if summary != "" {
+		prompt = fmt.Sprintf("%s\nBuild on this summary of the turns before these:\n%s", prompt, wrapInXMLTags(summary, "conversation_summary"))
+	}
+
+	messages := append(append([]wire.Message{}, turns...), wire.Message{
+		Role:    "user",
+		Content: []wire.Content{&wire.Text{Type: "text", Text: prompt}},
+	})
+
+	completion, err := app.complete(ctx, messages, nil, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return completion.Text, nil
+}
@@ -1,31 +1,200 @@
 package llm
 
 import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
 	"github.com/davidhbaek/llm/internal/anthropic"
+	"github.com/davidhbaek/llm/internal/cache"
+	"github.com/davidhbaek/llm/internal/credentials"
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/middleware"
 	"github.com/davidhbaek/llm/internal/openai"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+	"github.com/davidhbaek/llm/internal/telemetry"
+	"github.com/davidhbaek/llm/internal/wire"
 )
 
-type ClientFactory func(model string) Client
+type ClientFactory func(model string) (Client, error)
 
 type ClientConfig struct {
 	Models map[string]ClientFactory
+	// Families of models named by a prefix, like fake:echo
+	Prefixes map[string]ClientFactory
 }
 
 func NewClientConfig() *ClientConfig {
 	return &ClientConfig{
 		Models: map[string]ClientFactory{
-			GPT4: func(model string) Client {
-				return openai.NewClient(model)
-			},
-			OPUS: func(model string) Client {
-				return anthropic.NewClient(model)
-			},
-			SONNET: func(model string) Client {
-				return anthropic.NewClient(model)
-			},
-			HAIKU: func(model string) Client {
-				return anthropic.NewClient(model)
+			GPT4:   openaiClient,
+			OPUS:   anthropicClient,
+			SONNET: anthropicClient,
+			HAIKU:  anthropicClient,
+		},
+		Prefixes: map[string]ClientFactory{
+			fake.Prefix: func(model string) (Client, error) {
+				return fake.NewClient(model), nil
 			},
 		},
 	}
 }
+
+// apiKeys finds the providers' keys, they're only looked up once per run
+// since a key command may prompt for a passphrase
+var apiKeys = sync.OnceValue(credentials.Default)
+
+func anthropicClient(model string) (Client, error) {
+	key, err := apiKeys().Key("anthropic")
+	if err != nil {
+		return nil, err
+	}
+	return anthropic.NewClient(model, anthropic.WithAPIKey(key)), nil
+}
+
+func openaiClient(model string) (Client, error) {
+	key, err := apiKeys().Key("openai")
+	if err != nil {
+		return nil, err
+	}
+	return openai.NewClient(model, openai.WithAPIKey(key)), nil
+}
+
+// factory returns the ClientFactory for model
+func (c *ClientConfig) factory(model string) (ClientFactory, bool) {
+	if factory, ok := c.Models[model]; ok {
+		return factory, true
+	}
+
+	for prefix, factory := range c.Prefixes {
+		if strings.HasPrefix(model, prefix) {
+			return factory, true
+		}
+	}
+
+	return nil, false
+}
+
+// Cost estimates the price in $USD of a request to model with the given token usage
+func Cost(model string, usage wire.Usage) float64 {
+	if strings.HasPrefix(model, "claude") {
+		return anthropic.Cost(model, usage)
+	}
+
+	return openai.Cost(model, usage)
+}
+
+// supportsDocumentBlocks reports whether model can read documents sent as their own content blocks
+// which is needed for native PDFs and citations
+func supportsDocumentBlocks(model string) bool {
+	return strings.HasPrefix(model, "claude")
+}
+
+// providerOf names the provider serving model, rate limits can be shared by all of a provider's models
+func providerOf(model string) string {
+	switch {
+	case strings.HasPrefix(model, "claude"):
+		return "anthropic"
+	case strings.HasPrefix(model, fake.Prefix):
+		return "fake"
+	default:
+		return "openai"
+	}
+}
+
+// limitFlags adds the flags for the rate limits of models and providers to fl
+func limitFlags(fl *flag.FlagSet) *ratelimit.Config {
+	config := &ratelimit.Config{Providers: providerLimits{}}
+	fl.IntVar(&config.Default.RequestsPerMinute, "rpm", 0, "maximum requests per minute to each model, unlimited when 0")
+	fl.IntVar(&config.Default.InputTokensPerMinute, "input-tpm", 0, "maximum input tokens per minute to each model, unlimited when 0")
+	fl.IntVar(&config.Default.OutputTokensPerMinute, "output-tpm", 0, "maximum output tokens per minute from each model, unlimited when 0")
+	fl.IntVar(&config.Default.MaxInFlight, "max-in-flight", 0, "maximum requests to each model at once, unlimited when 0")
+	fl.Var(providerLimits(config.Providers), "provider-limit", "limits shared by all of a provider's models, e.g. anthropic:rpm=50,input-tpm=40000,output-tpm=8000,max-in-flight=4 (repeatable)")
+	return config
+}
+
+// providerLimits is a repeatable flag of limits by provider
+type providerLimits map[string]ratelimit.Limits
+
+var _ flag.Value = providerLimits{}
+
+func (p providerLimits) String() string {
+	return fmt.Sprintf("%v", map[string]ratelimit.Limits(p))
+}
+
+// Set parses a provider's limits like anthropic:rpm=50,max-in-flight=4
+func (p providerLimits) Set(value string) error {
+	provider, settings, ok := strings.Cut(value, ":")
+	if !ok || provider == "" {
+		return fmt.Errorf("provider limits must look like <provider>:rpm=50,max-in-flight=4, got %q", value)
+	}
+
+	limits := p[provider]
+	for _, setting := range strings.Split(settings, ",") {
+		key, v, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s limit %q must be a number", provider, key)
+		}
+
+		switch key {
+		case "rpm":
+			limits.RequestsPerMinute = n
+		case "input-tpm":
+			limits.InputTokensPerMinute = n
+		case "output-tpm":
+			limits.OutputTokensPerMinute = n
+		case "max-in-flight":
+			limits.MaxInFlight = n
+		default:
+			return fmt.Errorf("unknown %s limit %q, want one of [rpm, input-tpm, output-tpm, max-in-flight]", provider, key)
+		}
+	}
+	p[provider] = limits
+
+	return nil
+}
+
+// wrapClient adds the middleware a command's requests go through, store is nil to never use the cache
+// Cached responses are replayed without waiting for the rate limits
+// Every request is logged, cache hits included, and the ones sent to the provider are traced
+func wrapClient(client Client, logger *slog.Logger, store *cache.Store, registry *ratelimit.Registry) Client {
+	provider := providerOf(client.Model())
+
+	builder := middleware.NewBuilder().Use(logging.Middleware(logger, provider))
+	if store != nil {
+		builder.Use(cache.Middleware(store))
+	}
+	// Requests wait for the model's limits, and its provider's headers, before they're sent
+	builder.Use(registry.Middleware(provider))
+
+	return builder.Build(instrument(client, logger))
+}
+
+// instruments traces and measures requests with the global OpenTelemetry providers, which CLI sets up
+var instruments = sync.OnceValues(func() (*telemetry.Telemetry, error) {
+	return telemetry.New(nil, nil)
+})
+
+// instrument traces and measures client's requests to its provider, they're recorded nowhere unless telemetry is set up
+func instrument(client Client, logger *slog.Logger) Client {
+	tel, err := instruments()
+	if err != nil {
+		logger.Warn("not instrumenting requests", "err", err)
+		return client
+	}
+	return tel.Middleware(providerOf(client.Model()))(client)
+}
+
+// openCache opens the store of cached responses
+func openCache() (*cache.Store, error) {
+	dir, err := cache.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("finding the cache directory: %w", err)
+	}
+	return cache.NewStore(dir, cache.DefaultTTL, cache.DefaultMaxBytes), nil
+}
@@ -0,0 +1,107 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/markdown"
+)
+
+var extensions = map[string]string{
+	"go":         ".go",
+	"golang":     ".go",
+	"python":     ".py",
+	"py":         ".py",
+	"javascript": ".js",
+	"js":         ".js",
+	"typescript": ".ts",
+	"ts":         ".ts",
+	"tsx":        ".tsx",
+	"jsx":        ".jsx",
+	"rust":       ".rs",
+	"rs":         ".rs",
+	"java":       ".java",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"c++":        ".cpp",
+	"ruby":       ".rb",
+	"shell":      ".sh",
+	"bash":       ".sh",
+	"sh":         ".sh",
+	"zsh":        ".sh",
+	"sql":        ".sql",
+	"json":       ".json",
+	"yaml":       ".yaml",
+	"yml":        ".yaml",
+	"toml":       ".toml",
+	"html":       ".html",
+	"css":        ".css",
+	"markdown":   ".md",
+	"md":         ".md",
+	"dockerfile": ".dockerfile",
+}
+
+// saveCodeBlocks writes every fenced code block in text to its own file in dir
+// Blocks are named by the filename the model gave them, otherwise by their language
+func saveCodeBlocks(dir, text string) ([]string, error) {
+	blocks := markdown.CodeBlocks(text)
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating code directory: %w", err)
+	}
+
+	var paths []string
+	for i, block := range blocks {
+		name := block.Filename
+		// Don't let a filename from the model write outside of dir
+		if name == "" || !filepath.IsLocal(name) {
+			ext, ok := extensions[block.Language]
+			if !ok {
+				ext = ".txt"
+			}
+			name = fmt.Sprintf("snippet-%d%s", i+1, ext)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			return paths, fmt.Errorf("creating code directory: %w", err)
+		}
+
+		path, err := writeNewFile(dir, name, block.Code)
+		if err != nil {
+			return paths, fmt.Errorf("writing code block: %w", err)
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// writeNewFile writes code to name in dir, never replacing a file that's already there
+// Taken names get a -N suffix, e.g. main-2.go
+func writeNewFile(dir, name, code string) (string, error) {
+	ext := filepath.Ext(name)
+	path := filepath.Join(dir, name)
+	for n := 2; ; n++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := f.WriteString(code); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
@@ -0,0 +1,33 @@
+package llm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveCodeBlocks(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(main, []byte("package mine\n"), 0o644))
+
+	text := "Here you go:\n```go main.go\npackage main\n```\n\n```go main.go\npackage other\n```\n\n```python\nprint(1)\n```\n"
+	paths, err := saveCodeBlocks(dir, text)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "main-2.go"),
+		filepath.Join(dir, "main-3.go"),
+		filepath.Join(dir, "snippet-3.py"),
+	}, paths)
+
+	// The user's own file survives
+	data, err := os.ReadFile(main)
+	require.NoError(t, err)
+	require.Equal(t, "package mine\n", string(data))
+
+	data, err = os.ReadFile(paths[1])
+	require.NoError(t, err)
+	require.Equal(t, "package other\n", string(data))
+}
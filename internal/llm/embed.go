@@ -0,0 +1,102 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/credentials"
+	"github.com/davidhbaek/llm/internal/openai"
+)
+
+const defaultEmbeddingModel = "text-embedding-3-small"
+
+// newEmbedder returns an embedder for model, using baseURL for OpenAI compatible servers other than OpenAI's
+// Local servers usually don't need a key, so it's only required for OpenAI's
+func newEmbedder(model, baseURL string) (Embedder, error) {
+	key, err := apiKeys().Key("openai")
+	if err != nil && (baseURL == "" || !errors.Is(err, credentials.ErrNotFound)) {
+		return nil, err
+	}
+
+	opts := []openai.Option{openai.WithAPIKey(key)}
+	if baseURL != "" {
+		opts = append(opts, openai.WithBaseURL(baseURL))
+	}
+	return openai.NewClient(model, opts...), nil
+}
+
+// embedCommand writes an embedding for each input as a line of JSON
+// Inputs are the command's arguments or, without any, the lines of stdin
+// llm embed [-m model] [text...]
+func embedCommand(args []string, stdin io.Reader, stdout io.Writer) int {
+	fl := flag.NewFlagSet("embed", flag.ContinueOnError)
+
+	var model string
+	fl.StringVar(&model, "m", defaultEmbeddingModel, "the embedding model to use")
+	fl.StringVar(&model, "model", defaultEmbeddingModel, "the embedding model to use")
+
+	var baseURL string
+	fl.StringVar(&baseURL, "base-url", "", "base URL of an OpenAI compatible embeddings API, like a local model server")
+
+	var dimensions int
+	fl.IntVar(&dimensions, "dimensions", 0, "length of the embedding vectors, for models that support shortening them")
+
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	inputs := fl.Args()
+	if len(inputs) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				inputs = append(inputs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "reading stdin: %v\n", err)
+			return exitRuntime
+		}
+	}
+	if len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, "parsing args: embed needs text to embed, pass it as arguments or lines on stdin")
+		return exitUsage
+	}
+
+	embedder, err := newEmbedder(model, baseURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitRuntime
+	}
+
+	embeddings, err := embedder.Embed(context.Background(), inputs, dimensions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitCode(err)
+	}
+
+	enc := json.NewEncoder(stdout)
+	for i, vector := range embeddings.Vectors {
+		err := enc.Encode(struct {
+			Index     int       `json:"index"`
+			Input     string    `json:"input"`
+			Embedding []float32 `json:"embedding"`
+		}{Index: i, Input: inputs[i], Embedding: vector})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "writing output: %v\n", err)
+			return exitRuntime
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "model: %s, input tokens: %d\n", embeddings.Model, embeddings.Usage.InputTokens)
+	return exitOK
+}
@@ -0,0 +1,238 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/cache"
+	"github.com/davidhbaek/llm/internal/eval"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+)
+
+// evalCommand runs a suite of test cases against models and reports how they fared compared to the last run
+// llm eval [-m model...] [--judge model] [--results file] [-o text|json] suite.yaml
+func evalCommand(args []string, stdout io.Writer) int {
+	fl := flag.NewFlagSet("eval", flag.ContinueOnError)
+
+	var names fileList
+	fl.Var(&names, "m", "list of models to run the suite against, the suite's models when unset")
+	fl.Var(&names, "model", "list of models to run the suite against, the suite's models when unset")
+
+	var judge string
+	fl.StringVar(&judge, "judge", "", "model grading judge checks, the suite's judge when unset")
+
+	var concurrency int
+	fl.IntVar(&concurrency, "concurrency", 4, "number of cases to run at once")
+
+	var resultsPath string
+	fl.StringVar(&resultsPath, "results", "", "file the results are compared with and saved to (default <suite>.results.json)")
+
+	var output string
+	fl.StringVar(&output, "o", string(formatText), "output format [text, json]")
+	fl.StringVar(&output, "output", string(formatText), "output format [text, json]")
+
+	var noCache bool
+	fl.BoolVar(&noCache, "no-cache", false, "always send the prompts to the models instead of replaying cached responses")
+
+	limits := limitFlags(fl)
+	logs := logFlags(fl, "warn")
+
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	logger, err := logs.setup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	limits.Logger = logger
+
+	if fl.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "parsing args: eval needs the path of a suite")
+		return exitUsage
+	}
+	if format := outputFormat(output); format != formatText && format != formatJSON {
+		fmt.Fprintf(os.Stderr, "parsing args: output format must be one of [text, json], got %q\n", output)
+		return exitUsage
+	}
+
+	suitePath := fl.Arg(0)
+	suite, err := eval.Load(suitePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	if resultsPath == "" {
+		resultsPath = strings.TrimSuffix(suitePath, filepath.Ext(suitePath)) + ".results.json"
+	}
+
+	if len(names) == 0 {
+		names = suite.Models
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "parsing args: the suite has no models, pass them with -m")
+		return exitUsage
+	}
+	if judge == "" {
+		judge = suite.Judge
+	}
+	if judge == "" && suite.NeedsJudge() {
+		fmt.Fprintln(os.Stderr, "parsing args: the suite has judge checks but no judge model, pass one with --judge")
+		return exitUsage
+	}
+
+	var store *cache.Store
+	if !noCache {
+		store, err = openCache()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+			return exitRuntime
+		}
+	}
+	registry := ratelimit.NewRegistry(*limits)
+
+	newClient := func(name string) (Client, error) {
+		model, err := resolveModel(name)
+		if err != nil {
+			return nil, err
+		}
+		client, err := setupClient(model)
+		if err != nil {
+			return nil, err
+		}
+		return wrapClient(client, logger, store, registry), nil
+	}
+
+	var clients []eval.Client
+	for _, name := range names {
+		client, err := newClient(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+			return exitUsage
+		}
+		clients = append(clients, client)
+	}
+
+	runner := &eval.Runner{Cost: Cost, Concurrency: concurrency}
+	if judge != "" {
+		runner.Judge, err = newClient(judge)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing args: judge: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	previous, err := eval.LoadReport(resultsPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger.Warn("not comparing with the previous run", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := runner.Run(ctx, suite, clients)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitRuntime
+	}
+
+	var changes []eval.Change
+	if previous != nil {
+		changes = eval.Compare(previous, report)
+	}
+
+	if outputFormat(output) == formatJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			*eval.Report
+			Passed  int           `json:"passed"`
+			Cost    float64       `json:"cost_usd"`
+			Changes []eval.Change `json:"changes"`
+		}{Report: report, Passed: report.Passed(), Cost: report.Cost(), Changes: changes})
+	} else {
+		err = printEval(stdout, report, previous, changes)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing output: %v\n", err)
+		return exitRuntime
+	}
+
+	if err := report.Save(resultsPath); err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: saving results: %v\n", err)
+		return exitRuntime
+	}
+
+	if report.Passed() < len(report.Results) {
+		return exitFailedChecks
+	}
+	return exitOK
+}
+
+// printEval writes a line per result, the checks that failed under it, and what changed since the previous run
+func printEval(w io.Writer, report *eval.Report, previous *eval.Report, changes []eval.Change) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, result := range report.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t$%f\t%s\n", status, result.Case, result.Model, result.Cost, (time.Duration(result.LatencyMS) * time.Millisecond).String())
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, result := range report.Results {
+		if result.Passed {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s, %s:\n", result.Case, result.Model)
+		if result.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", result.Error)
+			continue
+		}
+		for _, check := range result.Checks {
+			if !check.Passed {
+				fmt.Fprintf(w, "  %s: %s\n", check.Check, check.Reason)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "\n%d/%d passed, cost $%f\n", report.Passed(), len(report.Results), report.Cost())
+
+	if previous == nil {
+		return nil
+	}
+	if len(changes) == 0 {
+		_, err := fmt.Fprintf(w, "no changes since %s\n", previous.Started.Local().Format(time.DateTime))
+		return err
+	}
+
+	fmt.Fprintf(w, "\nchanges since %s:\n", previous.Started.Local().Format(time.DateTime))
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s, %s: %s -> %s\n", change.Case, change.Model, change.Was, change.Now)
+		for _, line := range strings.Split(strings.TrimSuffix(change.Diff, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "  %s\n", line)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/rag"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// indexCommand builds a searchable index of the documents in a directory
+// llm index [--name name] <dir>
+func indexCommand(args []string) int {
+	fl := flag.NewFlagSet("index", flag.ContinueOnError)
+
+	var name string
+	fl.StringVar(&name, "name", "", "name of the index, defaults to the directory's name")
+
+	var chunkTokens int
+	fl.IntVar(&chunkTokens, "chunk-tokens", 500, "maximum tokens per indexed chunk")
+
+	var embedModel string
+	fl.StringVar(&embedModel, "embed-model", "", "embedding model to index with, chunks are ranked with BM25 when unset")
+
+	var baseURL string
+	fl.StringVar(&baseURL, "base-url", "", "base URL of an OpenAI compatible embeddings API")
+
+	var dimensions int
+	fl.IntVar(&dimensions, "dimensions", 0, "length of the embedding vectors, for models that support shortening them")
+
+	logs := logFlags(fl, "warn")
+
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	if _, err := logs.setup(); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	if fl.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "parsing args: index needs the directory of documents to index")
+		return exitUsage
+	}
+	dir := fl.Arg(0)
+
+	if name == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+			return exitRuntime
+		}
+		name = filepath.Base(abs)
+	}
+
+	var embedder rag.Embedder
+	if embedModel != "" {
+		e, err := newEmbedder(embedModel, baseURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+			return exitRuntime
+		}
+		embedder = &indexEmbedder{embedder: e, dimensions: dimensions}
+	}
+
+	idx, err := rag.Build(context.Background(), name, dir, chunkTokens, embedder)
+	if err == nil {
+		idx.EmbeddingDimensions = dimensions
+		idx.EmbeddingBaseURL = baseURL
+		err = idx.Save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitCode(err)
+	}
+
+	fmt.Printf("indexed %d chunks from %s as %q\n", len(idx.Chunks), dir, name)
+	return exitOK
+}
+
+const askInstructions = `Answer the user's question using the excerpts from their documents in <document></document> tags.
+Cite the excerpts your answer is based on by their index, like [1].
+If the excerpts don't contain the answer, say so instead of guessing.`
+
+// runAsk answers the prompt from the chunks of an index most relevant to it
+func (app *env) runAsk(ctx context.Context) error {
+	idx, err := rag.Load(app.index)
+	if errors.Is(err, rag.ErrNotFound) {
+		return fmt.Errorf("%w, create it with: llm index --name %s <dir>", err, app.index)
+	}
+	if err != nil {
+		return err
+	}
+
+	var embedder rag.Embedder
+	if idx.EmbeddingModel != "" {
+		e, err := newEmbedder(idx.EmbeddingModel, idx.EmbeddingBaseURL)
+		if err != nil {
+			return err
+		}
+		embedder = &indexEmbedder{embedder: e, dimensions: idx.EmbeddingDimensions}
+	}
+
+	results, err := idx.Search(ctx, app.userPrompt, app.topK, embedder)
+	if err != nil {
+		return fmt.Errorf("searching index: %w", err)
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("no documents in index %s match the prompt", app.index)
+	}
+
+	var docs strings.Builder
+	for i, result := range results {
+		chunk := result.Chunk
+		fmt.Fprintf(&docs, "<document index=\"%d\" source=%q pages=\"%d-%d\">%s</document>\n", i+1, chunk.Source, chunk.FirstPage, chunk.LastPage, chunk.Text)
+	}
+
+	system := wire.SystemPrompt(strings.TrimSpace(app.systemPrompt + "\n" + askInstructions))
+	system = append(system, wire.Text{Type: "text", Text: wrapInXMLTags(docs.String(), "documents")})
+
+	if _, err := app.send(ctx, []wire.Message{userMessage(app.userPrompt)}, system); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "\nsources:")
+	for i, result := range results {
+		chunk := result.Chunk
+		fmt.Fprintf(os.Stderr, "[%d] %s pages %d-%d\n", i+1, chunk.Source, chunk.FirstPage, chunk.LastPage)
+	}
+
+	return nil
+}
+
+// indexEmbedder adapts an Embedder to the interface the index uses
+type indexEmbedder struct {
+	embedder   Embedder
+	dimensions int
+}
+
+func (e *indexEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	embeddings, err := e.embedder.Embed(ctx, texts, e.dimensions)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings.Vectors, nil
+}
+
+func (e *indexEmbedder) Model() string {
+	return e.embedder.Model()
+}
@@ -0,0 +1,42 @@
+package llm
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/davidhbaek/llm/internal/fake"
+)
+
+func TestAskArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		stdin string
+		err   string
+	}{
+		{name: "index", args: []string{"--index", "notes", "-p", "hi"}},
+		{name: "no index", args: []string{"-p", "hi"}, err: "ask needs an index"},
+		{name: "documents", args: []string{"--index", "notes", "-p", "hi", "-d", "report.pdf"}, err: "ask only answers from its index"},
+		{name: "images", args: []string{"--index", "notes", "-p", "hi", "-i", "cat.png"}, err: "ask only answers from its index"},
+		{name: "piped document", args: []string{"--index", "notes", "-p", "hi"}, stdin: "some notes", err: "ask only answers from its index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := env{command: commandAsk, out: &printer{format: formatText, w: io.Discard}}
+			if tt.stdin != "" {
+				app.stdin = strings.NewReader(tt.stdin)
+			}
+
+			err := app.fromArgs(append([]string{"-m", fake.Echo, "--no-cache"}, tt.args...))
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
@@ -5,21 +5,44 @@ import (
 	"io"
 
 	"github.com/davidhbaek/llm/internal/anthropic"
+	"github.com/davidhbaek/llm/internal/cache"
+	"github.com/davidhbaek/llm/internal/fake"
 	"github.com/davidhbaek/llm/internal/openai"
+	"github.com/davidhbaek/llm/internal/ratelimit"
 	"github.com/davidhbaek/llm/internal/wire"
 )
 
 type Client interface {
 	// Define how to send a prompt to the LLMs API
-	SendMessage(ctx context.Context, messages []wire.Message, systemPrompt string) (*wire.Response, error)
-	// Define how to read the response body from the LLM
-	ReadBody(body io.Reader) (string, error)
+	// The system prompt is a list of text blocks so parts of it can be marked for caching
+	// opts set generation parameters like the maximum tokens and temperature
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	// Define how to read the streamed response body from the LLM
+	// handler is called for every event in the stream as it arrives and may be nil
+	// The completion read so far is returned alongside any error
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	// Define how to count the input tokens a request would use before sending it
+	CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error)
 	// Return the underlying LLM being prompted
 	Model() string
 }
 
+// Embedder is implemented by clients of embedding models
+type Embedder interface {
+	// Define how to turn text into vectors, batching the inputs as the API needs
+	// dimensions shortens the vectors for models that support it, zero keeps the model's default
+	Embed(ctx context.Context, inputs []string, dimensions int) (*wire.Embeddings, error)
+	// Return the underlying embedding model
+	Model() string
+}
+
 // Enforce interface compliance
 var (
 	_ Client = &openai.Client{}
 	_ Client = &anthropic.Client{}
+	_ Client = &fake.Client{}
+	_ Client = &cache.CachedClient{}
+	_ Client = &ratelimit.LimitedClient{}
+
+	_ Embedder = &openai.Client{}
 )
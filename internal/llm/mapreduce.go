@@ -0,0 +1,156 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/davidhbaek/llm/internal/document"
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/davidhbaek/llm/prompts"
+	"golang.org/x/sync/errgroup"
+)
+
+// partial is the answer to the prompt for part of the documents
+type partial struct {
+	// Describes which part of the documents the answer covers
+	label string
+	text  string
+}
+
+// runMapReduce answers the prompt over documents too long to send at once
+// The prompt is sent with each chunk of the documents concurrently (map), then the
+// answers are combined into one (reduce), in several rounds if they're long themselves
+func (app *env) runMapReduce(ctx context.Context) error {
+	docs, err := app.loadDocuments(app.docs)
+	if err != nil {
+		return err
+	}
+
+	prompt, system := app.userPrompt, app.systemPrompt
+	if prompt == "" {
+		prompt = prompts.SummaryUser
+		if system == "" {
+			system = prompts.SummarySystem
+		}
+	}
+
+	var chunks []document.Chunk
+	for _, doc := range docs {
+		chunks = append(chunks, document.Split(doc, app.chunkTokens)...)
+	}
+	slog.Debug("split documents into chunks", "documents", len(docs), "chunks", len(chunks), "max_tokens", app.chunkTokens)
+
+	partials := make([]partial, len(chunks))
+	var done atomic.Int32
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	eg.SetLimit(max(1, app.concurrency))
+	for idx, chunk := range chunks {
+		idx, chunk := idx, chunk
+		eg.Go(func() error {
+			label := fmt.Sprintf("%s pages %d-%d", chunk.Source, chunk.FirstPage, chunk.LastPage)
+			chunkSystem := append(wire.SystemPrompt(system), wire.Text{
+				Type: "text",
+				Text: fmt.Sprintf("<document source=%q pages=\"%d-%d\">%s</document>", chunk.Source, chunk.FirstPage, chunk.LastPage, chunk.Text),
+			})
+
+			completion, err := app.complete(egCtx, []wire.Message{userMessage(prompt)}, chunkSystem, nil)
+			if err != nil {
+				return fmt.Errorf("prompting chunk %d (%s): %w", idx+1, label, err)
+			}
+
+			partials[idx] = partial{label: label, text: completion.Text}
+			fmt.Fprintf(os.Stderr, "[%d/%d] finished chunk %d (%s)\n", done.Add(1), len(chunks), idx+1, label)
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// Combine the answers in groups until they fit in a single request
+	for round := 1; len(partials) > 1 && tokenizer.Estimate(reducePrompt(prompt, partials)) > app.chunkTokens; round++ {
+		groups := groupPartials(prompt, partials, app.chunkTokens)
+		slog.Debug("combining answers", "round", round, "answers", len(partials), "groups", len(groups))
+
+		reduced := make([]partial, len(groups))
+		eg, egCtx := errgroup.WithContext(ctx)
+		eg.SetLimit(max(1, app.concurrency))
+		for idx, group := range groups {
+			idx, group := idx, group
+			eg.Go(func() error {
+				completion, err := app.complete(egCtx, []wire.Message{userMessage(reducePrompt(prompt, group))}, wire.SystemPrompt(system), nil)
+				if err != nil {
+					return fmt.Errorf("combining answers: %w", err)
+				}
+
+				reduced[idx] = partial{label: fmt.Sprintf("%s to %s", group[0].label, group[len(group)-1].label), text: completion.Text}
+				return nil
+			})
+		}
+
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+		partials = reduced
+	}
+
+	fmt.Fprintf(os.Stderr, "combining %d answers\n", len(partials))
+	text, err := app.send(ctx, []wire.Message{userMessage(reducePrompt(prompt, partials))}, wire.SystemPrompt(system))
+	if err != nil {
+		return err
+	}
+
+	if app.codeDir != "" {
+		return app.saveCode(app.codeDir, text)
+	}
+
+	return nil
+}
+
+const reduceInstructions = `The documents were too long to read at once so they were split into sections and the request below was answered for each section separately.
+Combine the answers in <section></section> tags into a single answer to the request, as if you had read the documents in full.`
+
+func reducePrompt(prompt string, partials []partial) string {
+	var sb strings.Builder
+	sb.WriteString(reduceInstructions)
+	sb.WriteString("\n\n")
+	sb.WriteString(wrapInXMLTags(prompt, "request"))
+	sb.WriteString("\n\n")
+	for _, p := range partials {
+		fmt.Fprintf(&sb, "<section source=%q>%s</section>\n", p.label, p.text)
+	}
+	return sb.String()
+}
+
+// groupPartials splits partials into consecutive groups whose reduce prompt fits in maxTokens
+// Every group has at least two answers so each round makes progress
+func groupPartials(prompt string, partials []partial, maxTokens int) [][]partial {
+	var groups [][]partial
+	var group []partial
+	for _, p := range partials {
+		if len(group) >= 2 && tokenizer.Estimate(reducePrompt(prompt, append(group, p))) > maxTokens {
+			groups = append(groups, group)
+			group = nil
+		}
+		group = append(group, p)
+	}
+
+	if len(group) == 1 && len(groups) > 0 {
+		groups[len(groups)-1] = append(groups[len(groups)-1], group[0])
+	} else if len(group) > 0 {
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+func userMessage(text string) wire.Message {
+	return wire.Message{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}
+}
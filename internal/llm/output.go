@@ -0,0 +1,187 @@
+package llm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/markdown"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+type outputFormat string
+
+const (
+	formatText     outputFormat = "text"
+	formatJSON     outputFormat = "json"
+	formatJSONL    outputFormat = "jsonl"
+	formatMarkdown outputFormat = "markdown"
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch format := outputFormat(s); format {
+	case formatText, formatJSON, formatJSONL, formatMarkdown:
+		return format, nil
+	default:
+		return "", fmt.Errorf("output format must be one of [text, json, jsonl, markdown], got %q", s)
+	}
+}
+
+// result is the summary of a response written by the json and markdown formats
+type result struct {
+	Model      string     `json:"model"`
+	StopReason string     `json:"stop_reason"`
+	Usage      wire.Usage `json:"usage"`
+	Cost       float64    `json:"cost_usd"`
+	LatencyMS  int64      `json:"latency_ms"`
+	// Only set for responses streamed from the provider, not cached ones
+	Timing    *timing    `json:"timing,omitempty"`
+	Text      string     `json:"text"`
+	Citations []footnote `json:"citations,omitempty"`
+}
+
+// timing is how fast the provider streamed a response
+type timing struct {
+	TimeToFirstByteMS     int64   `json:"time_to_first_byte_ms"`
+	TimeToFirstTokenMS    int64   `json:"time_to_first_token_ms"`
+	OutputTokensPerSecond float64 `json:"output_tokens_per_second"`
+}
+
+// footnote is a citation numbered in the order it first appeared in the response
+type footnote struct {
+	Number int `json:"number"`
+	wire.Citation
+}
+
+// printer writes a model's response to w in the chosen output format
+// text and jsonl are written as the stream arrives, json and markdown once it's complete
+type printer struct {
+	format outputFormat
+	w      io.Writer
+	// Format Markdown in text output for display in a terminal
+	render   bool
+	renderer *markdown.Renderer
+
+	// Citations in the response so far, each span cited more than once keeps its first number
+	footnotes []footnote
+	numbers   map[wire.Citation]int
+	// The response text with citation markers, for the markdown format
+	annotated strings.Builder
+}
+
+// cite numbers a citation and returns its marker
+func (p *printer) cite(citation wire.Citation) string {
+	if p.numbers == nil {
+		p.numbers = map[wire.Citation]int{}
+	}
+
+	n, ok := p.numbers[citation]
+	if !ok {
+		n = len(p.footnotes) + 1
+		p.numbers[citation] = n
+		p.footnotes = append(p.footnotes, footnote{Number: n, Citation: citation})
+	}
+
+	if p.format == formatMarkdown {
+		return fmt.Sprintf("[^%d]", n)
+	}
+	return fmt.Sprintf("[%d]", n)
+}
+
+func (p *printer) onEvent(event wire.Event) error {
+	text := event.Text
+	if event.Type == wire.EventCitation && event.Citation != nil {
+		text = p.cite(*event.Citation)
+	}
+	p.annotated.WriteString(text)
+
+	switch p.format {
+	case formatText:
+		if text == "" {
+			return nil
+		}
+
+		if p.render {
+			if p.renderer == nil {
+				p.renderer = markdown.NewRenderer(p.w)
+			}
+			_, err := p.renderer.Write([]byte(text))
+			return err
+		}
+
+		_, err := fmt.Fprint(p.w, text)
+		return err
+	case formatJSONL:
+		return json.NewEncoder(p.w).Encode(event)
+	}
+
+	return nil
+}
+
+func (p *printer) finish(completion *wire.Completion, latency time.Duration) error {
+	res := result{
+		Model:      completion.Model,
+		StopReason: completion.StopReason,
+		Usage:      completion.Usage,
+		Cost:       Cost(completion.Model, completion.Usage),
+		LatencyMS:  latency.Milliseconds(),
+		Text:       completion.Text,
+		Citations:  p.footnotes,
+	}
+	if t := completion.Timing; t != nil {
+		res.Timing = &timing{
+			TimeToFirstByteMS:     t.TimeToFirstByte.Milliseconds(),
+			TimeToFirstTokenMS:    t.TimeToFirstToken.Milliseconds(),
+			OutputTokensPerSecond: t.OutputTokensPerSecond,
+		}
+	}
+	annotated := p.annotated.String()
+	if annotated == "" {
+		annotated = completion.Text
+	}
+
+	// Each response is numbered from 1, e.g. every turn of a chat
+	p.footnotes, p.numbers = nil, nil
+	p.annotated.Reset()
+
+	var err error
+	switch p.format {
+	case formatText:
+		if p.renderer != nil {
+			err = p.renderer.Flush()
+			p.renderer = nil
+		} else {
+			_, err = fmt.Fprintln(p.w)
+		}
+		if err == nil && len(res.Citations) > 0 {
+			_, err = fmt.Fprintf(p.w, "\n%s", formatFootnotes(res.Citations, "[%d]"))
+		}
+	case formatJSON:
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	case formatMarkdown:
+		if len(res.Citations) > 0 {
+			annotated += "\n\n" + formatFootnotes(res.Citations, "[^%d]:")
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n\n---\n\n| model | stop reason | input tokens | output tokens | cost | latency |\n|---|---|---|---|---|---|\n| %s | %s | %d | %d | $%f | %s |\n",
+			strings.TrimSuffix(annotated, "\n"), res.Model, res.StopReason, res.Usage.InputTokens, res.Usage.OutputTokens, res.Cost, latency.Round(time.Millisecond))
+	}
+
+	return err
+}
+
+// formatFootnotes lists each citation's document, location and quoted text under its marker
+func formatFootnotes(footnotes []footnote, marker string) string {
+	var sb strings.Builder
+	for _, fn := range footnotes {
+		title := fn.DocumentTitle
+		if title == "" {
+			title = fmt.Sprintf("document %d", fn.DocumentIndex+1)
+		}
+		fmt.Fprintf(&sb, marker+" %s, %s: %q\n", fn.Number, title, fn.Location(), strings.TrimSpace(fn.CitedText))
+	}
+	return sb.String()
+}
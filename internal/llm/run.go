@@ -1,21 +1,28 @@
 package llm
 
 import (
-	"bufio"
 	"context"
 	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/davidhbaek/llm/internal/anthropic"
+	"github.com/davidhbaek/llm/internal/cache"
+	"github.com/davidhbaek/llm/internal/document"
+	"github.com/davidhbaek/llm/internal/history"
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+	"github.com/davidhbaek/llm/internal/telemetry"
+	"github.com/davidhbaek/llm/internal/tokenizer"
 	"github.com/davidhbaek/llm/internal/wire"
 	"golang.org/x/sync/errgroup"
-	"rsc.io/pdf"
 )
 
 type env struct {
@@ -25,6 +32,28 @@ type env struct {
 	images       fileList
 	isChat       bool
 	docs         fileList
+	// Token budget and strategy for the conversation history in chat sessions
+	contextBudget   int
+	contextStrategy history.Strategy
+	// How PDFs are sent to the model
+	pdfMode string
+	// Ask the model to cite the documents it answers from
+	citations bool
+	// Answer the prompt over each chunk of the documents and combine the results
+	mapReduce   bool
+	chunkTokens int
+	concurrency int
+	// Directory to write the code blocks from a response to
+	codeDir string
+	// Subcommand to run instead of sending the prompt
+	command string
+	// Index to retrieve document chunks from, and how many, for the ask command
+	index string
+	topK  int
+	// Text piped in on stdin, sent as an extra document
+	stdinDoc string
+	stdin    io.Reader
+	out      *printer
 }
 
 type fileList []string
@@ -40,22 +69,114 @@ func (f *fileList) Set(value string) error {
 	return nil
 }
 
+// Exit codes returned by the CLI
+const (
+	exitOK      = 0
+	exitRuntime = 1
+	exitUsage   = 2
+	exitAPI     = 3
+	// The model started responding but the stream failed before it finished
+	exitPartial = 4
+	// Some cases of an eval suite failed their checks
+	exitFailedChecks = 5
+)
+
+var errPartialOutput = errors.New("response ended before it was complete")
+
+// Subcommands, given as the first argument
+const (
+	commandTokens = "tokens"
+	commandIndex  = "index"
+	commandAsk    = "ask"
+	commandEmbed  = "embed"
+	commandServe  = "serve"
+	commandCache  = "cache"
+	commandBench  = "bench"
+	commandEval   = "eval"
+	commandAuth   = "auth"
+)
+
 func CLI(args []string) int {
-	app := env{}
+	// Requests are traced and measured when OTEL_* variables point at a collector
+	shutdown, err := telemetry.Setup(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: setting up telemetry: %v\n", err)
+		return exitRuntime
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "exporting telemetry: %v\n", err)
+		}
+	}()
+
+	return dispatch(args)
+}
+
+// dispatch runs the command named by args
+func dispatch(args []string) int {
+	// Commands with their own flags
+	if len(args) > 0 {
+		switch args[0] {
+		case commandIndex:
+			return indexCommand(args[1:])
+		case commandEmbed:
+			return embedCommand(args[1:], os.Stdin, os.Stdout)
+		case commandServe:
+			return serveCommand(args[1:])
+		case commandCache:
+			return cacheCommand(args[1:], os.Stdout)
+		case commandBench:
+			return benchCommand(args[1:], os.Stdout)
+		case commandEval:
+			return evalCommand(args[1:], os.Stdout)
+		case commandAuth:
+			return authCommand(args[1:], os.Stdin, os.Stdout)
+		}
+	}
+
+	app := env{stdin: os.Stdin, out: &printer{format: formatText, w: os.Stdout}}
+	if len(args) > 0 && (args[0] == commandTokens || args[0] == commandAsk) {
+		app.command, args = args[0], args[1:]
+	}
+
 	err := app.fromArgs(args)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
-		return 2
+		return exitUsage
 	}
 
 	if err := app.run(); err != nil {
 		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
-		return 1
+		return exitCode(err)
+
+	}
+	return exitOK
+}
 
+func exitCode(err error) int {
+	var apiErr *wire.APIError
+	switch {
+	case errors.Is(err, errPartialOutput):
+		return exitPartial
+	case errors.As(err, &apiErr):
+		return exitAPI
+	default:
+		return exitRuntime
 	}
-	return 0
 }
 
+// Ways of sending PDFs to the model
+const (
+	pdfModeText   = "text"
+	pdfModeNative = "native"
+)
+
+// Providers only cache prompt prefixes of at least 1024-2048 tokens
+// At roughly 4 characters per token anything shorter isn't worth marking
+const minCacheableChars = 4 * 2048
+
 const (
 	OPUS   = "claude-3-opus-20240229"
 	SONNET = "claude-3-sonnet-20240229"
@@ -63,6 +184,28 @@ const (
 	GPT4   = "gpt-4-turbo"
 )
 
+// Short names for models accepted by -m
+var modelAliases = map[string]string{
+	"haiku":  HAIKU,
+	"sonnet": SONNET,
+	"opus":   OPUS,
+	"gpt4":   GPT4,
+}
+
+// resolveModel returns the full name of a model given by its alias or full name
+func resolveModel(name string) (string, error) {
+	if model, ok := modelAliases[name]; ok {
+		return model, nil
+	}
+
+	// The fake provider is named in full, e.g. fake:echo
+	if _, ok := NewClientConfig().factory(name); ok {
+		return name, nil
+	}
+
+	return "", errors.New("input model must be one of [haiku, sonnet, opus, gpt4] or fake:<behavior>")
+}
+
 func (app *env) fromArgs(args []string) error {
 	fl := flag.NewFlagSet("claude", flag.ContinueOnError)
 
@@ -90,27 +233,88 @@ func (app *env) fromArgs(args []string) error {
 	fl.BoolVar(&isChat, "c", false, "Start a live chat that retains conversation history")
 	fl.BoolVar(&isChat, "chat", false, "Start a live chat that retains conversation history")
 
+	var output string
+	fl.StringVar(&output, "o", string(formatText), "output format [text, json, jsonl, markdown]")
+	fl.StringVar(&output, "output", string(formatText), "output format [text, json, jsonl, markdown]")
+
+	var contextBudget int
+	fl.IntVar(&contextBudget, "context-budget", 100000, "maximum tokens of conversation history to send in a chat session")
+
+	var contextStrategy string
+	fl.StringVar(&contextStrategy, "context-strategy", string(history.DropOldest), "how to shorten a chat over its context budget [drop-oldest, pin-prefix, summarize]")
+
+	var pdfMode string
+	fl.StringVar(&pdfMode, "pdf-mode", pdfModeText, "how to send PDFs [text, native], native sends the file itself to models that support it")
+
+	var citations bool
+	fl.BoolVar(&citations, "citations", false, "cite the parts of the documents the answer comes from, only supported by Claude models")
+
+	var mapReduce bool
+	fl.BoolVar(&mapReduce, "map-reduce", false, "answer the prompt over chunks of long documents and combine the results")
+
+	var chunkTokens int
+	fl.IntVar(&chunkTokens, "chunk-tokens", 8000, "maximum tokens per document chunk with --map-reduce")
+
+	var concurrency int
+	fl.IntVar(&concurrency, "concurrency", 4, "number of chunks to prompt at once with --map-reduce")
+
+	var index string
+	fl.StringVar(&index, "index", "", "name of the document index to answer from with the ask command")
+
+	var topK int
+	fl.IntVar(&topK, "k", 5, "number of document chunks to retrieve with the ask command")
+
+	var codeDir string
+	fl.StringVar(&codeDir, "extract-code", "", "write each fenced code block in the response to a file in this directory")
+
+	var raw bool
+	fl.BoolVar(&raw, "raw", false, "print the response as plain text instead of rendering its Markdown")
+
+	limits := limitFlags(fl)
+
+	var noCache bool
+	fl.BoolVar(&noCache, "no-cache", false, "always send the prompt to the model instead of replaying a cached response")
+
+	logs := logFlags(fl, "warn")
+
 	if err := fl.Parse(args); err != nil {
 		return fmt.Errorf("parsing command line arguments: %w", err)
 	}
 
-	models := map[string]string{
-		"haiku":  HAIKU,
-		"sonnet": SONNET,
-		"opus":   OPUS,
-		"gpt4":   GPT4,
+	logger, err := logs.setup()
+	if err != nil {
+		return err
 	}
+	limits.Logger = logger
 
-	model, ok := models[inputModel]
-	if !ok {
-		return errors.New("input model must be one of [haiku, sonnet, opus, gpt4]")
+	model, err := resolveModel(inputModel)
+	if err != nil {
+		return err
+	}
+
+	format, err := parseOutputFormat(output)
+	if err != nil {
+		return err
 	}
+	app.out.format = format
+	app.out.render = !raw && isTerminal(app.out.w)
 
-	app.client = setupClient(model)
+	client, err := setupClient(model)
+	if err != nil {
+		return err
+	}
+	var store *cache.Store
+	if !noCache {
+		store, err = openCache()
+		if err != nil {
+			return err
+		}
+	}
+	app.client = wrapClient(client, logger, store, ratelimit.NewRegistry(*limits))
 
 	// Get the prompt text if they're coming from a file
 	if filepath.Ext(prompt) == ".txt" {
-		log.Printf("reading prompt file at path=%s", prompt)
+		slog.Debug("reading prompt file", "path", prompt)
 		bytes, err := os.ReadFile(prompt)
 		if err != nil {
 			return err
@@ -120,7 +324,7 @@ func (app *env) fromArgs(args []string) error {
 	}
 
 	if filepath.Ext(system) == ".txt" {
-		log.Printf("reading system file at path=%s", system)
+		slog.Debug("reading system file", "path", system)
 		bytes, err := os.ReadFile(system)
 		if err != nil {
 			return err
@@ -129,57 +333,150 @@ func (app *env) fromArgs(args []string) error {
 		system = string(bytes)
 	}
 
+	// Piped input becomes the prompt if none was given, otherwise it's sent as a document
+	// With --map-reduce it's always the document
+	// Chat sessions read their prompts from stdin so they're left alone
+	if !isChat && isPiped(app.stdin) {
+		slog.Debug("reading piped input from stdin")
+		bytes, err := io.ReadAll(app.stdin)
+		if err != nil {
+			return fmt.Errorf("reading stdin: %w", err)
+		}
+
+		if prompt == "" && !mapReduce {
+			prompt = string(bytes)
+		} else {
+			app.stdinDoc = string(bytes)
+		}
+	}
+
+	// Long documents are summarized when no prompt is given
+	if prompt == "" && !isChat && !mapReduce {
+		return errors.New("a prompt is required, pass one with -p or pipe it in on stdin")
+	}
+
 	app.userPrompt = prompt
 	app.systemPrompt = system
 	app.images = images
 	app.docs = docs
 	app.isChat = isChat
+	app.contextBudget = contextBudget
+	app.contextStrategy, err = history.ParseStrategy(contextStrategy)
+	if err != nil {
+		return err
+	}
+	app.codeDir = codeDir
+	app.index = index
+	app.topK = topK
+	if app.command == commandAsk && index == "" {
+		return errors.New("ask needs an index, pass one with --index")
+	}
+	// Answers only come from the index, anything else would be silently left out
+	if app.command == commandAsk && (len(docs) > 0 || len(images) > 0 || app.stdinDoc != "") {
+		return fmt.Errorf("ask only answers from its index, add documents to it with: llm index --name %s <dir>", index)
+	}
+	app.mapReduce = mapReduce
+	app.pdfMode = pdfMode
+	app.citations = citations
+	if pdfMode != pdfModeText && pdfMode != pdfModeNative {
+		return fmt.Errorf("pdf mode must be one of [text, native], got %q", pdfMode)
+	}
+	app.chunkTokens = chunkTokens
+	app.concurrency = concurrency
+	if mapReduce && len(app.docs) == 0 && app.stdinDoc == "" {
+		return errors.New("--map-reduce needs documents, pass them with -d or pipe them in on stdin")
+	}
 
 	return nil
 }
 
 func (app *env) run() error {
-	docs := make([]wire.Text, len(app.docs))
+	ctx := context.Background()
+	if app.mapReduce {
+		return app.runMapReduce(ctx)
+	}
 
-	eg, ctx := errgroup.WithContext(context.Background())
-	for idx, path := range app.docs {
-		idx, path := idx, path
-		eg.Go(func() error {
-			log.Println("ingesting this doc:", path)
-			var text string
-			file, err := pdf.Open(path)
-			if err != nil {
-				return fmt.Errorf("failed to open file at path=%s: %w", path, err)
-			}
+	if app.command == commandAsk {
+		return app.runAsk(ctx)
+	}
 
-			for i := 1; i <= file.NumPage(); i++ {
-				textSlice := file.Page(i).Content().Text
-				for _, t := range textSlice {
-					text += t.S + "\n"
-				}
-			}
+	attachments, system, err := app.buildPrompt()
+	if err != nil {
+		return err
+	}
 
-			docs[idx] = wire.Text{
-				Type: "text",
-				Text: text,
-			}
+	if app.isChat {
+		err := app.runChatSession(ctx, system, attachments)
+		if err != nil {
+			return fmt.Errorf("running chat session: %w", err)
+		}
+		return nil
+	}
 
-			return nil
-		})
+	content := append([]wire.Content{&wire.Text{Type: "text", Text: app.userPrompt}}, attachments...)
+	messages := []wire.Message{{Role: "user", Content: content}}
+
+	if app.command == commandTokens {
+		return app.countTokens(ctx, messages, system)
 	}
 
-	err := eg.Wait()
+	text, err := app.send(ctx, messages, system)
 	if err != nil {
-		return fmt.Errorf("extracting text from document: %w", err)
+		return err
 	}
 
+	if app.codeDir != "" {
+		return app.saveCode(app.codeDir, text)
+	}
+
+	return nil
+}
+
+// buildPrompt reads the documents and images given on the command line into
+// attachments for the user's message and the system prompt
+func (app *env) buildPrompt() ([]wire.Content, []wire.Text, error) {
+	var content []wire.Content
+
+	// Only Anthropic can read documents sent as their own blocks, everything else gets their text
+	documentBlocks := supportsDocumentBlocks(app.client.Model())
+	if app.citations && !documentBlocks {
+		slog.Warn("model doesn't support citations, sending documents without them", "model", app.client.Model())
+	}
+
+	textDocs := app.docs
+	if app.pdfMode == pdfModeNative {
+		if documentBlocks {
+			native, rest, err := app.loadNativeDocuments()
+			if err != nil {
+				return nil, nil, err
+			}
+			content = append(content, native...)
+			textDocs = rest
+		} else {
+			slog.Warn("model can't read PDFs natively, sending their text instead", "model", app.client.Model())
+		}
+	}
+
+	docs, err := app.loadDocuments(textDocs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Citations need every document in a block of its own, otherwise they're added to the system prompt
 	var docsPrompt string
 	for _, doc := range docs {
-		d := fmt.Sprintf("%s\n", wrapInXMLTags(doc.Text, "document"))
+		if app.citations && documentBlocks {
+			content = append(content, app.documentBlock(doc.Source, "text", "text/plain", doc.Text()))
+			continue
+		}
+		d := fmt.Sprintf("%s\n", wrapInXMLTags(doc.Text(), "document"))
 		docsPrompt += d
 	}
 
-	content := []wire.Content{&wire.Text{Type: "text", Text: app.userPrompt}}
+	// Cache everything up to the last document so follow up requests can reuse it
+	if len(content) > 0 {
+		content[len(content)-1].(*wire.Document).CacheControl = wire.Ephemeral()
+	}
 
 	for _, path := range app.images {
 		// TODO: Re-factor to make this model agnostic
@@ -195,86 +492,287 @@ func (app *env) run() error {
 		} else {
 			imgBytes, err := anthropic.DownloadImage(path)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 
-			content = append(content, &wire.AnthropicImage{
-				Type: "image",
-				Source: struct {
-					Type      string `json:"type"`
-					MediaType string `json:"media_type"`
-					Data      string `json:"data"`
-				}{
-					Type:      "base64",
-					MediaType: http.DetectContentType(imgBytes),
-					Data:      base64.StdEncoding.EncodeToString(imgBytes),
-				},
-			})
+			image := &wire.AnthropicImage{Type: "image"}
+			image.Source.Type = "base64"
+			image.Source.MediaType = http.DetectContentType(imgBytes)
+			image.Source.Data = base64.StdEncoding.EncodeToString(imgBytes)
+			content = append(content, image)
 
 		}
 	}
 
-	if app.isChat {
-		err := app.runChatSession(ctx)
+	system := wire.SystemPrompt(app.systemPrompt)
+	if docsPrompt != "" {
+		docsBlock := wire.Text{Type: "text", Text: wrapInXMLTags(docsPrompt, "documents")}
+		// Documents are resent with every request so cache them once they're worth it
+		if len(docsPrompt) >= minCacheableChars {
+			docsBlock.CacheControl = wire.Ephemeral()
+		}
+		system = append(system, docsBlock)
+	}
+
+	return content, system, nil
+}
+
+// Anthropic's limits on PDFs sent as document blocks
+const maxNativePDFSize = 32 * 1024 * 1024
+
+// loadNativeDocuments reads the PDFs to send as document blocks
+// PDFs with a page selection or over the size limit are returned to have their text extracted instead
+func (app *env) loadNativeDocuments() ([]wire.Content, []string, error) {
+	var blocks []wire.Content
+	var rest []string
+	for _, source := range app.docs {
+		path, pages, err := document.ParseSource(source)
 		if err != nil {
-			return fmt.Errorf("running chat session: %w", err)
+			return nil, nil, err
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading document: %w", err)
+		}
+
+		if len(pages) > 0 || info.Size() > maxNativePDFSize {
+			slog.Info("sending the text of the document, only whole PDFs under the size limit can be sent natively", "doc", source, "limit_bytes", maxNativePDFSize)
+			rest = append(rest, source)
+			continue
 		}
+
+		slog.Debug("attaching document", "path", path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading document: %w", err)
+		}
+
+		blocks = append(blocks, app.documentBlock(filepath.Base(path), "base64", "application/pdf", base64.StdEncoding.EncodeToString(data)))
 	}
 
-	systemPrompt := fmt.Sprintf(wrapInXMLTags(docsPrompt, "documents"), app.systemPrompt)
-	messages := []wire.Message{{Role: "user", Content: content}}
+	return blocks, rest, nil
+}
 
-	rsp, err := app.client.SendMessage(ctx, messages, systemPrompt)
-	if err != nil {
-		return fmt.Errorf("sending prompt: %w", err)
+func (app *env) documentBlock(title, sourceType, mediaType, data string) *wire.Document {
+	doc := &wire.Document{
+		Type: "document",
+		Source: wire.DocumentSource{
+			Type:      sourceType,
+			MediaType: mediaType,
+			Data:      data,
+		},
+		Title: title,
+	}
+	if app.citations {
+		doc.Citations = &wire.CitationsConfig{Enabled: true}
+	}
+	return doc
+}
+
+// loadDocuments extracts the text from the documents at paths and stdin
+func (app *env) loadDocuments(paths []string) ([]*document.Document, error) {
+	docs := make([]*document.Document, len(paths))
+
+	var eg errgroup.Group
+	for idx, path := range paths {
+		idx, path := idx, path
+		eg.Go(func() error {
+			slog.Debug("ingesting document", "path", path)
+			doc, err := document.Open(path)
+			if err != nil {
+				return err
+			}
+
+			docs[idx] = doc
+			return nil
+		})
 	}
 
-	_, err = app.client.ReadBody(rsp.Body)
+	err := eg.Wait()
 	if err != nil {
-		return fmt.Errorf("reading response body: %w", err)
+		return nil, fmt.Errorf("extracting text from document: %w", err)
 	}
 
-	return nil
+	if app.stdinDoc != "" {
+		docs = append(docs, document.FromText("stdin", app.stdinDoc))
+	}
+
+	return docs, nil
 }
 
-func (app *env) runChatSession(ctx context.Context) error {
-	log.Printf("Beginning chat session with model=%s", app.client.Model())
-	chatHistory := []wire.Message{}
-	input := bufio.NewReader(os.Stdin)
+// countTokens reports the input tokens and cost of a prompt without sending it
+func (app *env) countTokens(ctx context.Context, messages []wire.Message, system []wire.Text) error {
+	tokens, err := app.client.CountTokens(ctx, messages, system)
+	if err != nil {
+		return fmt.Errorf("counting tokens: %w", err)
+	}
 
-	for {
-		prompt, err := input.ReadString('\n')
+	model := app.client.Model()
+	cost := Cost(model, wire.Usage{InputTokens: tokens})
+	if !tokensEstimated(model) {
+		fmt.Fprintf(app.out.w, "model: %s\ninput tokens: %d\nestimated input cost: $%f\n", model, tokens, cost)
+		return nil
+	}
+
+	fmt.Fprintf(app.out.w, "model: %s\ninput tokens: ~%d (estimated)\nestimated input cost: $%f\n", model, tokens, cost)
+	if providerOf(model) == "openai" {
+		encoding := tokenizer.ForModel(model)
+		dir, err := tokenizer.Dir()
 		if err != nil {
-			return err
+			dir = "$TIKTOKEN_CACHE_DIR"
 		}
+		fmt.Fprintf(os.Stderr, "the %s vocabulary isn't installed so tokens were estimated from the length of the prompt, for an exact count download it with:\n  mkdir -p %s && curl -o %s %s\n",
+			encoding, dir, filepath.Join(dir, encoding+".tiktoken"), tokenizer.URL(encoding))
+	}
 
-		chatHistory = append(chatHistory, wire.Message{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: prompt}}})
+	return nil
+}
 
-		rsp, err := app.client.SendMessage(ctx, chatHistory, app.systemPrompt)
-		if err != nil {
-			return fmt.Errorf("sending chat prompt: %w", err)
-		}
+// tokensEstimated reports whether the model's tokens are guessed from the length of the prompt rather than counted
+// Anthropic's are counted by the API, OpenAI's locally when the model's vocabulary is installed
+func tokensEstimated(model string) bool {
+	switch providerOf(model) {
+	case "anthropic":
+		return false
+	case "openai":
+		_, err := tokenizer.Load(tokenizer.ForModel(model))
+		return errors.Is(err, tokenizer.ErrNoVocabulary)
+	default:
+		return true
+	}
+}
 
-		chatRsp, err := app.client.ReadBody(rsp.Body)
-		if err != nil {
-			return fmt.Errorf("reading chat response body: %w", err)
+func (app *env) saveCode(dir, text string) error {
+	paths, err := saveCodeBlocks(dir, text)
+	for _, path := range paths {
+		fmt.Fprintf(os.Stderr, "saved code block to %s\n", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "no code blocks found in the response")
+	}
+
+	return nil
+}
+
+// send prompts the model and prints its reply as it streams in, returning the full response text
+func (app *env) send(ctx context.Context, messages []wire.Message, system []wire.Text) (string, error) {
+	start := time.Now()
+	completion, err := app.complete(ctx, messages, system, app.out.onEvent)
+	if err != nil {
+		if completion != nil && completion.Text != "" {
+			return completion.Text, fmt.Errorf("%w: %w", errPartialOutput, err)
 		}
+		return "", err
+	}
+
+	if err := app.out.finish(completion, time.Since(start)); err != nil {
+		return "", fmt.Errorf("writing output: %w", err)
+	}
 
-		chatHistory = append(chatHistory, wire.Message{Role: "assistant", Content: []wire.Content{&wire.Text{Type: "text", Text: chatRsp}}})
+	return completion.Text, nil
+}
 
+// complete prompts the model and reads its whole reply, calling handler for each event in the stream
+func (app *env) complete(ctx context.Context, messages []wire.Message, system []wire.Text, handler wire.EventHandler) (*wire.Completion, error) {
+	rsp, err := app.client.SendMessage(ctx, messages, system)
+	if err != nil {
+		return nil, fmt.Errorf("sending prompt: %w", err)
+	}
+	// Closing frees the request's rate limit slot and lets the connection be reused, even if reading fails
+	if closer, ok := rsp.Body.(io.Closer); ok {
+		defer closer.Close()
 	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	completion, err := app.client.ReadBody(rsp.Body, handler)
+	if err != nil {
+		return completion, fmt.Errorf("reading response body: %w", err)
+	}
+
+	return completion, nil
 }
 
-func setupClient(model string) Client {
+// logConfig is how a command logs, every command takes the same flags
+type logConfig struct {
+	verbose bool
+	level   string
+	format  string
+}
+
+// logFlags adds the logging flags to fl, records below level are dropped unless they're changed
+func logFlags(fl *flag.FlagSet, level string) *logConfig {
+	c := &logConfig{}
+	fl.BoolVar(&c.verbose, "v", false, "log progress messages to stderr, the same as --log-level debug")
+	fl.BoolVar(&c.verbose, "verbose", false, "log progress messages to stderr, the same as --log-level debug")
+	fl.StringVar(&c.level, "log-level", level, "minimum level of the records logged to stderr [debug, info, warn, error]")
+	fl.StringVar(&c.format, "log-format", logging.FormatText, "format of the records logged to stderr [text, json]")
+	return c
+}
+
+// setup makes the logger the default, writing to stderr so only the model output goes to stdout
+func (c *logConfig) setup() (*slog.Logger, error) {
+	level := c.level
+	if c.verbose {
+		level = "debug"
+	}
+
+	logger, err := logging.New(os.Stderr, level, c.format)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+
+	return logger, nil
+}
+
+func setupClient(model string) (Client, error) {
 	config := NewClientConfig()
-	factory, ok := config.Models[model]
+	factory, ok := config.factory(model)
 	if !ok {
-		log.Fatalf("unsupported model: %s", model)
+		return nil, fmt.Errorf("unsupported model: %s", model)
 	}
 
 	return factory(model)
 }
 
+// isTerminal reports whether w is a terminal that can display ANSI formatting
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb"
+}
+
+// isPiped reports whether r is stdin connected to a pipe or file rather than a terminal
+func isPiped(r io.Reader) bool {
+	file, ok := r.(*os.File)
+	if !ok {
+		return r != nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice == 0
+}
+
 func wrapInXMLTags(text, tag string) string {
 	return fmt.Sprintf("<%s>%s</%s>", tag, text, tag)
 }
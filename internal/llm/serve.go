@@ -0,0 +1,149 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/credentials"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+	"github.com/davidhbaek/llm/internal/server"
+)
+
+// serveCommand runs an HTTP server with an OpenAI compatible chat completions API for every model
+// llm serve [--addr host:port] [--keys file] [--rpm n]
+func serveCommand(args []string) int {
+	fl := flag.NewFlagSet("serve", flag.ContinueOnError)
+
+	var addr string
+	fl.StringVar(&addr, "addr", "localhost:8080", "address to listen on")
+
+	var keysFile string
+	fl.StringVar(&keysFile, "keys", "", "file of callers' API keys, one \"<caller> <key>\" per line, every request is allowed when unset")
+
+	limits := limitFlags(fl)
+
+	// Requests are logged at info so they're shown by default
+	logs := logFlags(fl, "info")
+
+	if err := fl.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+
+	logger, err := logs.setup()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parsing args: %v\n", err)
+		return exitUsage
+	}
+	limits.Logger = logger
+
+	var keys map[string]string
+	if keysFile != "" {
+		keys, err = server.LoadKeys(keysFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "parsing args: reading keys: %v\n", err)
+			return exitUsage
+		}
+	} else {
+		logger.Warn("no --keys given, every request is allowed")
+	}
+
+	var models []string
+	for alias := range modelAliases {
+		models = append(models, alias)
+	}
+	sort.Strings(models)
+
+	if err := resolveKeys(models, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitRuntime
+	}
+
+	srv := &http.Server{
+		Addr: addr,
+		Handler: server.New(server.Config{
+			Resolve: serverClients(ratelimit.NewRegistry(*limits), logger),
+			Models:  models,
+			Keys:    keys,
+			Cost:    Cost,
+			Logger:  logger,
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		// Give requests that are still streaming a chance to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("listening", "addr", addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		return exitRuntime
+	}
+
+	return exitOK
+}
+
+// serverClients creates the client for a model named in a request, by its alias or full name
+// Every caller's requests to a model share its rate limits, and are traced when telemetry is set up
+func serverClients(registry *ratelimit.Registry, logger *slog.Logger) func(name string) (server.Client, error) {
+	return func(name string) (server.Client, error) {
+		model, err := resolveModel(name)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := setupClient(model)
+		if err != nil {
+			// Credential errors say where keys are kept, which is none of the callers' business
+			logger.Error("creating client", "model", model, "err", err)
+			return nil, fmt.Errorf("model %s isn't available", name)
+		}
+		return registry.Wrap(providerOf(model), instrument(client, logger)), nil
+	}
+}
+
+// resolveKeys looks up the keys of the served models' providers before the server starts, so a locked
+// keyring or an unreadable key file stops it instead of failing every request
+// A provider without a key is only warned about, its models answer that they aren't available
+func resolveKeys(models []string, logger *slog.Logger) error {
+	checked := map[string]bool{}
+	for _, name := range models {
+		model, err := resolveModel(name)
+		if err != nil {
+			return err
+		}
+		provider := providerOf(model)
+		if provider == "fake" || checked[provider] {
+			continue
+		}
+		checked[provider] = true
+
+		_, source, err := apiKeys().Lookup(provider)
+		switch {
+		case errors.Is(err, credentials.ErrNotFound):
+			logger.Warn("no API key, the provider's models won't be available", "provider", provider, "err", err)
+		case err != nil:
+			return fmt.Errorf("%s key: %w", provider, err)
+		default:
+			logger.Info("found API key", "provider", provider, "source", source)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package llm
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/davidhbaek/llm/internal/credentials"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+)
+
+// lockedKeyring fails like a keyring without its passphrase
+type lockedKeyring struct{}
+
+func (lockedKeyring) Key(provider string) (string, error) {
+	return "", errors.New("the keyring is locked, set " + credentials.PassphraseVar)
+}
+
+func (lockedKeyring) Describe(provider string) string {
+	return "the keyring"
+}
+
+func TestServeKeys(t *testing.T) {
+	defer func(keys func() *credentials.Resolver) { apiKeys = keys }(apiKeys)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Missing keys only make their models unavailable
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	resolver := credentials.NewResolver(credentials.Env{})
+	apiKeys = func() *credentials.Resolver { return resolver }
+	require.NoError(t, resolveKeys([]string{"sonnet", "gpt4"}, logger))
+
+	clients := serverClients(ratelimit.NewRegistry(ratelimit.Config{}), logger)
+	_, err := clients("sonnet")
+	require.EqualError(t, err, "model sonnet isn't available")
+	_, err = clients("fake:echo")
+	require.NoError(t, err)
+
+	// Other credential errors stop the server from starting
+	resolver = credentials.NewResolver(lockedKeyring{})
+	err = resolveKeys([]string{"sonnet", "gpt4"}, logger)
+	require.ErrorContains(t, err, "keyring is locked")
+
+	_, err = clients("sonnet")
+	require.EqualError(t, err, "model sonnet isn't available")
+}
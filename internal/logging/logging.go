@@ -0,0 +1,162 @@
+// Package logging sets up structured logging with log/slog and carries request-scoped loggers in contexts
+//
+// Library packages never write to stdout, they log to the logger in the request's context,
+// or the one they were given, falling back to slog.Default()
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New creates a logger writing records at level and above to w in format
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level must be one of [debug, info, warn, error], got %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("log format must be one of [text, json], got %q", format)
+	}
+}
+
+// Discard is a logger that drops every record
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+type contextKey struct{}
+
+// WithLogger returns a context carrying logger, for the code handling a request to log with its attributes
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the context's logger, or fallback when it has none, or slog.Default() when that's nil too
+func FromContext(ctx context.Context, fallback *slog.Logger) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return slog.Default()
+}
+
+// NewRequestID returns a random ID for correlating a request's log records
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Middleware logs every request with its model, provider, request ID, status, latency and tokens
+// The request's logger, with those attributes, is passed on in its context to the middleware and client it wraps
+func Middleware(logger *slog.Logger, provider string) middleware.Middleware {
+	return func(next middleware.Client) middleware.Client {
+		return &loggingClient{next: next, logger: logger, provider: provider}
+	}
+}
+
+type loggingClient struct {
+	next     middleware.Client
+	logger   *slog.Logger
+	provider string
+}
+
+func (c *loggingClient) Model() string {
+	return c.next.Model()
+}
+
+func (c *loggingClient) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return c.next.CountTokens(ctx, messages, system)
+}
+
+// loggedBody is the body of a response, carrying what's logged about its request to ReadBody
+type loggedBody struct {
+	io.Reader
+	logger *slog.Logger
+	start  time.Time
+}
+
+func (b *loggedBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *loggingClient) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	logger := FromContext(ctx, c.logger).With("model", c.next.Model(), "provider", c.provider, "request_id", NewRequestID())
+	ctx = WithLogger(ctx, logger)
+
+	logger.Debug("sending request", "messages", len(messages))
+	start := time.Now()
+	rsp, err := c.next.SendMessage(ctx, messages, system, opts...)
+	if err != nil {
+		logger.Error("request failed", "latency", time.Since(start), "error", err)
+		return nil, err
+	}
+
+	if id := providerRequestID(rsp.Header); id != "" {
+		logger = logger.With("provider_request_id", id)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		logger.Warn("request failed", "status", rsp.StatusCode, "latency", time.Since(start))
+		return rsp, nil
+	}
+
+	return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: &loggedBody{Reader: rsp.Body, logger: logger, start: start}}, nil
+}
+
+func (c *loggingClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	b, ok := body.(*loggedBody)
+	if !ok {
+		return c.next.ReadBody(body, handler)
+	}
+
+	completion, err := c.next.ReadBody(b.Reader, handler)
+
+	attrs := []any{"status", http.StatusOK, "latency", time.Since(b.start)}
+	if completion != nil {
+		attrs = append(attrs, "input_tokens", completion.Usage.InputTokens, "output_tokens", completion.Usage.OutputTokens, "stop_reason", completion.StopReason)
+	}
+	if err != nil {
+		b.logger.Error("response stream failed", append(attrs, "error", err)...)
+	} else {
+		b.logger.Info("request complete", attrs...)
+	}
+
+	return completion, err
+}
+
+// providerRequestID is the ID the provider gave the request, for support tickets
+func providerRequestID(header http.Header) string {
+	if id := header.Get("request-id"); id != "" {
+		return id
+	}
+	return header.Get("x-request-id")
+}
@@ -0,0 +1,105 @@
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		level, format string
+		wantErr       bool
+	}{
+		{level: "debug", format: "text"},
+		{level: "WARN", format: "json"},
+		{level: "loud", format: "text", wantErr: true},
+		{level: "info", format: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := logging.New(&bytes.Buffer{}, tt.level, tt.format)
+		require.Equal(t, tt.wantErr, err != nil, "level=%s format=%s", tt.level, tt.format)
+	}
+}
+
+// records parses the JSON log records in buf
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		record := map[string]any{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		out = append(out, record)
+	}
+	return out
+}
+
+func TestMiddleware(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := logging.New(buf, "debug", "json")
+	require.NoError(t, err)
+
+	// The wrapped client sees the request's logger in its context
+	inner := &contextLogging{Client: fake.NewClient("fake:hello world")}
+	client := middleware.Chain(inner, logging.Middleware(logger, "fake"))
+
+	messages := []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "hi"}}}}
+	rsp, err := client.SendMessage(context.Background(), messages, nil)
+	require.NoError(t, err)
+	_, err = client.ReadBody(rsp.Body, nil)
+	require.NoError(t, err)
+
+	logged := records(t, buf)
+	require.Len(t, logged, 3)
+	require.Equal(t, "sending request", logged[0]["msg"])
+	require.Equal(t, "inside the client", logged[1]["msg"])
+	require.Equal(t, "request complete", logged[2]["msg"])
+
+	done := logged[2]
+	require.Equal(t, "INFO", done["level"])
+	require.Equal(t, "fake:hello world", done["model"])
+	require.Equal(t, "fake", done["provider"])
+	require.Equal(t, float64(http.StatusOK), done["status"])
+	require.Equal(t, float64(3), done["output_tokens"])
+	require.Contains(t, done, "latency")
+
+	// Every record of a request shares its ID
+	require.NotEmpty(t, done["request_id"])
+	require.Equal(t, done["request_id"], logged[0]["request_id"])
+	require.Equal(t, done["request_id"], logged[1]["request_id"])
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger, err := logging.New(buf, "info", "json")
+	require.NoError(t, err)
+
+	client := middleware.Chain(fake.NewClient(fake.RateLimited), logging.Middleware(logger, "fake"))
+	rsp, err := client.SendMessage(context.Background(), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, rsp.StatusCode)
+
+	logged := records(t, buf)
+	require.Len(t, logged, 1)
+	require.Equal(t, "WARN", logged[0]["level"])
+	require.Equal(t, float64(http.StatusTooManyRequests), logged[0]["status"])
+}
+
+// contextLogging logs to the logger in the context of each request it sends
+type contextLogging struct {
+	*fake.Client
+}
+
+func (c *contextLogging) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	logging.FromContext(ctx, logging.Discard()).Debug("inside the client")
+	return c.Client.SendMessage(ctx, messages, system, opts...)
+}
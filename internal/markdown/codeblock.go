@@ -0,0 +1,81 @@
+package markdown
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+)
+
+// CodeBlock is a fenced code block found in Markdown text
+type CodeBlock struct {
+	Language string
+	// Filename is taken from the fence's info string when the model gave one
+	// e.g. ```go main.go or ```python title="app.py"
+	Filename string
+	Code     string
+}
+
+var (
+	openFenceRe = regexp.MustCompile("^\\s*(```+|~~~+)\\s*(.*)$")
+	filenameRe  = regexp.MustCompile(`^(?:(?:title|file|filename|name)=)?["']?([\w./-]+\.\w+)["']?$`)
+)
+
+// CodeBlocks returns every fenced code block in text in the order they appear
+// A block left open at the end of text is still returned
+func CodeBlocks(text string) []CodeBlock {
+	var blocks []CodeBlock
+	var current *CodeBlock
+	var fence string
+	var code strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(text)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if current == nil {
+			m := openFenceRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			fence = m[1]
+			current = parseInfo(m[2])
+			code.Reset()
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(line), fence) && strings.Trim(strings.TrimSpace(line), fence[:1]) == "" {
+			current.Code = code.String()
+			blocks = append(blocks, *current)
+			current = nil
+			continue
+		}
+
+		code.WriteString(line)
+		code.WriteString("\n")
+	}
+
+	if current != nil {
+		current.Code = code.String()
+		blocks = append(blocks, *current)
+	}
+
+	return blocks
+}
+
+// parseInfo reads the language and an optional filename from a fence's info string
+func parseInfo(info string) *CodeBlock {
+	block := &CodeBlock{}
+	for i, field := range strings.Fields(info) {
+		if m := filenameRe.FindStringSubmatch(field); m != nil && block.Filename == "" {
+			block.Filename = m[1]
+			continue
+		}
+
+		if i == 0 {
+			block.Language = strings.ToLower(field)
+		}
+	}
+
+	return block
+}
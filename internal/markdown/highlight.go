@@ -0,0 +1,121 @@
+package markdown
+
+import (
+	"strings"
+	"unicode"
+)
+
+type language struct {
+	keywords map[string]bool
+	comment  string
+}
+
+func words(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+var languages = map[string]language{
+	"go": {
+		keywords: words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false error string int bool byte rune float64 any"),
+		comment:  "//",
+	},
+	"python": {
+		keywords: words("and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self"),
+		comment:  "#",
+	},
+	"javascript": {
+		keywords: words("async await break case catch class const continue default delete do else export extends finally for function if import in instanceof let new null return switch this throw try typeof undefined var void while yield true false interface type"),
+		comment:  "//",
+	},
+	"rust": {
+		keywords: words("as async await break const continue crate else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		comment:  "//",
+	},
+	"shell": {
+		keywords: words("if then else elif fi case esac for while until do done in function return export local echo exit"),
+		comment:  "#",
+	},
+	"sql": {
+		keywords: words("select from where and or not insert into values update set delete create table drop alter join left right inner outer on group by order having limit as null is in like distinct union SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER JOIN LEFT RIGHT INNER OUTER ON GROUP BY ORDER HAVING LIMIT AS NULL IS IN LIKE DISTINCT UNION"),
+		comment:  "--",
+	},
+}
+
+var aliases = map[string]string{
+	"golang":     "go",
+	"py":         "python",
+	"js":         "javascript",
+	"ts":         "javascript",
+	"jsx":        "javascript",
+	"tsx":        "javascript",
+	"typescript": "javascript",
+	"rs":         "rust",
+	"sh":         "shell",
+	"bash":       "shell",
+	"zsh":        "shell",
+}
+
+// highlight colors keywords, strings, numbers and comments in a line of code
+// Unknown languages are returned as is
+func highlight(line, lang string) string {
+	if alias, ok := aliases[lang]; ok {
+		lang = alias
+	}
+	l, ok := languages[lang]
+	if !ok {
+		return line
+	}
+
+	var sb strings.Builder
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case strings.HasPrefix(string(runes[i:]), l.comment):
+			sb.WriteString(dim + string(runes[i:]) + reset)
+			return sb.String()
+
+		case r == '"' || r == '\'' || r == '`':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end = min(end+1, len(runes))
+			sb.WriteString(green + string(runes[i:end]) + reset)
+			i = end
+
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || runes[end] == '.' || runes[end] == '_') {
+				end++
+			}
+			sb.WriteString(yellow + string(runes[i:end]) + reset)
+			i = end
+
+		case unicode.IsLetter(r) || r == '_':
+			end := i
+			for end < len(runes) && (unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end]) || runes[end] == '_') {
+				end++
+			}
+			word := string(runes[i:end])
+			if l.keywords[word] {
+				word = blue + bold + word + reset
+			}
+			sb.WriteString(word)
+			i = end
+
+		default:
+			sb.WriteRune(r)
+			i++
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,247 @@
+// Package markdown renders Markdown for display in a terminal as it streams in
+package markdown
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ANSI escape codes
+const (
+	reset     = "\x1b[0m"
+	bold      = "\x1b[1m"
+	dim       = "\x1b[2m"
+	italic    = "\x1b[3m"
+	underline = "\x1b[4m"
+	green     = "\x1b[32m"
+	yellow    = "\x1b[33m"
+	blue      = "\x1b[34m"
+	magenta   = "\x1b[35m"
+	cyan      = "\x1b[36m"
+)
+
+// Renderer formats Markdown written to it and writes the result to an underlying writer
+// Text is buffered until a full line arrives since a line's formatting can depend on
+// characters that haven't been streamed yet, tables are buffered until they end
+type Renderer struct {
+	w       io.Writer
+	partial bytes.Buffer
+	table   []string
+
+	inCode   bool
+	fence    string
+	codeLang string
+}
+
+func NewRenderer(w io.Writer) *Renderer {
+	return &Renderer{w: w}
+}
+
+// Write renders every complete line in p, keeping any trailing partial line for later
+func (r *Renderer) Write(p []byte) (int, error) {
+	r.partial.Write(p)
+
+	for {
+		idx := bytes.IndexByte(r.partial.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+
+		line := string(r.partial.Next(idx + 1))
+		if err := r.renderLine(strings.TrimSuffix(line, "\n")); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush renders whatever is left in the buffer, call it once the stream is finished
+func (r *Renderer) Flush() error {
+	if r.partial.Len() > 0 {
+		line := r.partial.String()
+		r.partial.Reset()
+		if err := r.renderLine(line); err != nil {
+			return err
+		}
+	}
+
+	return r.flushTable()
+}
+
+var (
+	headingRe  = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	bulletRe   = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	numberedRe = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	quoteRe    = regexp.MustCompile(`^>\s?(.*)$`)
+	ruleRe     = regexp.MustCompile(`^\s*([-*_])(\s*([-*_]))+\s*$`)
+	fenceRe    = regexp.MustCompile("^\\s*(```+|~~~+)\\s*([^\\s`]*)")
+)
+
+func (r *Renderer) renderLine(line string) error {
+	if r.inCode {
+		if strings.HasPrefix(strings.TrimSpace(line), r.fence) {
+			r.inCode = false
+			return r.println(dim + "└─" + reset)
+		}
+		return r.println(dim + "│ " + reset + highlight(line, r.codeLang))
+	}
+
+	if m := fenceRe.FindStringSubmatch(line); m != nil {
+		if err := r.flushTable(); err != nil {
+			return err
+		}
+		r.inCode = true
+		r.fence = m[1]
+		r.codeLang = strings.ToLower(m[2])
+		return r.println(dim + "┌─ " + r.codeLang + reset)
+	}
+
+	if isTableRow(line) {
+		r.table = append(r.table, line)
+		return nil
+	}
+	if err := r.flushTable(); err != nil {
+		return err
+	}
+
+	switch {
+	case headingRe.MatchString(line):
+		m := headingRe.FindStringSubmatch(line)
+		color := cyan
+		if len(m[1]) == 1 {
+			color = cyan + underline
+		}
+		return r.println(bold + color + inline(m[2]) + reset)
+	case ruleRe.MatchString(line):
+		return r.println(dim + strings.Repeat("─", 40) + reset)
+	case bulletRe.MatchString(line):
+		m := bulletRe.FindStringSubmatch(line)
+		return r.println(m[1] + yellow + "•" + reset + " " + inline(m[2]))
+	case numberedRe.MatchString(line):
+		m := numberedRe.FindStringSubmatch(line)
+		return r.println(m[1] + yellow + m[2] + reset + " " + inline(m[3]))
+	case quoteRe.MatchString(line):
+		m := quoteRe.FindStringSubmatch(line)
+		return r.println(dim + "┃ " + reset + italic + inline(m[1]) + reset)
+	default:
+		return r.println(inline(line))
+	}
+}
+
+func (r *Renderer) println(s string) error {
+	_, err := io.WriteString(r.w, s+"\n")
+	return err
+}
+
+var (
+	codeSpanRe = regexp.MustCompile("`([^`]+)`")
+	boldRe     = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicRe   = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+	linkRe     = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+)
+
+// inline formats code spans, emphasis and links within a line
+func inline(s string) string {
+	// Code spans are swapped out first so their contents aren't treated as emphasis
+	var spans []string
+	s = codeSpanRe.ReplaceAllStringFunc(s, func(m string) string {
+		spans = append(spans, m[1:len(m)-1])
+		return "\x00" + strconv.Itoa(len(spans)-1) + "\x00"
+	})
+
+	s = linkRe.ReplaceAllString(s, underline+blue+"$1"+reset+dim+" ($2)"+reset)
+	s = boldRe.ReplaceAllString(s, bold+"$1$2"+reset)
+	s = italicRe.ReplaceAllString(s, italic+"$1$2"+reset)
+
+	for i, span := range spans {
+		s = strings.Replace(s, "\x00"+strconv.Itoa(i)+"\x00", magenta+span+reset, 1)
+	}
+
+	return s
+}
+
+func isTableRow(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, "|") && strings.Count(trimmed, "|") >= 2
+}
+
+var separatorRe = regexp.MustCompile(`^\|?(\s*:?-+:?\s*\|)+\s*:?-*:?\s*$`)
+
+// flushTable renders the buffered table rows with their columns aligned
+func (r *Renderer) flushTable() error {
+	if len(r.table) == 0 {
+		return nil
+	}
+	rows := r.table
+	r.table = nil
+
+	var cells [][]string
+	var widths []int
+	header := -1
+	for _, row := range rows {
+		trimmed := strings.TrimSpace(row)
+		if separatorRe.MatchString(trimmed) {
+			header = len(cells) - 1
+			continue
+		}
+
+		trimmed = strings.TrimSuffix(strings.TrimPrefix(trimmed, "|"), "|")
+		var cols []string
+		for i, col := range strings.Split(trimmed, "|") {
+			cols = append(cols, strings.TrimSpace(col))
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+		}
+		cells = append(cells, cols)
+	}
+
+	// Cells are formatted before they're measured, since formatting removes markers like ** and `
+	for i, cols := range cells {
+		for j, col := range cols {
+			if i == header {
+				cols[j] = bold + col + reset
+			} else {
+				cols[j] = inline(col)
+			}
+			widths[j] = max(widths[j], visibleWidth(cols[j]))
+		}
+	}
+
+	for i, cols := range cells {
+		var sb strings.Builder
+		for j, col := range cols {
+			if j > 0 {
+				sb.WriteString(dim + " │ " + reset)
+			}
+			sb.WriteString(col + strings.Repeat(" ", widths[j]-visibleWidth(col)))
+		}
+		if err := r.println(sb.String()); err != nil {
+			return err
+		}
+
+		if i == header {
+			var sep []string
+			for _, w := range widths[:len(cols)] {
+				sep = append(sep, strings.Repeat("─", w))
+			}
+			if err := r.println(dim + strings.Join(sep, "─┼─") + reset); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+var ansiRe = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// visibleWidth is how many characters s takes up on a terminal, leaving out ANSI escape codes
+func visibleWidth(s string) int {
+	return utf8.RuneCountInString(ansiRe.ReplaceAllString(s, ""))
+}
@@ -0,0 +1,76 @@
+package markdown_test
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/markdown"
+	"github.com/stretchr/testify/require"
+)
+
+var ansiRe = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func TestRenderer(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Deltas   []string
+		Expected string
+	}{
+		{
+			Name:     "heading and emphasis split across deltas",
+			Deltas:   []string{"# Ti", "tle\nsome **bo", "ld** and *it", "alic* text"},
+			Expected: "Title\nsome bold and italic text\n",
+		},
+		{
+			Name:     "lists",
+			Deltas:   []string{"- one\n", "- two\n1. first\n"},
+			Expected: "• one\n• two\n1. first\n",
+		},
+		{
+			Name:     "code spans aren't treated as emphasis",
+			Deltas:   []string{"run `a*b*c` now\n"},
+			Expected: "run a*b*c now\n",
+		},
+		{
+			Name:     "fenced code block",
+			Deltas:   []string{"``", "`go\nfunc main() {}\n`", "``\nafter\n"},
+			Expected: "┌─ go\n│ func main() {}\n└─\nafter\n",
+		},
+		{
+			Name:     "table columns are aligned",
+			Deltas:   []string{"| a | bb |\n|---|---|\n| ccc | d |\n", "done"},
+			Expected: "a   │ bb\n────┼───\nccc │ d \ndone\n",
+		},
+		{
+			Name:     "table columns are aligned by their formatted text",
+			Deltas:   []string{"| name | kind |\n|---|---|\n| **bold** | `x` |\n| plain | y |\n"},
+			Expected: "name  │ kind\n──────┼─────\nbold  │ x   \nplain │ y   \n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r := markdown.NewRenderer(&buf)
+			for _, delta := range test.Deltas {
+				_, err := r.Write([]byte(delta))
+				require.NoError(t, err)
+			}
+			require.NoError(t, r.Flush())
+			require.Equal(t, test.Expected, ansiRe.ReplaceAllString(buf.String(), ""))
+		})
+	}
+}
+
+func TestCodeBlocks(t *testing.T) {
+	text := "Here you go:\n\n```go main.go\npackage main\n```\n\nand\n\n```python title=\"tools/app.py\"\nprint('hi')\n```\n\n~~~\nplain\n~~~\n\n```sh\necho unterminated\n"
+
+	blocks := markdown.CodeBlocks(text)
+	require.Equal(t, []markdown.CodeBlock{
+		{Language: "go", Filename: "main.go", Code: "package main\n"},
+		{Language: "python", Filename: "tools/app.py", Code: "print('hi')\n"},
+		{Code: "plain\n"},
+		{Language: "sh", Code: "echo unterminated\n"},
+	}, blocks)
+}
@@ -0,0 +1,163 @@
+// Package middleware composes behavior around llm.Client, like caching, rate limiting, logging or redaction,
+// without changing the provider packages
+//
+// A Middleware wraps a client in another one. Intercept builds one from hooks that see each request
+// and the events of its streamed response, which covers most needs without writing a whole client
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Client is llm.Client
+type Client interface {
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error)
+	Model() string
+}
+
+// Middleware wraps a client, handling requests before and after the client it wraps
+type Middleware func(Client) Client
+
+// Builder composes middleware in the order it's added, the first one sees requests first and responses last
+type Builder struct {
+	middleware []Middleware
+}
+
+func NewBuilder() *Builder {
+	return &Builder{}
+}
+
+// Use adds middleware inside the middleware already added, nil middleware is skipped
+func (b *Builder) Use(middleware ...Middleware) *Builder {
+	for _, mw := range middleware {
+		if mw != nil {
+			b.middleware = append(b.middleware, mw)
+		}
+	}
+	return b
+}
+
+// Build wraps client in the middleware
+func (b *Builder) Build(client Client) Client {
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		client = b.middleware[i](client)
+	}
+	return client
+}
+
+// Chain wraps client in middleware, the first one is the outermost
+func Chain(client Client, middleware ...Middleware) Client {
+	return NewBuilder().Use(middleware...).Build(client)
+}
+
+// Request is a prompt on its way to the model
+type Request struct {
+	Model    string
+	Messages []wire.Message
+	System   []wire.Text
+	Options  wire.Options
+}
+
+// Hooks are called over the course of a request, any of them can be nil
+type Hooks struct {
+	// Called before the request is sent, changes to it are sent on, an error stops it from being sent
+	Request func(ctx context.Context, req *Request) error
+	// Called with each event of the streamed response, before the caller sees it, an error stops the stream
+	Event func(req *Request, event wire.Event) error
+	// Called once the response is read or fails, completion is nil when there was no stream
+	// Errors from the provider are *wire.APIError
+	Response func(req *Request, completion *wire.Completion, err error)
+}
+
+// Intercept is middleware that calls hooks for every request
+func Intercept(hooks Hooks) Middleware {
+	return func(next Client) Client {
+		return &interceptor{next: next, hooks: hooks}
+	}
+}
+
+type interceptor struct {
+	next  Client
+	hooks Hooks
+}
+
+func (i *interceptor) Model() string {
+	return i.next.Model()
+}
+
+func (i *interceptor) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return i.next.CountTokens(ctx, messages, system)
+}
+
+// interceptedBody is the body of a response, carrying its request to ReadBody
+type interceptedBody struct {
+	io.Reader
+	req *Request
+}
+
+func (b *interceptedBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (i *interceptor) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	req := &Request{Model: i.next.Model(), Messages: messages, System: system, Options: wire.NewOptions(opts...)}
+	if i.hooks.Request != nil {
+		if err := i.hooks.Request(ctx, req); err != nil {
+			return nil, err
+		}
+	}
+
+	options := req.Options
+	rsp, err := i.next.SendMessage(ctx, req.Messages, req.System, func(o *wire.Options) { *o = options })
+	if err != nil {
+		i.respond(req, nil, err)
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		// The caller still gets to read the error body
+		body, _ := io.ReadAll(rsp.Body)
+		if closer, ok := rsp.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		i.respond(req, nil, wire.NewAPIError(rsp.StatusCode, bytes.NewReader(body)))
+		return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: bytes.NewReader(body)}, nil
+	}
+
+	return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: &interceptedBody{Reader: rsp.Body, req: req}}, nil
+}
+
+func (i *interceptor) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	b, ok := body.(*interceptedBody)
+	if !ok {
+		return i.next.ReadBody(body, handler)
+	}
+
+	completion, err := i.next.ReadBody(b.Reader, func(event wire.Event) error {
+		if i.hooks.Event != nil {
+			if err := i.hooks.Event(b.req, event); err != nil {
+				return err
+			}
+		}
+		return handler.Emit(event)
+	})
+	i.respond(b.req, completion, err)
+
+	return completion, err
+}
+
+func (i *interceptor) respond(req *Request, completion *wire.Completion, err error) {
+	if i.hooks.Response != nil {
+		i.hooks.Response(req, completion, err)
+	}
+}
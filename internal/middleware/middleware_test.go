@@ -0,0 +1,122 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func userMessage(text string) []wire.Message {
+	return []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}}
+}
+
+// send sends a request through client and reads the whole response
+func send(t *testing.T, client middleware.Client, text string, opts ...wire.Option) (*wire.Completion, error) {
+	rsp, err := client.SendMessage(context.Background(), userMessage(text), wire.SystemPrompt("Be brief"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+	return client.ReadBody(rsp.Body, nil)
+}
+
+func TestBuilderOrder(t *testing.T) {
+	var calls []string
+	named := func(name string) middleware.Middleware {
+		return middleware.Intercept(middleware.Hooks{
+			Request: func(ctx context.Context, req *middleware.Request) error {
+				calls = append(calls, name+" request")
+				return nil
+			},
+			Response: func(req *middleware.Request, completion *wire.Completion, err error) {
+				calls = append(calls, name+" response")
+			},
+		})
+	}
+
+	client := middleware.NewBuilder().Use(named("outer"), nil, named("inner")).Build(fake.NewClient(fake.Echo))
+	_, err := send(t, client, "hi")
+	require.NoError(t, err)
+	require.Equal(t, []string{"outer request", "inner request", "inner response", "outer response"}, calls)
+	require.Equal(t, fake.Echo, client.Model())
+}
+
+func TestIntercept(t *testing.T) {
+	inner := fake.NewClient(fake.Echo)
+
+	var seen *middleware.Request
+	var events []wire.Event
+	var final *wire.Completion
+	client := middleware.Chain(inner, middleware.Intercept(middleware.Hooks{
+		// Redact the prompt and pin the temperature
+		Request: func(ctx context.Context, req *middleware.Request) error {
+			seen = req
+			req.Messages = userMessage(strings.ReplaceAll(req.Messages[0].Content[0].(*wire.Text).Text, "hunter2", "[redacted]"))
+			req.Options.Temperature = new(float64)
+			return nil
+		},
+		Event: func(req *middleware.Request, event wire.Event) error {
+			require.Same(t, seen, req)
+			events = append(events, event)
+			return nil
+		},
+		Response: func(req *middleware.Request, completion *wire.Completion, err error) {
+			require.NoError(t, err)
+			final = completion
+		},
+	}))
+
+	completion, err := send(t, client, "my password is hunter2", wire.WithMaxTokens(100))
+	require.NoError(t, err)
+	require.Equal(t, "my password is [redacted]", completion.Text)
+	require.Same(t, completion, final)
+	require.Equal(t, wire.EventStart, events[0].Type)
+	require.Equal(t, wire.EventStop, events[len(events)-1].Type)
+
+	require.Equal(t, fake.Echo, seen.Model)
+	require.Equal(t, wire.SystemPrompt("Be brief"), seen.System)
+
+	calls := inner.Calls()
+	require.Len(t, calls, 1)
+	require.Equal(t, 100, calls[0].Options.MaxTokens)
+	require.Equal(t, 0.0, *calls[0].Options.Temperature)
+}
+
+func TestInterceptErrors(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	inner := fake.NewClient(fake.RateLimited)
+
+	var responseErr error
+	client := middleware.Chain(inner, middleware.Intercept(middleware.Hooks{
+		Request: func(ctx context.Context, req *middleware.Request) error {
+			if strings.Contains(req.Messages[0].Content[0].(*wire.Text).Text, "forbidden") {
+				return errBlocked
+			}
+			return nil
+		},
+		Response: func(req *middleware.Request, completion *wire.Completion, err error) {
+			responseErr = err
+		},
+	}))
+
+	_, err := send(t, client, "something forbidden")
+	require.ErrorIs(t, err, errBlocked)
+	require.Empty(t, inner.Calls())
+
+	// The hook and the caller both see the provider's error
+	_, err = send(t, client, "hi")
+	var apiErr *wire.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, "rate_limit_error", apiErr.Type)
+	require.ErrorAs(t, responseErr, &apiErr)
+	require.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+}
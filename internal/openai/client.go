@@ -5,13 +5,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/tokenizer"
 	"github.com/davidhbaek/llm/internal/wire"
 )
 
@@ -24,10 +28,43 @@ type Client struct {
 	config     Config
 	model      string
 	httpClient *http.Client
+	// Used when the request's context doesn't carry a logger
+	logger *slog.Logger
 }
 
-func NewClient(model string) *Client {
-	return &Client{
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL points the client at another OpenAI compatible API, like a local model server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.config.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithAPIKey authenticates with key instead of the OPENAI_API_KEY environment variable
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.config.apiKey = key
+	}
+}
+
+// WithHTTPClient sends requests with httpClient instead of the default client
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithLogger logs to logger instead of slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+func NewClient(model string, opts ...Option) *Client {
+	c := &Client{
 		config: Config{
 			baseURL: "https://api.openai.com",
 			apiKey:  os.Getenv("OPENAI_API_KEY"),
@@ -42,35 +79,66 @@ func NewClient(model string) *Client {
 			},
 		},
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 func (c *Client) Model() string {
 	return c.model
 }
 
-func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, systemPrompt string) (*wire.Response, error) {
+func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	options := wire.NewOptions(opts...)
+
+	messages, err := toOpenAI(messages)
+	if err != nil {
+		return nil, err
+	}
+
 	// The OpenAI API doesn't have a separate field for system prompts like the Anthropic API does
+	var systemPrompt []string
+	for _, block := range system {
+		systemPrompt = append(systemPrompt, block.Text)
+	}
 	if len(systemPrompt) > 0 {
-		messages = append(messages, wire.Message{
+		messages = append([]wire.Message{{
 			Role:    "system",
-			Content: []wire.Content{&wire.Text{Type: "text", Text: systemPrompt}},
-		})
+			Content: []wire.Content{&wire.Text{Type: "text", Text: strings.Join(systemPrompt, "\n")}},
+		}}, messages...)
+	}
+
+	type streamOptions struct {
+		IncludeUsage bool `json:"include_usage"`
 	}
 
 	reqBody, err := json.Marshal(struct {
-		Model    string         `json:"model"`
-		Messages []wire.Message `json:"messages"`
-		Stream   bool           `json:"stream"`
+		Model         string         `json:"model"`
+		Messages      []wire.Message `json:"messages"`
+		Stream        bool           `json:"stream"`
+		StreamOptions streamOptions  `json:"stream_options"`
+		MaxTokens     int            `json:"max_tokens,omitempty"`
+		Temperature   *float64       `json:"temperature,omitempty"`
+		TopP          *float64       `json:"top_p,omitempty"`
+		Stop          []string       `json:"stop,omitempty"`
 	}{
-		Model:    c.model,
-		Messages: messages,
-		Stream:   true,
+		Model:         c.model,
+		Messages:      messages,
+		Stream:        true,
+		StreamOptions: streamOptions{IncludeUsage: true},
+		MaxTokens:     options.MaxTokens,
+		Temperature:   options.Temperature,
+		TopP:          options.TopP,
+		Stop:          options.Stop,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/chat/completions"), bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/chat/completions"), bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, err
 	}
@@ -78,21 +146,107 @@ func (c *Client) SendMessage(ctx context.Context, messages []wire.Message, syste
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.apiKey))
 
+	start := time.Now()
 	rsp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	logging.FromContext(ctx, c.logger).Debug("received response headers", "path", req.URL.Path, "status", rsp.StatusCode, "latency", time.Since(start))
 
 	return &wire.Response{
 		StatusCode: rsp.StatusCode,
-		Body:       rsp.Body,
+		Header:     rsp.Header,
+		Body:       &wire.TimedBody{Reader: rsp.Body, Sent: start, Received: time.Now()},
 	}, nil
 }
 
-func (c *Client) ReadBody(body io.Reader) (string, error) {
+// toOpenAI copies messages, converting Anthropic content to OpenAI's format
+// Cache breakpoints are dropped, images become data URLs and text documents become text
+func toOpenAI(messages []wire.Message) ([]wire.Message, error) {
+	copied := make([]wire.Message, len(messages))
+	for i, msg := range messages {
+		copied[i] = wire.Message{Role: msg.Role, Content: make([]wire.Content, len(msg.Content))}
+		for j, content := range msg.Content {
+			switch part := content.(type) {
+			case *wire.Text:
+				if part.CacheControl != nil {
+					content = &wire.Text{Type: part.Type, Text: part.Text}
+				}
+			case *wire.AnthropicImage:
+				if part.Source.Type != "base64" {
+					return nil, fmt.Errorf("%s image sources aren't supported by OpenAI models, send the image as base64", part.Source.Type)
+				}
+				image := &wire.OpenAIImage{Type: "image_url"}
+				image.ImageURL.URL = fmt.Sprintf("data:%s;base64,%s", part.Source.MediaType, part.Source.Data)
+				content = image
+			case *wire.Document:
+				if part.Source.Type != "text" {
+					return nil, fmt.Errorf("%s documents aren't supported by OpenAI models", part.Source.MediaType)
+				}
+				content = &wire.Text{Type: "text", Text: part.Source.Data}
+			}
+			copied[i].Content[j] = content
+		}
+	}
+
+	return copied, nil
+}
+
+// Per message overheads from OpenAI's guide to counting tokens for chat models
+const (
+	tokensPerMessage = 3
+	tokensPerRole    = 1
+	tokensPerReply   = 3
+	// A high detail 1024x1024 image, the API sizes images down to around this
+	tokensPerImage = 765
+)
+
+// CountTokens returns the number of input tokens a request would use
+// It's counted locally with the model's BPE vocabulary when it's available on disk
+// and estimated from the length of the text otherwise, nothing is sent over the network
+func (c *Client) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	count := tokenizer.Estimate
+	bpe, err := tokenizer.Load(tokenizer.ForModel(c.model))
+	switch {
+	case err == nil:
+		count = bpe.Count
+	case errors.Is(err, tokenizer.ErrNoVocabulary):
+		logging.FromContext(ctx, c.logger).Debug("estimating tokens", "error", err)
+	default:
+		return 0, err
+	}
+
+	tokens := tokensPerReply
+	if len(system) > 0 {
+		tokens += tokensPerMessage + tokensPerRole
+		for _, block := range system {
+			tokens += count(block.Text)
+		}
+	}
+
+	for _, msg := range messages {
+		tokens += tokensPerMessage + tokensPerRole
+		for _, content := range msg.Content {
+			switch part := content.(type) {
+			case *wire.Text:
+				tokens += count(part.Text)
+			default:
+				tokens += tokensPerImage
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+func (c *Client) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	stopwatch := wire.StartStopwatch(body)
+	handler = stopwatch.Handler(handler)
+
 	scanner := bufio.NewScanner(body)
 
-	var text string
+	completion := &wire.Completion{Model: c.model}
+	started := false
 	for scanner.Scan() {
 		line := scanner.Text()
 
@@ -103,11 +257,14 @@ func (c *Client) ReadBody(body io.Reader) (string, error) {
 
 		payload := parts[1]
 		if strings.Contains(payload, "[DONE]") {
+			usage := completion.Usage
+			err := handler.Emit(wire.Event{Type: wire.EventStop, StopReason: completion.StopReason, Usage: &usage})
+			if err != nil {
+				return completion, err
+			}
 			break
 		}
 
-		// TODO: Add error response handling
-
 		response := struct {
 			ID                string `json:"id"`
 			Object            string `json:"-"`
@@ -119,22 +276,61 @@ func (c *Client) ReadBody(body io.Reader) (string, error) {
 				Delta struct {
 					Content string `json:"content"`
 				} `json:"delta"`
+				FinishReason string `json:"finish_reason"`
 			} `json:"choices"`
+			// Only sent in the final chunk when stream_options.include_usage is set
+			Usage *struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+			Error *wire.APIError `json:"error"`
 		}{}
 
 		err := json.Unmarshal([]byte(payload), &response)
 		if err != nil {
-			return "", fmt.Errorf("unmarshaling response from API: %w", err)
+			return completion, fmt.Errorf("unmarshaling response from API: %w", err)
+		}
+
+		if response.Error != nil {
+			return completion, response.Error
+		}
+
+		if !started {
+			started = true
+			completion.Model = response.Model
+			err := handler.Emit(wire.Event{Type: wire.EventStart, Model: response.Model})
+			if err != nil {
+				return completion, err
+			}
+		}
+
+		if response.Usage != nil {
+			completion.Usage.InputTokens = response.Usage.PromptTokens
+			completion.Usage.OutputTokens = response.Usage.CompletionTokens
 		}
 
 		for _, choice := range response.Choices {
-			fmt.Printf("%s", choice.Delta.Content)
-			text += choice.Delta.Content
+			if choice.FinishReason != "" {
+				completion.StopReason = choice.FinishReason
+			}
+
+			if choice.Delta.Content == "" {
+				continue
+			}
+
+			completion.Text += choice.Delta.Content
+			err := handler.Emit(wire.Event{Type: wire.EventText, Text: choice.Delta.Content})
+			if err != nil {
+				return completion, err
+			}
 		}
 
 	}
 
-	fmt.Println()
+	if err := scanner.Err(); err != nil {
+		return completion, fmt.Errorf("reading response stream: %w", err)
+	}
 
-	return text, nil
+	completion.Timing = stopwatch.Timing(completion.Usage.OutputTokens)
+	return completion, nil
 }
@@ -2,45 +2,217 @@ package openai_test
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/davidhbaek/llm/internal/openai"
+	"github.com/davidhbaek/llm/internal/replay"
 	"github.com/davidhbaek/llm/internal/wire"
 
 	"github.com/stretchr/testify/require"
 )
 
+var record = flag.Bool("record", false, "record the fixtures in testdata from the real API, needs OPENAI_API_KEY")
+
+// newTestClient replays the API's responses from testdata/<fixture>.json, or records them with -record
+func newTestClient(t *testing.T, fixture string) *openai.Client {
+	transport := replay.NewTransport(filepath.Join("testdata", fixture+".json"), *record)
+	t.Cleanup(func() {
+		require.NoError(t, transport.Save())
+	})
+
+	return openai.NewClient("gpt-4-turbo", openai.WithHTTPClient(&http.Client{Transport: transport}))
+}
+
+// A 1x1 red PNG, so recording doesn't depend on an image hosted elsewhere
+const redPixel = "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAIAAACQd1PeAAAADElEQVR4nGP4z8AAAAMBAQDJ/pLvAAAAAElFTkSuQmCC"
+
 func TestSendMessage(t *testing.T) {
-	client := openai.NewClient("gpt-4-turbo")
 	tests := []struct {
 		Name               string
+		Fixture            string
 		ExpectedStatusCode int
+		ExpectedText       string
 		InputMsg           []wire.Message
-		SystemPrompt       string
+		SystemPrompt       []wire.Text
 	}{
-		{Name: "Hello ChatGPT", ExpectedStatusCode: http.StatusOK, InputMsg: []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello World"}}}}},
-		{Name: "send image with prompt", ExpectedStatusCode: http.StatusOK, InputMsg: []wire.Message{{Role: "user", Content: []wire.Content{
-			&wire.Text{Type: "text", Text: "What's in this image?"},
-			&wire.OpenAIImage{
-				Type: "image_url",
-				ImageURL: struct {
-					URL string `json:"url"`
-				}{
-					URL: "https://tetonheritagebuilders.com/wp-content/uploads/2016/12/krafty_photos_Aguzin-2.jpg",
+		{
+			Name:               "Hello ChatGPT",
+			Fixture:            "send_message",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedText:       "Hello! How can I assist you today?",
+			InputMsg:           []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello World"}}}},
+		},
+		{
+			Name:               "send image with prompt",
+			Fixture:            "send_message_image",
+			ExpectedStatusCode: http.StatusOK,
+			ExpectedText:       "The image is a single red pixel.",
+			InputMsg: []wire.Message{{Role: "user", Content: []wire.Content{
+				&wire.Text{Type: "text", Text: "What's in this image?"},
+				&wire.OpenAIImage{
+					Type: "image_url",
+					ImageURL: struct {
+						URL string `json:"url"`
+					}{
+						URL: redPixel,
+					},
 				},
-			},
-		}}}},
+			}}},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
+			client := newTestClient(t, test.Fixture)
+
 			rsp, err := client.SendMessage(context.Background(), test.InputMsg, test.SystemPrompt)
 			require.NoError(t, err)
 			require.Equal(t, test.ExpectedStatusCode, rsp.StatusCode)
 
-			_, err = client.ReadBody(rsp.Body)
+			completion, err := client.ReadBody(rsp.Body, nil)
 			require.NoError(t, err)
+			require.Equal(t, test.ExpectedText, completion.Text)
+			require.Equal(t, "stop", completion.StopReason)
 		})
 	}
 }
+
+func TestReadBody(t *testing.T) {
+	client := openai.NewClient("gpt-4-turbo")
+
+	stream := strings.Join([]string{
+		`data: {"id":"1","model":"gpt-4-turbo","choices":[{"index":0,"delta":{"content":"Hello"}}]}`,
+		``,
+		`data: {"id":"1","model":"gpt-4-turbo","choices":[{"index":0,"delta":{"content":" there"},"finish_reason":"stop"}]}`,
+		``,
+		`data: {"id":"1","model":"gpt-4-turbo","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":2}}`,
+		``,
+		`data: [DONE]`,
+	}, "\n")
+
+	var events []wire.Event
+	completion, err := client.ReadBody(strings.NewReader(stream), func(e wire.Event) error {
+		events = append(events, e)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "Hello there", completion.Text)
+	require.Equal(t, "stop", completion.StopReason)
+	require.Equal(t, wire.Usage{InputTokens: 9, OutputTokens: 2}, completion.Usage)
+
+	require.Len(t, events, 4)
+	require.Equal(t, wire.EventStart, events[0].Type)
+	require.Equal(t, wire.EventStop, events[3].Type)
+}
+
+func TestEmbed(t *testing.T) {
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/embeddings", r.URL.Path)
+
+		req := struct {
+			Input      []string `json:"input"`
+			Dimensions int      `json:"dimensions"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, 8, req.Dimensions)
+		batches = append(batches, len(req.Input))
+
+		type data struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		}
+		rsp := struct {
+			Model string `json:"model"`
+			Data  []data `json:"data"`
+			Usage struct {
+				PromptTokens int `json:"prompt_tokens"`
+			} `json:"usage"`
+		}{Model: "text-embedding-3-small"}
+		// Reply out of order, the client should put them back in input order
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			n, err := strconv.Atoi(req.Input[i])
+			require.NoError(t, err)
+			rsp.Data = append(rsp.Data, data{Index: i, Embedding: []float32{float32(n)}})
+		}
+		rsp.Usage.PromptTokens = len(req.Input)
+
+		require.NoError(t, json.NewEncoder(w).Encode(rsp))
+	}))
+	defer server.Close()
+
+	client := openai.NewClient("text-embedding-3-small", openai.WithBaseURL(server.URL))
+
+	var inputs []string
+	for i := 0; i < 300; i++ {
+		inputs = append(inputs, strconv.Itoa(i))
+	}
+
+	embeddings, err := client.Embed(context.Background(), inputs, 8)
+	require.NoError(t, err)
+	require.Equal(t, []int{256, 44}, batches)
+	require.Len(t, embeddings.Vectors, 300)
+	for i, vector := range embeddings.Vectors {
+		require.Equal(t, []float32{float32(i)}, vector)
+	}
+	require.Equal(t, 300, embeddings.Usage.InputTokens)
+}
+
+func TestSendMessageConvertsAnthropicContent(t *testing.T) {
+	var sent struct {
+		Messages []struct {
+			Role    string            `json:"role"`
+			Content []json.RawMessage `json:"content"`
+		} `json:"messages"`
+		MaxTokens int `json:"max_tokens"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&sent))
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer server.Close()
+
+	image := &wire.AnthropicImage{Type: "image"}
+	image.Source.Type = "base64"
+	image.Source.MediaType = "image/png"
+	image.Source.Data = "iVBORw0KGgo="
+
+	messages := []wire.Message{{Role: "user", Content: []wire.Content{
+		&wire.Text{Type: "text", Text: "Describe these", CacheControl: wire.Ephemeral()},
+		image,
+		&wire.Document{Type: "document", Source: wire.DocumentSource{Type: "text", MediaType: "text/plain", Data: "Some notes"}},
+	}}}
+
+	client := openai.NewClient("gpt-4-turbo", openai.WithBaseURL(server.URL))
+	rsp, err := client.SendMessage(context.Background(), messages, nil, wire.WithMaxTokens(100))
+	require.NoError(t, err)
+	_, err = client.ReadBody(rsp.Body, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, 100, sent.MaxTokens)
+	require.Len(t, sent.Messages, 1)
+	require.JSONEq(t, `{"type":"text","text":"Describe these"}`, string(sent.Messages[0].Content[0]))
+	require.JSONEq(t, `{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}`, string(sent.Messages[0].Content[1]))
+	require.JSONEq(t, `{"type":"text","text":"Some notes"}`, string(sent.Messages[0].Content[2]))
+
+	// PDFs can't be converted
+	pdf := []wire.Message{{Role: "user", Content: []wire.Content{
+		&wire.Document{Type: "document", Source: wire.DocumentSource{Type: "base64", MediaType: "application/pdf", Data: "JVBERi0="}},
+	}}}
+	_, err = client.SendMessage(context.Background(), pdf, nil)
+	require.Error(t, err)
+
+	// Neither can images Anthropic fetches from a URL
+	byURL := &wire.AnthropicImage{Type: "image"}
+	byURL.Source.Type = "url"
+	byURL.Source.URL = "https://example.com/cat.png"
+	_, err = client.SendMessage(context.Background(), []wire.Message{{Role: "user", Content: []wire.Content{byURL}}}, nil)
+	require.ErrorContains(t, err, "url image sources aren't supported")
+}
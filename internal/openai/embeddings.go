@@ -0,0 +1,102 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Inputs sent per embeddings request, the API accepts up to 2048
+// but a smaller batch keeps each request well under its token limit
+const embeddingBatchSize = 256
+
+// Embed returns a vector for each input, in the same order, sending them in batches
+// dimensions shortens the vectors for models that support it, zero keeps the model's default
+func (c *Client) Embed(ctx context.Context, inputs []string, dimensions int) (*wire.Embeddings, error) {
+	embeddings := &wire.Embeddings{Model: c.model, Vectors: make([][]float32, 0, len(inputs))}
+
+	for start := 0; start < len(inputs); start += embeddingBatchSize {
+		batch := inputs[start:min(start+embeddingBatchSize, len(inputs))]
+
+		rsp, err := c.embedBatch(ctx, batch, dimensions)
+		if err != nil {
+			return nil, err
+		}
+		if len(rsp.Data) != len(batch) {
+			return nil, fmt.Errorf("got %d embeddings for %d inputs", len(rsp.Data), len(batch))
+		}
+
+		vectors := make([][]float32, len(batch))
+		for _, data := range rsp.Data {
+			if data.Index < 0 || data.Index >= len(batch) {
+				return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+			}
+			vectors[data.Index] = data.Embedding
+		}
+
+		embeddings.Model = rsp.Model
+		embeddings.Vectors = append(embeddings.Vectors, vectors...)
+		embeddings.Usage.InputTokens += rsp.Usage.PromptTokens
+	}
+
+	return embeddings, nil
+}
+
+type embeddingsResponse struct {
+	Model string `json:"model"`
+	Data  []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+func (c *Client) embedBatch(ctx context.Context, inputs []string, dimensions int) (*embeddingsResponse, error) {
+	reqBody, err := json.Marshal(struct {
+		Model          string   `json:"model"`
+		Input          []string `json:"input"`
+		Dimensions     int      `json:"dimensions,omitempty"`
+		EncodingFormat string   `json:"encoding_format"`
+	}{
+		Model:          c.model,
+		Input:          inputs,
+		Dimensions:     dimensions,
+		EncodingFormat: "float",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", c.config.baseURL, "v1/embeddings"), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.apiKey))
+	}
+
+	rsp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	embeddings := &embeddingsResponse{}
+	if err := json.NewDecoder(rsp.Body).Decode(embeddings); err != nil {
+		return nil, fmt.Errorf("decoding embeddings: %w", err)
+	}
+
+	return embeddings, nil
+}
@@ -0,0 +1,24 @@
+package openai
+
+import (
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Price is shown as $USD per 1M tokens
+const (
+	GPT4_TURBO_INPUT_COST  = 10.00 / 1000000
+	GPT4_TURBO_OUTPUT_COST = 30.00 / 1000000
+)
+
+// Cost returns the price in $USD of a request to model, zero for unknown models
+func Cost(model string, usage wire.Usage) float64 {
+	var cost float64
+	switch {
+	case strings.HasPrefix(model, "gpt-4-turbo"):
+		cost = float64(usage.InputTokens)*GPT4_TURBO_INPUT_COST + float64(usage.OutputTokens)*GPT4_TURBO_OUTPUT_COST
+	}
+
+	return cost
+}
@@ -0,0 +1,207 @@
+// Package rag indexes folders of documents on disk and retrieves the chunks most relevant to a query
+package rag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/document"
+	"github.com/davidhbaek/llm/internal/logging"
+)
+
+// Embedder turns text into vectors whose distances reflect how similar their meanings are
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+	// The embedding model, an index can only be searched with the model it was built with
+	Model() string
+}
+
+type Chunk struct {
+	Source    string    `json:"source"`
+	FirstPage int       `json:"first_page"`
+	LastPage  int       `json:"last_page"`
+	Text      string    `json:"text"`
+	Vector    []float32 `json:"vector,omitempty"`
+}
+
+type Index struct {
+	Name string `json:"name"`
+	// The directory that was indexed
+	Root string `json:"root"`
+	// Empty when the index is searched with BM25 instead of embeddings
+	EmbeddingModel string `json:"embedding_model,omitempty"`
+	// Set by callers that need them to recreate the embedder for queries
+	EmbeddingDimensions int       `json:"embedding_dimensions,omitempty"`
+	EmbeddingBaseURL    string    `json:"embedding_base_url,omitempty"`
+	Created             time.Time `json:"created"`
+	Chunks              []Chunk   `json:"chunks"`
+}
+
+// Number of chunks sent to the embedder per request
+const embedBatchSize = 64
+
+// Build extracts and chunks every supported document under root
+// Chunks are embedded when an embedder is given, otherwise the index is searched with BM25
+func Build(ctx context.Context, name, root string, chunkTokens int, embedder Embedder) (*Index, error) {
+	idx := &Index{Name: name, Root: root, Created: time.Now().UTC()}
+	logger := logging.FromContext(ctx, nil)
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		doc, err := load(path)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return nil
+		}
+
+		if rel, err := filepath.Rel(root, path); err == nil {
+			doc.Source = rel
+		}
+
+		logger.Debug("indexing document", "source", doc.Source)
+		for _, chunk := range document.Split(doc, chunkTokens) {
+			idx.Chunks = append(idx.Chunks, Chunk{
+				Source:    chunk.Source,
+				FirstPage: chunk.FirstPage,
+				LastPage:  chunk.LastPage,
+				Text:      chunk.Text,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading documents: %w", err)
+	}
+
+	if embedder == nil {
+		return idx, nil
+	}
+
+	idx.EmbeddingModel = embedder.Model()
+	for start := 0; start < len(idx.Chunks); start += embedBatchSize {
+		batch := idx.Chunks[start:min(start+embedBatchSize, len(idx.Chunks))]
+		texts := make([]string, len(batch))
+		for i, chunk := range batch {
+			texts[i] = chunk.Text
+		}
+
+		vectors, err := embedder.Embed(ctx, texts)
+		if err != nil {
+			return nil, fmt.Errorf("embedding chunks: %w", err)
+		}
+		if len(vectors) != len(batch) {
+			return nil, fmt.Errorf("embedding chunks: got %d vectors for %d chunks", len(vectors), len(batch))
+		}
+
+		for i := range batch {
+			batch[i].Vector = vectors[i]
+		}
+		logger.Debug("embedded chunks", "done", start+len(batch), "total", len(idx.Chunks))
+	}
+
+	return idx, nil
+}
+
+// load extracts the text of a supported document, it returns nil for any other file
+func load(path string) (*document.Document, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pdf":
+		return document.ExtractPDF(path, nil)
+	case ".txt", ".md", ".markdown":
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return document.FromText(path, string(bytes)), nil
+	default:
+		return nil, nil
+	}
+}
+
+var ErrNotFound = errors.New("index not found")
+
+// Dir is where indexes are stored, LLM_INDEX_DIR overrides the default in the user's cache directory
+func Dir() (string, error) {
+	if dir := os.Getenv("LLM_INDEX_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "llm", "index"), nil
+}
+
+func indexPath(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("invalid index name: %q", name)
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".json"), nil
+}
+
+// Save writes the index to disk, replacing any index with the same name
+func (idx *Index) Save() error {
+	path, err := indexPath(idx.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed write doesn't corrupt the existing index
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bytes, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func Load(name string) (*Index, error) {
+	path, err := indexPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	if err := json.Unmarshal(bytes, idx); err != nil {
+		return nil, fmt.Errorf("decoding index %s: %w", name, err)
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,89 @@
+package rag_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/rag"
+	"github.com/stretchr/testify/require"
+)
+
+func writeDocs(t *testing.T, docs map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range docs {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(text), 0o644))
+	}
+	return dir
+}
+
+func TestBuildAndSearch(t *testing.T) {
+	t.Setenv("LLM_INDEX_DIR", t.TempDir())
+
+	dir := writeDocs(t, map[string]string{
+		"pets/cats.txt":  "Cats are small carnivorous mammals. Cats sleep most of the day.",
+		"pets/dogs.md":   "Dogs are loyal companions and love to play fetch.",
+		"finance.txt":    "The quarterly revenue grew by twelve percent.",
+		"ignored.go":     "package cats",
+		"notes/empty.md": "",
+	})
+
+	idx, err := rag.Build(context.Background(), "test", dir, 100, nil)
+	require.NoError(t, err)
+	require.Len(t, idx.Chunks, 3)
+	require.NoError(t, idx.Save())
+
+	loaded, err := rag.Load("test")
+	require.NoError(t, err)
+	require.Equal(t, idx.Chunks, loaded.Chunks)
+
+	results, err := loaded.Search(context.Background(), "how do cats sleep?", 2, nil)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, filepath.Join("pets", "cats.txt"), results[0].Chunk.Source)
+
+	_, err = rag.Load("missing")
+	require.ErrorIs(t, err, rag.ErrNotFound)
+}
+
+// letterEmbedder embeds text as the counts of a few letters
+type letterEmbedder struct{}
+
+func (letterEmbedder) Model() string { return "letters" }
+
+func (letterEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	var vectors [][]float32
+	for _, text := range texts {
+		vectors = append(vectors, []float32{
+			float32(strings.Count(text, "x")),
+			float32(strings.Count(text, "y")),
+			float32(strings.Count(text, "z")),
+		})
+	}
+	return vectors, nil
+}
+
+func TestSearchEmbeddings(t *testing.T) {
+	dir := writeDocs(t, map[string]string{
+		"x.txt": "xxxx y",
+		"y.txt": "yyyy z",
+		"z.txt": "zzzz x",
+	})
+
+	idx, err := rag.Build(context.Background(), "test", dir, 100, letterEmbedder{})
+	require.NoError(t, err)
+	require.Equal(t, "letters", idx.EmbeddingModel)
+
+	results, err := idx.Search(context.Background(), "yy", 2, letterEmbedder{})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "y.txt", results[0].Chunk.Source)
+
+	_, err = idx.Search(context.Background(), "yy", 2, nil)
+	require.Error(t, err)
+}
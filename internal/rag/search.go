@@ -0,0 +1,154 @@
+package rag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type Result struct {
+	Chunk Chunk
+	Score float64
+}
+
+// Search returns the k chunks most relevant to query, best first
+// Indexes built with embeddings need an embedder for the same model to embed the query
+func (idx *Index) Search(ctx context.Context, query string, k int, embedder Embedder) ([]Result, error) {
+	var results []Result
+	if idx.EmbeddingModel == "" {
+		results = bm25(idx.Chunks, query)
+	} else {
+		if embedder == nil {
+			return nil, fmt.Errorf("index %s was built with embedding model %s, an embedder for it is needed to search", idx.Name, idx.EmbeddingModel)
+		}
+		if embedder.Model() != idx.EmbeddingModel {
+			return nil, fmt.Errorf("index %s was built with embedding model %s, not %s", idx.Name, idx.EmbeddingModel, embedder.Model())
+		}
+
+		vectors, err := embedder.Embed(ctx, []string{query})
+		if err != nil {
+			return nil, fmt.Errorf("embedding query: %w", err)
+		}
+		if len(vectors) != 1 {
+			return nil, errors.New("embedding query: no vector returned")
+		}
+
+		for _, chunk := range idx.Chunks {
+			results = append(results, Result{Chunk: chunk, Score: cosine(vectors[0], chunk.Vector)})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+
+	return results, nil
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// BM25 parameters, the usual defaults
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// bm25 scores each chunk by how often it contains the query's terms, weighting rare terms higher
+// Chunks that share no terms with the query are left out
+func bm25(chunks []Chunk, query string) []Result {
+	docs := make([]map[string]int, len(chunks))
+	docFreq := map[string]int{}
+	var totalLen int
+	for i, chunk := range chunks {
+		docs[i] = map[string]int{}
+		for _, term := range terms(chunk.Text) {
+			if docs[i][term] == 0 {
+				docFreq[term]++
+			}
+			docs[i][term]++
+			totalLen++
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	avgLen := float64(totalLen) / float64(len(chunks))
+
+	queryTerms := map[string]bool{}
+	for _, term := range terms(query) {
+		queryTerms[term] = true
+	}
+
+	var results []Result
+	n := float64(len(chunks))
+	for i, doc := range docs {
+		var docLen int
+		for _, count := range doc {
+			docLen += count
+		}
+
+		var score float64
+		for term := range queryTerms {
+			tf := float64(doc[term])
+			if tf == 0 {
+				continue
+			}
+
+			df := float64(docFreq[term])
+			idf := math.Log((n-df+0.5)/(df+0.5) + 1)
+			score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(docLen)/avgLen))
+		}
+
+		if score > 0 {
+			results = append(results, Result{Chunk: chunks[i], Score: score})
+		}
+	}
+
+	return results
+}
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "has": true, "in": true, "is": true, "it": true, "of": true, "on": true,
+	"or": true, "that": true, "the": true, "this": true, "to": true, "was": true, "what": true,
+	"were": true, "which": true, "who": true, "with": true, "how": true, "does": true, "do": true,
+}
+
+// terms splits text into lowercase words, leaving out stop words
+func terms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	var terms []string
+	for _, word := range words {
+		if !stopWords[word] {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
@@ -0,0 +1,416 @@
+// Package ratelimit keeps requests to LLM providers within their rate limits, so batch and fan-out
+// work waits its turn instead of failing with 429s
+//
+// Each model has budgets for requests, input tokens and output tokens per minute, and a maximum
+// number of requests in flight. Providers can have budgets too, shared by all their models.
+// Budgets refill continuously like the providers' own token buckets, and are corrected by the
+// anthropic-ratelimit-* and x-ratelimit-* headers of every response. Headers describe the model
+// that responded, so a provider's budgets are only lowered by them when they were set
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Limits are the budgets for a model or a provider, zero is unlimited
+type Limits struct {
+	RequestsPerMinute     int
+	InputTokensPerMinute  int
+	OutputTokensPerMinute int
+	MaxInFlight           int
+}
+
+type Config struct {
+	// Limits shared by every model of a provider, by the provider's name
+	Providers map[string]Limits
+	// Limits of each model, by the model's name
+	Models map[string]Limits
+	// Limits of models that aren't in Models
+	Default Limits
+	// Used when a request's context doesn't carry a logger, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// bucket holds a budget per minute that refills continuously up to the limit
+// It can go negative when a request uses more than it reserved
+type bucket struct {
+	// Per minute, zero is unlimited
+	limit     float64
+	available float64
+	updated   time.Time
+}
+
+func newBucket(limit int, now time.Time) bucket {
+	return bucket{limit: float64(limit), available: float64(limit), updated: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if b.limit > 0 {
+		b.available = min(b.limit, b.available+now.Sub(b.updated).Minutes()*b.limit)
+	}
+	b.updated = now
+}
+
+// wait is how long until n are available
+func (b *bucket) wait(n float64) time.Duration {
+	if b.limit == 0 || b.available >= n {
+		return 0
+	}
+	return time.Duration((n - b.available) / b.limit * float64(time.Minute))
+}
+
+func (b *bucket) take(n float64) {
+	if b.limit > 0 {
+		b.available -= n
+	}
+}
+
+// Limiter enforces the limits of one model or provider
+type Limiter struct {
+	name   string
+	logger *slog.Logger
+	// Shared by several models, whose responses only adapt the budgets set for it
+	shared bool
+
+	mu           sync.Mutex
+	maxInFlight  int
+	inFlight     int
+	requests     bucket
+	inputTokens  bucket
+	outputTokens bucket
+	// Nothing is sent before this, set when the provider says a limit is exhausted
+	pausedUntil time.Time
+	// Closed and replaced whenever a request finishes, to wake requests waiting for a slot
+	done chan struct{}
+}
+
+func NewLimiter(name string, limits Limits) *Limiter {
+	now := time.Now()
+	return &Limiter{
+		name:         name,
+		maxInFlight:  limits.MaxInFlight,
+		requests:     newBucket(limits.RequestsPerMinute, now),
+		inputTokens:  newBucket(limits.InputTokensPerMinute, now),
+		outputTokens: newBucket(limits.OutputTokensPerMinute, now),
+		done:         make(chan struct{}),
+	}
+}
+
+// Wait blocks until a request with about inputTokens of input can be sent, then reserves it
+// It returns the input tokens reserved, which must be given back with Done once the response is read
+func (l *Limiter) Wait(ctx context.Context, inputTokens int) (int, error) {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.requests.refill(now)
+		l.inputTokens.refill(now)
+		l.outputTokens.refill(now)
+
+		// A request bigger than the whole budget would never be sent otherwise
+		input := inputTokens
+		if l.inputTokens.limit > 0 {
+			input = min(input, int(l.inputTokens.limit))
+		}
+
+		// Output isn't known until the response is read, so a request only waits for the budget to be out of debt
+		delay := max(l.pausedUntil.Sub(now), l.requests.wait(1), l.inputTokens.wait(float64(input)), l.outputTokens.wait(1))
+		full := l.maxInFlight > 0 && l.inFlight >= l.maxInFlight
+		if delay <= 0 && !full {
+			l.requests.take(1)
+			l.inputTokens.take(float64(input))
+			l.inFlight++
+			l.mu.Unlock()
+			return input, nil
+		}
+
+		done := l.done
+		l.mu.Unlock()
+
+		// Requests waiting only for a slot wake when one is freed
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if delay > 0 {
+			logging.FromContext(ctx, l.logger).Info("waiting for rate limit", "limiter", l.name, "delay", delay.Round(time.Millisecond))
+			timer = time.NewTimer(delay)
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, fmt.Errorf("waiting for %s rate limit: %w", l.name, ctx.Err())
+		case <-expired:
+		case <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+// Done frees a request's slot and charges its actual usage in place of the reserved input tokens Wait returned
+// When usage is nil, because it's unknown, the reservation stays charged as the request's input
+func (l *Limiter) Done(reserved int, usage *wire.Usage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if usage != nil {
+		l.inputTokens.take(float64(usage.InputTokens - reserved))
+		l.outputTokens.take(float64(usage.OutputTokens))
+	}
+
+	l.inFlight--
+	close(l.done)
+	l.done = make(chan struct{})
+}
+
+// Observe adapts the limiter to the rate limit headers of a provider's response
+// Limits the provider reports are used for budgets that weren't set, or that are higher,
+// and a budget the provider says is exhausted pauses requests until it resets
+// The headers describe the model that responded, so a provider's limiter only lowers the budgets set for it
+func (l *Limiter) Observe(statusCode int, header http.Header) {
+	if header == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, h := range []struct {
+		bucket                  *bucket
+		limit, remaining, reset string
+	}{
+		{&l.requests, "anthropic-ratelimit-requests-limit", "anthropic-ratelimit-requests-remaining", "anthropic-ratelimit-requests-reset"},
+		{&l.inputTokens, "anthropic-ratelimit-input-tokens-limit", "anthropic-ratelimit-input-tokens-remaining", "anthropic-ratelimit-input-tokens-reset"},
+		{&l.outputTokens, "anthropic-ratelimit-output-tokens-limit", "anthropic-ratelimit-output-tokens-remaining", "anthropic-ratelimit-output-tokens-reset"},
+		{&l.requests, "x-ratelimit-limit-requests", "x-ratelimit-remaining-requests", "x-ratelimit-reset-requests"},
+		// OpenAI's token limit counts input and output together, input is most of it
+		{&l.inputTokens, "x-ratelimit-limit-tokens", "x-ratelimit-remaining-tokens", "x-ratelimit-reset-tokens"},
+	} {
+		h.bucket.refill(now)
+		if l.shared && h.bucket.limit == 0 {
+			continue
+		}
+
+		if limit, err := strconv.Atoi(header.Get(h.limit)); err == nil && limit > 0 && !l.shared {
+			if h.bucket.limit == 0 {
+				h.bucket.available = float64(limit)
+			}
+			if h.bucket.limit == 0 || float64(limit) < h.bucket.limit {
+				h.bucket.limit = float64(limit)
+			}
+		}
+
+		remaining, err := strconv.Atoi(header.Get(h.remaining))
+		if err != nil {
+			continue
+		}
+		// Other clients share the provider's budget, so it only ever lowers ours
+		if h.bucket.limit > 0 {
+			h.bucket.available = min(h.bucket.available, float64(remaining))
+		}
+		if reset, ok := parseReset(header.Get(h.reset), now); ok && remaining == 0 && reset.After(l.pausedUntil) {
+			l.pausedUntil = reset
+		}
+	}
+
+	if statusCode == http.StatusTooManyRequests && !l.shared {
+		if seconds, err := strconv.Atoi(header.Get("retry-after")); err == nil {
+			if until := now.Add(time.Duration(seconds) * time.Second); until.After(l.pausedUntil) {
+				l.pausedUntil = until
+			}
+		}
+	}
+}
+
+// parseReset reads when a limit resets, Anthropic sends a time and OpenAI a duration like 6m0s
+func parseReset(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), true
+	}
+	return time.Time{}, false
+}
+
+// Registry hands out the limiters for each provider and model, so every client of a model shares one
+type Registry struct {
+	config Config
+
+	mu        sync.Mutex
+	providers map[string]*Limiter
+	models    map[string]*Limiter
+}
+
+func NewRegistry(config Config) *Registry {
+	return &Registry{config: config, providers: map[string]*Limiter{}, models: map[string]*Limiter{}}
+}
+
+func (r *Registry) limiters(provider, model string) (*Limiter, *Limiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.providers[provider] == nil {
+		r.providers[provider] = NewLimiter(provider, r.config.Providers[provider])
+		r.providers[provider].logger = r.config.Logger
+		r.providers[provider].shared = true
+	}
+	if r.models[model] == nil {
+		limits, ok := r.config.Models[model]
+		if !ok {
+			limits = r.config.Default
+		}
+		r.models[model] = NewLimiter(model, limits)
+		r.models[model].logger = r.config.Logger
+	}
+
+	return r.providers[provider], r.models[model]
+}
+
+// Client is the llm.Client being limited
+type Client interface {
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error)
+	Model() string
+}
+
+// LimitedClient waits for its provider's and model's limits before every request
+type LimitedClient struct {
+	client   Client
+	provider *Limiter
+	model    *Limiter
+}
+
+// Wrap limits client with the limiters of its provider and model
+func (r *Registry) Wrap(provider string, client Client) *LimitedClient {
+	p, m := r.limiters(provider, client.Model())
+	return &LimitedClient{client: client, provider: p, model: m}
+}
+
+// Middleware limits clients of the provider's models
+func (r *Registry) Middleware(provider string) middleware.Middleware {
+	return func(next middleware.Client) middleware.Client {
+		return r.Wrap(provider, next)
+	}
+}
+
+func (c *LimitedClient) Model() string {
+	return c.client.Model()
+}
+
+func (c *LimitedClient) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return c.client.CountTokens(ctx, messages, system)
+}
+
+// limitedBody is the body of a response that holds its limiters' slots until it's read or closed
+type limitedBody struct {
+	io.Reader
+	once sync.Once
+	done func(*wire.Usage)
+}
+
+func (b *limitedBody) finish(usage *wire.Usage) {
+	b.once.Do(func() { b.done(usage) })
+}
+
+func (b *limitedBody) Close() error {
+	b.finish(nil)
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *LimitedClient) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	tokens := estimateTokens(messages, system)
+
+	// The model is waited for first so a request doesn't hold a provider slot while its model is busy
+	// Each limiter caps the reservation at its own budget, so each is given back what it reserved
+	modelReserved, err := c.model.Wait(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	providerReserved, err := c.provider.Wait(ctx, tokens)
+	if err != nil {
+		// Nothing was sent, so the model's reservation is given back
+		c.model.Done(modelReserved, &wire.Usage{})
+		return nil, err
+	}
+	done := func(usage *wire.Usage) {
+		c.provider.Done(providerReserved, usage)
+		c.model.Done(modelReserved, usage)
+	}
+
+	rsp, err := c.client.SendMessage(ctx, messages, system, opts...)
+	if err != nil {
+		done(nil)
+		return nil, err
+	}
+
+	c.provider.Observe(rsp.StatusCode, rsp.Header)
+	c.model.Observe(rsp.StatusCode, rsp.Header)
+	if rsp.StatusCode != http.StatusOK {
+		done(nil)
+		return rsp, nil
+	}
+
+	return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: &limitedBody{Reader: rsp.Body, done: done}}, nil
+}
+
+// ReadBody reads the response, then frees its slot and charges its tokens to the budgets
+func (c *LimitedClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	b, ok := body.(*limitedBody)
+	if !ok {
+		return c.client.ReadBody(body, handler)
+	}
+
+	completion, err := c.client.ReadBody(b.Reader, handler)
+	// Streams that fail before reporting usage only free their slot, the input tokens Wait reserved stay charged
+	if completion != nil && completion.Usage != (wire.Usage{}) {
+		b.finish(&completion.Usage)
+	} else {
+		b.finish(nil)
+	}
+	return completion, err
+}
+
+// estimateTokens approximates a request's input tokens from its text, the real count is charged once it's known
+func estimateTokens(messages []wire.Message, system []wire.Text) int {
+	var tokens int
+	for _, block := range system {
+		tokens += tokenizer.Estimate(block.Text)
+	}
+	for _, msg := range messages {
+		for _, content := range msg.Content {
+			switch c := content.(type) {
+			case *wire.Text:
+				tokens += tokenizer.Estimate(c.Text)
+			case *wire.Document:
+				if c.Source.Type == "text" {
+					tokens += tokenizer.Estimate(c.Source.Data)
+				}
+			}
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,237 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/ratelimit"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func userMessage(text string) []wire.Message {
+	return []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: text}}}}
+}
+
+// send sends a request and reads its whole response, waiting no longer than timeout
+func send(client *ratelimit.LimitedClient, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rsp, err := client.SendMessage(ctx, userMessage("Hello there"), nil)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+	_, err = client.ReadBody(rsp.Body, nil)
+	return err
+}
+
+func TestBudgets(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ratelimit.Limits
+		// Requests sent before the budget runs out
+		allowed int
+	}{
+		{name: "requests per minute", limits: ratelimit.Limits{RequestsPerMinute: 3}, allowed: 3},
+		// Each request is about 3 input tokens
+		{name: "input tokens per minute", limits: ratelimit.Limits{InputTokensPerMinute: 9}, allowed: 3},
+		// Each response is about 10 output tokens, a request is sent as long as the budget isn't spent
+		{name: "output tokens per minute", limits: ratelimit.Limits{OutputTokensPerMinute: 25}, allowed: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := ratelimit.NewRegistry(ratelimit.Config{Default: tt.limits})
+			inner := fake.NewClient("fake:a reply that is about forty characters")
+			client := registry.Wrap("fake", inner)
+
+			for i := 0; i < tt.allowed; i++ {
+				require.NoError(t, send(client, time.Second))
+			}
+
+			err := send(client, 50*time.Millisecond)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.Len(t, inner.Calls(), tt.allowed)
+		})
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	registry := ratelimit.NewRegistry(ratelimit.Config{
+		Providers: map[string]ratelimit.Limits{"fake": {MaxInFlight: 3}},
+		Models:    map[string]ratelimit.Limits{"fake:one": {MaxInFlight: 2}},
+	})
+	clients := []*ratelimit.LimitedClient{
+		registry.Wrap("fake", fake.NewClient("fake:one", fake.WithDelay(5*time.Millisecond))),
+		registry.Wrap("fake", fake.NewClient("fake:two", fake.WithDelay(5*time.Millisecond))),
+	}
+
+	var mu sync.Mutex
+	inFlight := map[string]int{}
+	peak := map[string]int{}
+	track := func(model string, delta int) {
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight[model] += delta
+		inFlight["all"] += delta
+		peak[model] = max(peak[model], inFlight[model])
+		peak["all"] = max(peak["all"], inFlight["all"])
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		client := clients[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rsp, err := client.SendMessage(context.Background(), userMessage("hi"), nil)
+			require.NoError(t, err)
+			track(client.Model(), 1)
+			// Stop counting before the slot is freed at the end of the stream
+			_, err = client.ReadBody(rsp.Body, func(event wire.Event) error {
+				if event.Type == wire.EventStop {
+					track(client.Model(), -1)
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 2, peak["fake:one"])
+	require.Equal(t, 3, peak["all"])
+}
+
+func TestAdaptsToHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		// How long the next request is held back
+		pause time.Duration
+	}{
+		{
+			name:   "anthropic",
+			status: http.StatusOK,
+			header: http.Header{
+				"Anthropic-Ratelimit-Requests-Limit":     {"50"},
+				"Anthropic-Ratelimit-Requests-Remaining": {"0"},
+				"Anthropic-Ratelimit-Requests-Reset":     {time.Now().Add(2 * time.Second).UTC().Format(time.RFC3339)},
+			},
+			pause: time.Second,
+		},
+		{
+			name:   "openai",
+			status: http.StatusOK,
+			header: http.Header{
+				"X-Ratelimit-Limit-Tokens":     {"10000"},
+				"X-Ratelimit-Remaining-Tokens": {"0"},
+				"X-Ratelimit-Reset-Tokens":     {"200ms"},
+			},
+			pause: 200 * time.Millisecond,
+		},
+		{
+			name:   "retry after",
+			status: http.StatusTooManyRequests,
+			header: http.Header{"Retry-After": {"1"}},
+			pause:  time.Second,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := fake.NewClient(fake.Echo, fake.WithResponses(
+				fake.Response{Text: "limited", StatusCode: tt.status, Header: tt.header},
+				fake.Response{Text: "ok"},
+			))
+			client := ratelimit.NewRegistry(ratelimit.Config{}).Wrap("fake", inner)
+
+			err := send(client, time.Second)
+			if tt.status != http.StatusOK {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			err = send(client, tt.pause/4)
+			require.ErrorIs(t, err, context.DeadlineExceeded)
+			require.Len(t, inner.Calls(), 1)
+		})
+	}
+}
+
+func TestProviderAdaptsToHeaders(t *testing.T) {
+	exhausted := http.Header{
+		"Anthropic-Ratelimit-Requests-Limit":     {"50"},
+		"Anthropic-Ratelimit-Requests-Remaining": {"0"},
+		"Anthropic-Ratelimit-Requests-Reset":     {time.Now().Add(2 * time.Second).UTC().Format(time.RFC3339)},
+	}
+
+	tests := []struct {
+		name     string
+		provider ratelimit.Limits
+		// Whether the provider's other models wait too
+		paused bool
+	}{
+		{name: "provider budget", provider: ratelimit.Limits{RequestsPerMinute: 1000}, paused: true},
+		// The headers are about one model, they don't become a limit for all of them
+		{name: "no provider budget", paused: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := ratelimit.NewRegistry(ratelimit.Config{Providers: map[string]ratelimit.Limits{"fake": tt.provider}})
+			first := registry.Wrap("fake", fake.NewClient("fake:first", fake.WithResponses(fake.Response{Text: "limited", Header: exhausted})))
+			second := registry.Wrap("fake", fake.NewClient("fake:second"))
+
+			require.NoError(t, send(first, time.Second))
+
+			err := send(second, 250*time.Millisecond)
+			if tt.paused {
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestClosingFreesSlot(t *testing.T) {
+	registry := ratelimit.NewRegistry(ratelimit.Config{Default: ratelimit.Limits{MaxInFlight: 1}})
+	client := registry.Wrap("fake", fake.NewClient(fake.Echo))
+
+	rsp, err := client.SendMessage(context.Background(), userMessage("hi"), nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, send(client, 20*time.Millisecond), context.DeadlineExceeded)
+
+	closer, ok := rsp.Body.(interface{ Close() error })
+	require.True(t, ok)
+	require.NoError(t, closer.Close())
+	require.NoError(t, send(client, time.Second))
+}
+
+func TestOversizedRequest(t *testing.T) {
+	limiter := ratelimit.NewLimiter("test", ratelimit.Limits{InputTokensPerMinute: 6000})
+
+	// Only the whole budget is reserved, or the request would never be sent
+	reserved, err := limiter.Wait(context.Background(), 12000)
+	require.NoError(t, err)
+	require.Equal(t, 6000, reserved)
+
+	// Charging what was used leaves the budget owing the tokens it couldn't reserve
+	limiter.Done(reserved, &wire.Usage{InputTokens: 12000})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = limiter.Wait(ctx, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,224 @@
+// Package replay records HTTP exchanges with provider APIs to fixture files and replays them
+// so client tests run offline, without API keys
+//
+// Fixtures are JSON files holding every exchange in order. Response bodies are stored as a
+// list of lines to keep streamed SSE responses readable and easy to edit by hand.
+// Request headers aren't stored so API keys never end up in a fixture
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Exchange is a request and the response the API sent back
+type Exchange struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Left out for requests without a body
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type Response struct {
+	StatusCode  int      `json:"status_code"`
+	ContentType string   `json:"content_type,omitempty"`
+	Body        []string `json:"body"`
+}
+
+// Transport is an http.RoundTripper that answers requests from a fixture file
+// When recording, requests are sent to the real API and the fixture is written by Save
+type Transport struct {
+	path   string
+	record bool
+	// Sends requests while recording, http.DefaultTransport when nil
+	Base http.RoundTripper
+
+	mu        sync.Mutex
+	exchanges []Exchange
+	next      int
+	loaded    bool
+}
+
+var _ http.RoundTripper = &Transport{}
+
+// ErrNoFixture is returned when replaying a request that wasn't recorded
+var ErrNoFixture = errors.New("no recorded response")
+
+func NewTransport(path string, record bool) *Transport {
+	return &Transport{path: path, record: record}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.record {
+		return t.forward(req, recorded)
+	}
+
+	if !t.loaded {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Exchanges are replayed in the order they were recorded
+	if t.next >= len(t.exchanges) {
+		return nil, fmt.Errorf("%w: %s %s is request %d in %s, which only has %d", ErrNoFixture, recorded.Method, recorded.Path, t.next+1, t.path, len(t.exchanges))
+	}
+
+	exchange := t.exchanges[t.next]
+	if !exchange.Request.matches(recorded) {
+		return nil, fmt.Errorf("%w: %s %s doesn't match request %d in %s, record the fixture again if the request changed on purpose", ErrNoFixture, recorded.Method, recorded.Path, t.next+1, t.path)
+	}
+	t.next++
+
+	return exchange.Response.toHTTP(req), nil
+}
+
+// Save writes the recorded exchanges to the fixture file, it does nothing when replaying
+func (t *Transport) Save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.record {
+		return nil
+	}
+
+	bytes, err := json.MarshalIndent(t.exchanges, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, append(bytes, '\n'), 0o644)
+}
+
+func (t *Transport) load() error {
+	bytes, err := os.ReadFile(t.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: fixture %s doesn't exist, record it first", ErrNoFixture, t.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bytes, &t.exchanges); err != nil {
+		return fmt.Errorf("decoding fixture %s: %w", t.path, err)
+	}
+	t.loaded = true
+
+	return nil
+}
+
+// forward sends the request to the real API and records the whole response
+func (t *Transport) forward(req *http.Request, recorded Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	rsp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response to record: %w", err)
+	}
+
+	response := Response{
+		StatusCode:  rsp.StatusCode,
+		ContentType: rsp.Header.Get("Content-Type"),
+		Body:        strings.Split(string(body), "\n"),
+	}
+	t.exchanges = append(t.exchanges, Exchange{Request: recorded, Response: response})
+
+	return response.toHTTP(req), nil
+}
+
+func readRequest(req *http.Request) (Request, error) {
+	recorded := Request{Method: req.Method, Path: req.URL.Path}
+	if req.Body == nil {
+		return recorded, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return recorded, fmt.Errorf("reading request to record: %w", err)
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(body) > 0 {
+		// Indented so the request reads well in the fixture
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, body, "", "  "); err != nil {
+			return recorded, fmt.Errorf("request body isn't JSON: %w", err)
+		}
+		recorded.Body = indented.Bytes()
+	}
+
+	return recorded, nil
+}
+
+// matches compares requests ignoring the formatting of their JSON bodies
+func (r Request) matches(other Request) bool {
+	if r.Method != other.Method || r.Path != other.Path {
+		return false
+	}
+
+	var a, b bytes.Buffer
+	if len(r.Body) > 0 {
+		if err := json.Compact(&a, r.Body); err != nil {
+			return false
+		}
+	}
+	if len(other.Body) > 0 {
+		if err := json.Compact(&b, other.Body); err != nil {
+			return false
+		}
+	}
+
+	return bytes.Equal(a.Bytes(), b.Bytes())
+}
+
+func (r Response) toHTTP(req *http.Request) *http.Response {
+	header := http.Header{}
+	if r.ContentType != "" {
+		header.Set("Content-Type", r.ContentType)
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode: r.StatusCode,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(strings.Join(r.Body, "\n"))),
+		Request:    req,
+	}
+}
@@ -0,0 +1,71 @@
+package replay_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/replay"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "event: echo\ndata: %s\n\n", body)
+	}))
+	defer server.Close()
+
+	fixture := filepath.Join(t.TempDir(), "echo.json")
+	send := func(transport *replay.Transport, body string) (int, string, error) {
+		client := &http.Client{Transport: transport}
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/v1/echo", strings.NewReader(body))
+		require.NoError(t, err)
+		// Headers like API keys aren't recorded
+		req.Header.Set("x-api-key", "secret")
+
+		rsp, err := client.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer rsp.Body.Close()
+
+		read, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		return rsp.StatusCode, string(read), nil
+	}
+
+	recorder := replay.NewTransport(fixture, true)
+	status, body, err := send(recorder, `{"text":"hello"}`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, recorder.Save())
+
+	saved, err := os.ReadFile(fixture)
+	require.NoError(t, err)
+	require.NotContains(t, string(saved), "secret")
+
+	// The server isn't needed to replay
+	server.Close()
+
+	replayer := replay.NewTransport(fixture, false)
+	status, replayed, err := send(replayer, `{ "text": "hello" }`)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, body, replayed)
+
+	// Every recorded exchange has been used
+	_, _, err = send(replayer, `{"text":"hello"}`)
+	require.ErrorIs(t, err, replay.ErrNoFixture)
+
+	// A different request doesn't match the recording
+	_, _, err = send(replay.NewTransport(fixture, false), `{"text":"goodbye"}`)
+	require.ErrorIs(t, err, replay.ErrNoFixture)
+}
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// messagesRequest is the body of an Anthropic Messages API request, fields we don't support are ignored
+type messagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	System        systemPrompt    `json:"system"`
+	Messages      []messageParam  `json:"messages"`
+	Stream        bool            `json:"stream"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	StopSequences []string        `json:"stop_sequences"`
+	Tools         json.RawMessage `json:"tools"`
+}
+
+// systemPrompt is either a string or a list of text blocks
+type systemPrompt []wire.Text
+
+func (s *systemPrompt) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*s = wire.SystemPrompt(text)
+		return nil
+	}
+	return json.Unmarshal(data, (*[]wire.Text)(s))
+}
+
+type messageParam struct {
+	Role    string        `json:"role"`
+	Content contentBlocks `json:"content"`
+}
+
+// contentBlocks is either a string or a list of text, image and document blocks
+type contentBlocks []wire.Content
+
+func (c *contentBlocks) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = contentBlocks{&wire.Text{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []json.RawMessage
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return errors.New("content must be a string or a list of content blocks")
+	}
+
+	for _, raw := range blocks {
+		block := struct {
+			Type   string `json:"type"`
+			Source struct {
+				Type string `json:"type"`
+				URL  string `json:"url"`
+			} `json:"source"`
+		}{}
+		if err := json.Unmarshal(raw, &block); err != nil {
+			return err
+		}
+
+		var content wire.Content
+		switch {
+		case block.Type == "text":
+			content = &wire.Text{}
+		case block.Type == "image" && block.Source.Type == "url":
+			// Passed on for Anthropic to fetch, the server never downloads or reads images for callers
+			if !strings.HasPrefix(block.Source.URL, "https://") {
+				return errors.New("image URLs must be https URLs")
+			}
+			content = &wire.AnthropicImage{}
+		case block.Type == "image" && block.Source.Type == "base64":
+			content = &wire.AnthropicImage{}
+		case block.Type == "document" && (block.Source.Type == "base64" || block.Source.Type == "text"):
+			content = &wire.Document{}
+		default:
+			return fmt.Errorf("unsupported content block: %q with source %q", block.Type, block.Source.Type)
+		}
+
+		if err := json.Unmarshal(raw, content); err != nil {
+			return err
+		}
+		*c = append(*c, content)
+	}
+
+	return nil
+}
+
+func (req *messagesRequest) toWire() ([]wire.Message, error) {
+	if len(req.Tools) > 0 && string(req.Tools) != "null" {
+		return nil, errors.New("tools aren't supported")
+	}
+
+	var messages []wire.Message
+	for _, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("unsupported message role: %q", msg.Role)
+		}
+		messages = append(messages, wire.Message{Role: msg.Role, Content: msg.Content})
+	}
+
+	if len(messages) == 0 {
+		return nil, errors.New("messages must include at least one user message")
+	}
+
+	return messages, nil
+}
+
+func (req *messagesRequest) options() []wire.Option {
+	var opts []wire.Option
+	if req.MaxTokens > 0 {
+		opts = append(opts, wire.WithMaxTokens(req.MaxTokens))
+	}
+	if req.Temperature != nil {
+		opts = append(opts, wire.WithTemperature(*req.Temperature))
+	}
+	if req.TopP != nil {
+		opts = append(opts, wire.WithTopP(*req.TopP))
+	}
+	if len(req.StopSequences) > 0 {
+		opts = append(opts, wire.WithStop(req.StopSequences...))
+	}
+	return opts
+}
+
+// textBlock is a block of text in a response, citations are only set for models that cite documents
+type textBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	Citations []wire.Citation `json:"citations,omitempty"`
+}
+
+type message struct {
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Role         string      `json:"role"`
+	Model        string      `json:"model"`
+	Content      []textBlock `json:"content"`
+	StopReason   *string     `json:"stop_reason"`
+	StopSequence *string     `json:"stop_sequence"`
+	Usage        wire.Usage  `json:"usage"`
+}
+
+// stopReason maps a provider's stop reason to Anthropic's
+func stopReason(reason string) *string {
+	switch reason {
+	case "stop", "":
+		reason = "end_turn"
+	case "length":
+		reason = "max_tokens"
+	}
+	return &reason
+}
+
+// messageWriter turns the events of a response into Anthropic content blocks
+// When streaming, each one is written to the client as the matching Anthropic event
+type messageWriter struct {
+	w      http.ResponseWriter
+	stream bool
+
+	msg message
+	// The block text is being added to, nil between blocks
+	block *textBlock
+	err   error
+}
+
+func (m *messageWriter) onEvent(event wire.Event) error {
+	switch event.Type {
+	case wire.EventStart:
+		if event.Usage != nil {
+			m.msg.Usage = *event.Usage
+		}
+		start := m.msg
+		start.Content = []textBlock{}
+		m.write("message_start", map[string]any{"type": "message_start", "message": start})
+	case wire.EventText:
+		// Text after a block's citations starts a new block
+		if m.block != nil && len(m.block.Citations) > 0 {
+			m.endBlock()
+		}
+		if m.block == nil {
+			m.msg.Content = append(m.msg.Content, textBlock{Type: "text"})
+			m.block = &m.msg.Content[len(m.msg.Content)-1]
+			m.write("content_block_start", map[string]any{"type": "content_block_start", "index": len(m.msg.Content) - 1, "content_block": textBlock{Type: "text"}})
+		}
+		m.block.Text += event.Text
+		m.write("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": len(m.msg.Content) - 1,
+			"delta": map[string]string{"type": "text_delta", "text": event.Text},
+		})
+	case wire.EventCitation:
+		// All of a block's citations come after its text, the block stays open for them
+		// until more text or the end of the message
+		if m.block == nil || event.Citation == nil {
+			return m.err
+		}
+		m.block.Citations = append(m.block.Citations, *event.Citation)
+		m.write("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": len(m.msg.Content) - 1,
+			"delta": map[string]any{"type": "citations_delta", "citation": event.Citation},
+		})
+	case wire.EventStop:
+		m.endBlock()
+		m.msg.StopReason = stopReason(event.StopReason)
+		if event.Usage != nil {
+			m.msg.Usage = *event.Usage
+		}
+		m.write("message_delta", map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{"stop_reason": m.msg.StopReason, "stop_sequence": nil},
+			"usage": m.msg.Usage,
+		})
+	}
+
+	return m.err
+}
+
+func (m *messageWriter) endBlock() {
+	if m.block == nil {
+		return
+	}
+	m.write("content_block_stop", map[string]any{"type": "content_block_stop", "index": len(m.msg.Content) - 1})
+	m.block = nil
+}
+
+// write sends a server-sent event when streaming, the first error stops the stream
+func (m *messageWriter) write(event string, data any) {
+	if !m.stream || m.err != nil {
+		return
+	}
+
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		m.err = err
+		return
+	}
+
+	if _, err := fmt.Fprintf(m.w, "event: %s\ndata: %s\n\n", event, bytes); err != nil {
+		m.err = err
+		return
+	}
+	if f, ok := m.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// messages handles Anthropic Messages API requests for any model, translating them for other providers
+func (s *Server) messages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAnthropicError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+		return
+	}
+
+	req := messagesRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("decoding request: %v", err))
+		return
+	}
+
+	messages, err := req.toWire()
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	client, err := s.client(req.Model)
+	if err != nil {
+		writeAnthropicError(w, http.StatusNotFound, "not_found_error", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	body, err := s.send(ctx, client, messages, req.System, req.options())
+	if err != nil {
+		s.record(ctx, req.Model, wire.Usage{}, true)
+		status, apiErr := clientError(err)
+		writeAnthropicError(w, status, apiErr.Type, apiErr.Message)
+		return
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	mw := &messageWriter{
+		w:      w,
+		stream: req.Stream,
+		msg:    message{ID: newID("msg_"), Type: "message", Role: "assistant", Model: req.Model, Content: []textBlock{}},
+	}
+
+	if req.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	completion, err := client.ReadBody(body, mw.onEvent)
+	s.record(ctx, req.Model, usageOf(completion), err != nil)
+
+	if err != nil {
+		apiErr := toAPIError(err)
+		if !req.Stream {
+			status, _ := clientError(err)
+			writeAnthropicError(w, status, apiErr.Type, apiErr.Message)
+			return
+		}
+		// Headers are already sent, so errors are reported in the stream like Anthropic does
+		mw.write("error", anthropicError(apiErr.Type, apiErr.Message))
+		return
+	}
+
+	if !req.Stream {
+		writeJSON(w, http.StatusOK, mw.msg)
+		return
+	}
+	mw.write("message_stop", map[string]string{"type": "message_stop"})
+}
+
+func anthropicError(errType, message string) any {
+	return map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	}
+}
+
+// writeAnthropicError writes an error in the Anthropic API's format
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, anthropicError(errType, message))
+}
@@ -0,0 +1,264 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/davidhbaek/llm/internal/server"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+func postMessages(t *testing.T, url, key, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/messages", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("anthropic-version", "2023-06-01")
+	if key != "" {
+		req.Header.Set("x-api-key", key)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { rsp.Body.Close() })
+	return rsp
+}
+
+func TestMessages(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"sk-bob": "bob"})
+
+	rsp := postMessages(t, ts.URL, "sk-bob", `{
+		"model": "fake:echo",
+		"max_tokens": 256,
+		"system": "Be brief",
+		"messages": [{"role": "user", "content": [
+			{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}},
+			{"type": "text", "text": "What's in this image?", "cache_control": {"type": "ephemeral"}}
+		]}]
+	}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	body := struct {
+		Type    string `json:"type"`
+		Role    string `json:"role"`
+		Model   string `json:"model"`
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+	require.Equal(t, "message", body.Type)
+	require.Equal(t, "assistant", body.Role)
+	require.Equal(t, "fake:echo", body.Model)
+	require.Len(t, body.Content, 1)
+	require.Equal(t, "text", body.Content[0].Type)
+	require.Equal(t, "What's in this image?", body.Content[0].Text)
+	require.Equal(t, "end_turn", body.StopReason)
+	require.Greater(t, body.Usage.OutputTokens, 0)
+
+	require.Equal(t, 1, srv.Usage("bob")["fake:echo"].Requests)
+}
+
+func TestMessagesImageURL(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+
+	// https image URLs are passed on to the model's provider, never fetched by the server
+	rsp := postMessages(t, ts.URL, "", `{
+		"model": "fake:echo",
+		"max_tokens": 256,
+		"messages": [{"role": "user", "content": [
+			{"type": "image", "source": {"type": "url", "url": "https://example.com/cat.png"}},
+			{"type": "text", "text": "What's in this image?"}
+		]}]
+	}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+func TestMessagesStream(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+
+	rsp := postMessages(t, ts.URL, "", `{
+		"model": "fake:one two",
+		"max_tokens": 256,
+		"messages": [{"role": "user", "content": "Count to two"}],
+		"stream": true
+	}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+
+	var events []string
+	var text string
+	scanner := bufio.NewScanner(rsp.Body)
+	for scanner.Scan() {
+		if event, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, event)
+			continue
+		}
+
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		delta := struct {
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(data), &delta))
+		text += delta.Delta.Text
+	}
+
+	require.Equal(t, []string{
+		"message_start",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+		"message_delta",
+		"message_stop",
+	}, events)
+	require.Equal(t, "one two", text)
+}
+
+// citingClient answers with a block of text supported by two citations, then a block without any
+type citingClient struct{}
+
+func (citingClient) Model() string { return "citing" }
+
+func (citingClient) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	return &wire.Response{StatusCode: http.StatusOK, Body: strings.NewReader("")}, nil
+}
+
+func (citingClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	citations := []wire.Citation{
+		{Type: "page_location", CitedText: "first", StartPageNumber: 1, EndPageNumber: 2},
+		{Type: "page_location", CitedText: "second", StartPageNumber: 3, EndPageNumber: 4},
+	}
+	events := []wire.Event{
+		{Type: wire.EventStart, Usage: &wire.Usage{InputTokens: 10}},
+		{Type: wire.EventText, Text: "Cited"},
+		{Type: wire.EventCitation, Citation: &citations[0]},
+		{Type: wire.EventCitation, Citation: &citations[1]},
+		{Type: wire.EventText, Text: " and not"},
+		{Type: wire.EventStop, StopReason: "end_turn", Usage: &wire.Usage{InputTokens: 10, OutputTokens: 3}},
+	}
+	for _, event := range events {
+		if err := handler.Emit(event); err != nil {
+			return &wire.Completion{}, err
+		}
+	}
+	return &wire.Completion{Text: "Cited and not", Citations: citations, StopReason: "end_turn"}, nil
+}
+
+func TestMessagesCitations(t *testing.T) {
+	srv := server.New(server.Config{
+		Resolve: func(model string) (server.Client, error) { return citingClient{}, nil },
+	})
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	request := `{"model": "citing", "max_tokens": 256, "messages": [{"role": "user", "content": "Cite it"}], "stream": %t}`
+
+	rsp := postMessages(t, ts.URL, "", fmt.Sprintf(request, false))
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body := struct {
+		Content []struct {
+			Text      string          `json:"text"`
+			Citations []wire.Citation `json:"citations"`
+		} `json:"content"`
+	}{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+	require.Len(t, body.Content, 2)
+	require.Equal(t, "Cited", body.Content[0].Text)
+	require.Len(t, body.Content[0].Citations, 2)
+	require.Equal(t, "second", body.Content[0].Citations[1].CitedText)
+	require.Equal(t, " and not", body.Content[1].Text)
+	require.Empty(t, body.Content[1].Citations)
+
+	rsp = postMessages(t, ts.URL, "", fmt.Sprintf(request, true))
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	var events []string
+	scanner := bufio.NewScanner(rsp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		event := struct {
+			Type  string `json:"type"`
+			Index int    `json:"index"`
+			Delta struct {
+				Type string `json:"type"`
+			} `json:"delta"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		if event.Delta.Type != "" {
+			event.Type = event.Delta.Type
+		}
+		events = append(events, fmt.Sprintf("%s %d", event.Type, event.Index))
+	}
+	require.Equal(t, []string{
+		"message_start 0",
+		"content_block_start 0",
+		"text_delta 0",
+		"citations_delta 0",
+		"citations_delta 0",
+		"content_block_stop 0",
+		"content_block_start 1",
+		"text_delta 1",
+		"content_block_stop 1",
+		"message_delta 0",
+		"message_stop 0",
+	}, events)
+}
+
+func TestMessagesErrors(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"sk-bob": "bob"})
+
+	tests := []struct {
+		Name           string
+		Key            string
+		Body           string
+		ExpectedStatus int
+		ExpectedType   string
+	}{
+		{Name: "missing key", Body: `{"model":"fake:echo","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusUnauthorized, ExpectedType: "authentication_error"},
+		{Name: "tools aren't supported", Key: "sk-bob", Body: `{"model":"fake:echo","max_tokens":10,"tools":[{"name":"search"}],"messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "image from a file", Key: "sk-bob", Body: `{"model":"fake:echo","max_tokens":10,"messages":[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"/etc/passwd"}}]}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "image over http", Key: "sk-bob", Body: `{"model":"fake:echo","max_tokens":10,"messages":[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"http://169.254.169.254/"}}]}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "unknown content block", Key: "sk-bob", Body: `{"model":"fake:echo","max_tokens":10,"messages":[{"role":"user","content":[{"type":"tool_result"}]}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "provider error is passed on", Key: "sk-bob", Body: `{"model":"fake:error-529","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: 529, ExpectedType: "overloaded_error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rsp := postMessages(t, ts.URL, test.Key, test.Body)
+			require.Equal(t, test.ExpectedStatus, rsp.StatusCode)
+
+			body := struct {
+				Type  string `json:"type"`
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}{}
+			require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+			require.Equal(t, "error", body.Type)
+			require.Equal(t, test.ExpectedType, body.Error.Type)
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// chatRequest is the body of an OpenAI chat completions request, fields we don't support are ignored
+type chatRequest struct {
+	Model         string        `json:"model"`
+	Messages      []chatMessage `json:"messages"`
+	Stream        bool          `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	MaxTokens int `json:"max_tokens"`
+	// Replaces max_tokens in newer versions of the API
+	MaxCompletionTokens int      `json:"max_completion_tokens"`
+	Temperature         *float64 `json:"temperature"`
+	TopP                *float64 `json:"top_p"`
+	Stop                stopList `json:"stop"`
+}
+
+type chatMessage struct {
+	Role    string      `json:"role"`
+	Content chatContent `json:"content"`
+}
+
+// chatContent is either a string or a list of text and image parts
+type chatContent []wire.Content
+
+func (c *chatContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = chatContent{&wire.Text{Type: "text", Text: text}}
+		return nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or a list of parts")
+	}
+
+	for _, raw := range parts {
+		part := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(raw, &part); err != nil {
+			return err
+		}
+
+		switch part.Type {
+		case "text":
+			text := &wire.Text{}
+			if err := json.Unmarshal(raw, text); err != nil {
+				return err
+			}
+			*c = append(*c, text)
+		case "image_url":
+			image := &wire.OpenAIImage{}
+			if err := json.Unmarshal(raw, image); err != nil {
+				return err
+			}
+			// Anything else could be a path on the server's disk, images are never read or fetched for callers
+			if url := image.ImageURL.URL; !strings.HasPrefix(url, "data:") && !strings.HasPrefix(url, "https://") {
+				return errors.New("image_url must be a base64 data URL or an https URL")
+			}
+			*c = append(*c, image)
+		default:
+			return fmt.Errorf("unsupported content part: %q", part.Type)
+		}
+	}
+
+	return nil
+}
+
+// stopList is either a single stop sequence or a list of them
+type stopList []string
+
+func (s *stopList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = stopList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(s))
+}
+
+// toWire splits the system messages out of a chat request, the way the clients take them
+func (req *chatRequest) toWire() ([]wire.Message, []wire.Text, error) {
+	var messages []wire.Message
+	var system []wire.Text
+	for _, msg := range req.Messages {
+		switch msg.Role {
+		case "system", "developer":
+			for _, content := range msg.Content {
+				text, ok := content.(*wire.Text)
+				if !ok {
+					return nil, nil, errors.New("system messages can only contain text")
+				}
+				system = append(system, wire.Text{Type: "text", Text: text.Text})
+			}
+		case "user", "assistant":
+			messages = append(messages, wire.Message{Role: msg.Role, Content: msg.Content})
+		default:
+			return nil, nil, fmt.Errorf("unsupported message role: %q", msg.Role)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, nil, errors.New("messages must include at least one user message")
+	}
+
+	return messages, system, nil
+}
+
+func (req *chatRequest) options() []wire.Option {
+	var opts []wire.Option
+	if maxTokens := max(req.MaxTokens, req.MaxCompletionTokens); maxTokens > 0 {
+		opts = append(opts, wire.WithMaxTokens(maxTokens))
+	}
+	if req.Temperature != nil {
+		opts = append(opts, wire.WithTemperature(*req.Temperature))
+	}
+	if req.TopP != nil {
+		opts = append(opts, wire.WithTopP(*req.TopP))
+	}
+	if len(req.Stop) > 0 {
+		opts = append(opts, wire.WithStop(req.Stop...))
+	}
+	return opts
+}
+
+type chatUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func toChatUsage(usage wire.Usage) *chatUsage {
+	// Cached tokens are still prompt tokens to OpenAI
+	prompt := usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
+	return &chatUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      prompt + usage.OutputTokens,
+	}
+}
+
+type chatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type chatChoice struct {
+	Index        int          `json:"index"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatDelta   `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type chatResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []chatChoice `json:"choices"`
+	Usage   *chatUsage   `json:"usage,omitempty"`
+}
+
+// MarshalJSON writes content as a string, responses only ever have text
+func (c chatContent) MarshalJSON() ([]byte, error) {
+	var text string
+	for _, content := range c {
+		if t, ok := content.(*wire.Text); ok {
+			text += t.Text
+		}
+	}
+	return json.Marshal(text)
+}
+
+// finishReason maps a provider's stop reason to OpenAI's
+func finishReason(stopReason string) *string {
+	reason := stopReason
+	switch stopReason {
+	case "end_turn", "stop_sequence", "":
+		reason = "stop"
+	case "max_tokens":
+		reason = "length"
+	}
+	return &reason
+}
+
+func (s *Server) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use POST")
+		return
+	}
+
+	req := chatRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("decoding request: %v", err))
+		return
+	}
+
+	messages, system, err := req.toWire()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+
+	client, err := s.client(req.Model)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "invalid_request_error", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	body, err := s.send(ctx, client, messages, system, req.options())
+	if err != nil {
+		s.record(ctx, req.Model, wire.Usage{}, true)
+		writeClientError(w, err)
+		return
+	}
+	if closer, ok := body.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	rsp := chatResponse{ID: newID("chatcmpl-"), Created: time.Now().Unix(), Model: req.Model}
+
+	if !req.Stream {
+		completion, err := client.ReadBody(body, nil)
+		s.record(ctx, req.Model, usageOf(completion), err != nil)
+		if err != nil {
+			writeClientError(w, err)
+			return
+		}
+
+		rsp.Object = "chat.completion"
+		rsp.Choices = []chatChoice{{
+			Message:      &chatMessage{Role: "assistant", Content: chatContent{&wire.Text{Type: "text", Text: completion.Text}}},
+			FinishReason: finishReason(completion.StopReason),
+		}}
+		rsp.Usage = toChatUsage(completion.Usage)
+		writeJSON(w, http.StatusOK, rsp)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rsp.Object = "chat.completion.chunk"
+	write := func(v any) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	completion, err := client.ReadBody(body, func(event wire.Event) error {
+		chunk := rsp
+		switch event.Type {
+		case wire.EventStart:
+			chunk.Choices = []chatChoice{{Delta: &chatDelta{Role: "assistant"}}}
+		case wire.EventText:
+			chunk.Choices = []chatChoice{{Delta: &chatDelta{Content: event.Text}}}
+		case wire.EventStop:
+			chunk.Choices = []chatChoice{{Delta: &chatDelta{}, FinishReason: finishReason(event.StopReason)}}
+		default:
+			return nil
+		}
+		return write(chunk)
+	})
+	s.record(ctx, req.Model, usageOf(completion), err != nil)
+
+	// Headers are already sent, so errors are reported in the stream like OpenAI does
+	if err != nil {
+		write(struct {
+			Error apiError `json:"error"`
+		}{Error: toAPIError(err)})
+		return
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		chunk := rsp
+		chunk.Choices = []chatChoice{}
+		chunk.Usage = toChatUsage(completion.Usage)
+		write(chunk)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// send sends a request to the client, turning error statuses into a wire.APIError
+func (s *Server) send(ctx context.Context, client Client, messages []wire.Message, system []wire.Text, opts []wire.Option) (io.Reader, error) {
+	rsp, err := client.SendMessage(ctx, messages, system, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		if closer, ok := rsp.Body.(io.Closer); ok {
+			defer closer.Close()
+		}
+		return nil, wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+
+	return rsp.Body, nil
+}
+
+type apiError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	// Always null, it's only there for clients that expect it
+	Code *string `json:"code"`
+}
+
+// toAPIError keeps the type of errors from the provider, anything else is the server's fault
+func toAPIError(err error) apiError {
+	var providerErr *wire.APIError
+	if errors.As(err, &providerErr) {
+		return apiError{Message: providerErr.Message, Type: providerErr.Type}
+	}
+	return apiError{Message: err.Error(), Type: "api_error"}
+}
+
+// clientError passes on the status of errors from the provider
+// Other errors mean the provider couldn't be reached or its response couldn't be read
+func clientError(err error) (int, apiError) {
+	status := http.StatusBadGateway
+	var providerErr *wire.APIError
+	if errors.As(err, &providerErr) && providerErr.StatusCode != 0 {
+		status = providerErr.StatusCode
+	}
+
+	return status, toAPIError(err)
+}
+
+func writeClientError(w http.ResponseWriter, err error) {
+	status, apiErr := clientError(err)
+	writeError(w, status, apiErr.Type, apiErr.Message)
+}
+
+// writeError writes an error in the OpenAI API's format
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{Error: apiError{Message: message, Type: errType}})
+}
+
+func newID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
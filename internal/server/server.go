@@ -0,0 +1,316 @@
+// Package server exposes LLM clients over HTTP, so tools in any language can reach every provider through one API
+//
+// Both OpenAI's chat completions API and Anthropic's Messages API are served for every model,
+// requests and streamed responses are translated for providers that use the other format
+//
+// Provider API keys stay with the server, callers authenticate with keys of their own
+// and their token usage is accounted for per model
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidhbaek/llm/internal/logging"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Client is the part of llm.Client the server needs
+type Client interface {
+	SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error)
+	ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error)
+	Model() string
+}
+
+type Config struct {
+	// Resolve returns the client for the model named in a request
+	Resolve func(model string) (Client, error)
+	// Models listed by /v1/models
+	Models []string
+	// Callers' names by their API key, every request is allowed when there are none
+	Keys map[string]string
+	// Estimates the price of a request for usage accounting, costs are left at zero when nil
+	Cost func(model string, usage wire.Usage) float64
+	// Where requests are logged, slog.Default() when nil
+	Logger *slog.Logger
+}
+
+// Usage is a caller's running total for one model
+type Usage struct {
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+}
+
+type Server struct {
+	config Config
+	mux    *http.ServeMux
+
+	mu sync.Mutex
+	// Clients are reused across requests so their connections are too
+	clients map[string]Client
+	// Usage by caller, then model
+	usage map[string]map[string]*Usage
+}
+
+var _ http.Handler = &Server{}
+
+// Caller name for requests when the server has no keys
+const anonymous = "anonymous"
+
+func New(config Config) *Server {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	s := &Server{
+		config:  config,
+		mux:     http.NewServeMux(),
+		clients: map[string]Client{},
+		usage:   map[string]map[string]*Usage{},
+	}
+
+	s.mux.HandleFunc("/v1/chat/completions", s.chatCompletions)
+	s.mux.HandleFunc("/v1/messages", s.messages)
+	s.mux.HandleFunc("/v1/models", s.models)
+	s.mux.HandleFunc("/v1/usage", s.callerUsage)
+
+	return s
+}
+
+type contextKey int
+
+const requestKey contextKey = iota
+
+// request collects what's logged about a request once it's handled
+type request struct {
+	caller string
+	model  string
+	usage  wire.Usage
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+	req := &request{caller: anonymous}
+	logger := s.config.Logger.With("request_id", logging.NewRequestID())
+	defer func() {
+		logger.Info("request",
+			"caller", req.caller, "method", r.Method, "path", r.URL.Path, "model", req.model, "status", sw.status,
+			"latency", time.Since(start).Round(time.Millisecond), "input_tokens", req.usage.InputTokens, "output_tokens", req.usage.OutputTokens)
+	}()
+
+	if len(s.config.Keys) > 0 {
+		caller, ok := s.authenticate(r)
+		if !ok {
+			// Errors are in the format of the API the caller is using
+			if r.URL.Path == "/v1/messages" {
+				writeAnthropicError(sw, http.StatusUnauthorized, "authentication_error", "missing or invalid API key")
+			} else {
+				writeError(sw, http.StatusUnauthorized, "authentication_error", "missing or invalid API key")
+			}
+			return
+		}
+		req.caller = caller
+	}
+
+	// Clients log with the request's ID and caller
+	ctx := context.WithValue(r.Context(), requestKey, req)
+	ctx = logging.WithLogger(ctx, logger.With("caller", req.caller))
+	s.mux.ServeHTTP(sw, r.WithContext(ctx))
+}
+
+// authenticate returns the caller whose key is in the request's Authorization header
+// Both the OpenAI style Bearer token and Anthropic's x-api-key header are accepted
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		key = r.Header.Get("x-api-key")
+	}
+	if key == "" {
+		return "", false
+	}
+
+	// Compare against every key in constant time so timing doesn't give away how much of a key matched
+	var caller string
+	for k, name := range s.config.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			caller = name
+		}
+	}
+
+	return caller, caller != ""
+}
+
+func requestFrom(ctx context.Context) *request {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req
+	}
+	return &request{caller: anonymous}
+}
+
+// client returns the client for model, creating it on first use
+func (s *Server) client(model string) (Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if client, ok := s.clients[model]; ok {
+		return client, nil
+	}
+
+	client, err := s.config.Resolve(model)
+	if err != nil {
+		return nil, err
+	}
+	s.clients[model] = client
+
+	return client, nil
+}
+
+// usageOf is what a completion used, clients may return no completion with an error
+func usageOf(completion *wire.Completion) wire.Usage {
+	if completion == nil {
+		return wire.Usage{}
+	}
+	return completion.Usage
+}
+
+// record adds a request to its caller's usage of the model
+func (s *Server) record(ctx context.Context, model string, usage wire.Usage, failed bool) {
+	req := requestFrom(ctx)
+	req.model, req.usage = model, usage
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.usage[req.caller] == nil {
+		s.usage[req.caller] = map[string]*Usage{}
+	}
+	total := s.usage[req.caller][model]
+	if total == nil {
+		total = &Usage{}
+		s.usage[req.caller][model] = total
+	}
+
+	total.Requests++
+	if failed {
+		total.Errors++
+	}
+	total.InputTokens += usage.InputTokens
+	total.OutputTokens += usage.OutputTokens
+	if s.config.Cost != nil {
+		total.CostUSD += s.config.Cost(model, usage)
+	}
+}
+
+// Usage returns a caller's usage of each model since the server started
+func (s *Server) Usage(caller string) map[string]Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := map[string]Usage{}
+	for model, total := range s.usage[caller] {
+		usage[model] = *total
+	}
+	return usage
+}
+
+func (s *Server) callerUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+
+	caller := requestFrom(r.Context()).caller
+	writeJSON(w, http.StatusOK, struct {
+		Caller string           `json:"caller"`
+		Models map[string]Usage `json:"models"`
+	}{Caller: caller, Models: s.Usage(caller)})
+}
+
+func (s *Server) models(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "use GET")
+		return
+	}
+
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		OwnedBy string `json:"owned_by"`
+	}
+
+	list := struct {
+		Object string  `json:"object"`
+		Data   []model `json:"data"`
+	}{Object: "list", Data: []model{}}
+	for _, name := range s.config.Models {
+		list.Data = append(list.Data, model{ID: name, Object: "model", OwnedBy: "llm"})
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// LoadKeys reads callers' API keys from a file with a caller's name and key on each line
+// Blank lines and lines starting with # are skipped
+func LoadKeys(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a caller's name and their key", path, n)
+		}
+		keys[fields[1]] = fields[0]
+	}
+
+	return keys, scanner.Err()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusWriter remembers the status code written, for logging
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through so streamed responses aren't buffered
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
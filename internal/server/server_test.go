@@ -0,0 +1,225 @@
+package server_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/server"
+	"github.com/davidhbaek/llm/internal/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, keys map[string]string) (*server.Server, *httptest.Server) {
+	srv := server.New(server.Config{
+		Resolve: func(model string) (server.Client, error) {
+			if !strings.HasPrefix(model, fake.Prefix) {
+				return nil, fmt.Errorf("unsupported model: %s", model)
+			}
+			return fake.NewClient(model), nil
+		},
+		Models: []string{fake.Echo},
+		Keys:   keys,
+		Cost: func(model string, usage wire.Usage) float64 {
+			return float64(usage.InputTokens + usage.OutputTokens)
+		},
+	})
+
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func post(t *testing.T, url, key, body string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/chat/completions", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { rsp.Body.Close() })
+	return rsp
+}
+
+func TestChatCompletions(t *testing.T) {
+	srv, ts := newTestServer(t, map[string]string{"sk-alice": "alice"})
+
+	rsp := post(t, ts.URL, "sk-alice", `{
+		"model": "fake:echo",
+		"messages": [
+			{"role": "system", "content": "Be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "Hello there"}]}
+		],
+		"max_tokens": 100
+	}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	body := struct {
+		Object  string `json:"object"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+	require.Equal(t, "chat.completion", body.Object)
+	require.Equal(t, "fake:echo", body.Model)
+	require.Len(t, body.Choices, 1)
+	require.Equal(t, "assistant", body.Choices[0].Message.Role)
+	require.Equal(t, "Hello there", body.Choices[0].Message.Content)
+	require.Equal(t, "stop", body.Choices[0].FinishReason)
+	require.Greater(t, body.Usage.CompletionTokens, 0)
+
+	usage := srv.Usage("alice")["fake:echo"]
+	require.Equal(t, 1, usage.Requests)
+	require.Equal(t, body.Usage.PromptTokens, usage.InputTokens)
+	require.Equal(t, body.Usage.CompletionTokens, usage.OutputTokens)
+	require.Equal(t, float64(usage.InputTokens+usage.OutputTokens), usage.CostUSD)
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	_, ts := newTestServer(t, nil)
+
+	rsp := post(t, ts.URL, "", `{
+		"model": "fake:one two three",
+		"messages": [{"role": "user", "content": "Count to three"}],
+		"stream": true,
+		"stream_options": {"include_usage": true}
+	}`)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+
+	var text string
+	var finishReason string
+	var sawUsage, done bool
+	scanner := bufio.NewScanner(rsp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+
+		chunk := struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *struct {
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		require.Equal(t, "chat.completion.chunk", chunk.Object)
+
+		for _, choice := range chunk.Choices {
+			text += choice.Delta.Content
+			if choice.FinishReason != nil {
+				finishReason = *choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			sawUsage = true
+		}
+	}
+
+	require.True(t, done)
+	require.True(t, sawUsage)
+	require.Equal(t, "one two three", text)
+	require.Equal(t, "stop", finishReason)
+}
+
+func TestChatCompletionsErrors(t *testing.T) {
+	_, ts := newTestServer(t, map[string]string{"sk-alice": "alice"})
+
+	tests := []struct {
+		Name           string
+		Key            string
+		Body           string
+		ExpectedStatus int
+		ExpectedType   string
+	}{
+		{Name: "missing key", Body: `{"model":"fake:echo","messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusUnauthorized, ExpectedType: "authentication_error"},
+		{Name: "wrong key", Key: "sk-mallory", Body: `{"model":"fake:echo","messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusUnauthorized, ExpectedType: "authentication_error"},
+		{Name: "unknown model", Key: "sk-alice", Body: `{"model":"gpt-17","messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusNotFound, ExpectedType: "invalid_request_error"},
+		{Name: "no messages", Key: "sk-alice", Body: `{"model":"fake:echo","messages":[]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "image from a file", Key: "sk-alice", Body: `{"model":"fake:echo","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"/etc/passwd"}}]}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "image from a file URL", Key: "sk-alice", Body: `{"model":"fake:echo","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"file:///etc/passwd"}}]}]}`, ExpectedStatus: http.StatusBadRequest, ExpectedType: "invalid_request_error"},
+		{Name: "provider error is passed on", Key: "sk-alice", Body: `{"model":"fake:error-429","messages":[{"role":"user","content":"hi"}]}`, ExpectedStatus: http.StatusTooManyRequests, ExpectedType: "rate_limit_error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rsp := post(t, ts.URL, test.Key, test.Body)
+			require.Equal(t, test.ExpectedStatus, rsp.StatusCode)
+
+			body := struct {
+				Error struct {
+					Type    string `json:"type"`
+					Message string `json:"message"`
+				} `json:"error"`
+			}{}
+			require.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+			require.Equal(t, test.ExpectedType, body.Error.Type)
+			require.NotEmpty(t, body.Error.Message)
+		})
+	}
+}
+
+// failingClient reads no completion at all, like middleware that fails before the stream starts
+type failingClient struct {
+	*fake.Client
+}
+
+func (failingClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	return nil, errors.New("stream broke")
+}
+
+func TestNoCompletion(t *testing.T) {
+	srv := server.New(server.Config{
+		Resolve: func(model string) (server.Client, error) {
+			return failingClient{fake.NewClient(model)}, nil
+		},
+	})
+	ts := httptest.NewServer(srv)
+	t.Cleanup(ts.Close)
+
+	for _, stream := range []bool{false, true} {
+		request := fmt.Sprintf(`{"model":"fake:echo","max_tokens":16,"messages":[{"role":"user","content":"hi"}],"stream":%t}`, stream)
+		for _, rsp := range []*http.Response{post(t, ts.URL, "", request), postMessages(t, ts.URL, "", request)} {
+			if stream {
+				require.Equal(t, http.StatusOK, rsp.StatusCode)
+				data, err := io.ReadAll(rsp.Body)
+				require.NoError(t, err)
+				require.Contains(t, string(data), "stream broke")
+			} else {
+				require.Equal(t, http.StatusBadGateway, rsp.StatusCode)
+			}
+		}
+	}
+	require.Equal(t, 4, srv.Usage("anonymous")["fake:echo"].Errors)
+}
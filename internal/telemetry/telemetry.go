@@ -0,0 +1,285 @@
+// Package telemetry instruments LLM clients with OpenTelemetry traces and metrics
+//
+// Spans and metrics follow the GenAI semantic conventions, so LLM spend and latency show up next to
+// everything else a platform already monitors. Nothing is exported unless the program installs
+// OpenTelemetry providers with exporters, like Setup does, the global providers are no-ops by default
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// Name of the instrumentation scope of the spans and metrics
+const scope = "github.com/davidhbaek/llm"
+
+// Attributes from the GenAI semantic conventions
+const (
+	operationName    = attribute.Key("gen_ai.operation.name")
+	genAISystem      = attribute.Key("gen_ai.system")
+	requestModel     = attribute.Key("gen_ai.request.model")
+	requestMaxTokens = attribute.Key("gen_ai.request.max_tokens")
+	requestTemp      = attribute.Key("gen_ai.request.temperature")
+	requestTopP      = attribute.Key("gen_ai.request.top_p")
+	responseModel    = attribute.Key("gen_ai.response.model")
+	finishReasons    = attribute.Key("gen_ai.response.finish_reasons")
+	inputTokens      = attribute.Key("gen_ai.usage.input_tokens")
+	outputTokens     = attribute.Key("gen_ai.usage.output_tokens")
+	tokenType        = attribute.Key("gen_ai.token.type")
+	errorTypeKey     = attribute.Key("error.type")
+	httpStatusCode   = attribute.Key("http.response.status_code")
+	// Not in the conventions yet
+	timeToFirstToken = attribute.Key("llm.time_to_first_token")
+)
+
+const operationChat = "chat"
+
+// Values of error.type for errors that don't come from the provider
+const (
+	errorTypeOther    = "_OTHER"
+	errorTypeStream   = "stream_error"
+	errorTypeCanceled = "canceled"
+	errorTypeTimeout  = "timeout"
+)
+
+// Telemetry holds the tracer and metric instruments shared by every instrumented client
+type Telemetry struct {
+	tracer trace.Tracer
+
+	duration         metric.Float64Histogram
+	timeToFirstToken metric.Float64Histogram
+	tokens           metric.Int64Histogram
+	errors           metric.Int64Counter
+}
+
+// New creates the instruments, the global OpenTelemetry providers are used for nil ones
+func New(tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider) (*Telemetry, error) {
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	if meterProvider == nil {
+		meterProvider = otel.GetMeterProvider()
+	}
+
+	t := &Telemetry{tracer: tracerProvider.Tracer(scope)}
+	meter := meterProvider.Meter(scope)
+
+	var err error
+	t.duration, err = meter.Float64Histogram("gen_ai.client.operation.duration",
+		metric.WithDescription("Duration of LLM requests, until the whole response is read"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.01, 0.02, 0.04, 0.08, 0.16, 0.32, 0.64, 1.28, 2.56, 5.12, 10.24, 20.48, 40.96, 81.92))
+	if err != nil {
+		return nil, fmt.Errorf("creating duration histogram: %w", err)
+	}
+
+	// Not in the conventions yet, named like the rest of the client metrics
+	t.timeToFirstToken, err = meter.Float64Histogram("llm.client.time_to_first_token",
+		metric.WithDescription("Time from sending an LLM request to the first token of its response"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.01, 0.02, 0.04, 0.08, 0.16, 0.32, 0.64, 1.28, 2.56, 5.12, 10.24))
+	if err != nil {
+		return nil, fmt.Errorf("creating time to first token histogram: %w", err)
+	}
+
+	t.tokens, err = meter.Int64Histogram("gen_ai.client.token.usage",
+		metric.WithDescription("Input and output tokens used by LLM requests"),
+		metric.WithUnit("{token}"),
+		metric.WithExplicitBucketBoundaries(1, 4, 16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304))
+	if err != nil {
+		return nil, fmt.Errorf("creating token usage histogram: %w", err)
+	}
+
+	t.errors, err = meter.Int64Counter("llm.client.errors",
+		metric.WithDescription("Failed LLM requests by error type"),
+		metric.WithUnit("{error}"))
+	if err != nil {
+		return nil, fmt.Errorf("creating error counter: %w", err)
+	}
+
+	return t, nil
+}
+
+// Middleware traces and measures the requests of clients of the provider's models, e.g. anthropic or openai
+func (t *Telemetry) Middleware(provider string) middleware.Middleware {
+	return func(next middleware.Client) middleware.Client {
+		return &instrumentedClient{next: next, telemetry: t, provider: provider}
+	}
+}
+
+type instrumentedClient struct {
+	next      middleware.Client
+	telemetry *Telemetry
+	provider  string
+}
+
+func (c *instrumentedClient) Model() string {
+	return c.next.Model()
+}
+
+func (c *instrumentedClient) CountTokens(ctx context.Context, messages []wire.Message, system []wire.Text) (int, error) {
+	return c.next.CountTokens(ctx, messages, system)
+}
+
+// call is a request being traced, from sending it until its response is read
+type call struct {
+	telemetry *Telemetry
+	span      trace.Span
+	start     time.Time
+	// Attributes of the request, shared by its metrics
+	attrs []attribute.KeyValue
+
+	once sync.Once
+}
+
+// instrumentedBody is the body of a response, carrying its call to ReadBody
+type instrumentedBody struct {
+	io.Reader
+	call *call
+}
+
+func (b *instrumentedBody) Close() error {
+	b.call.end(context.Background(), nil, errors.New("response closed before it was read"))
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (c *instrumentedClient) SendMessage(ctx context.Context, messages []wire.Message, system []wire.Text, opts ...wire.Option) (*wire.Response, error) {
+	model := c.next.Model()
+	options := wire.NewOptions(opts...)
+
+	attrs := []attribute.KeyValue{
+		operationName.String(operationChat),
+		genAISystem.String(c.provider),
+		requestModel.String(model),
+	}
+	spanAttrs := append([]attribute.KeyValue{}, attrs...)
+	if options.MaxTokens > 0 {
+		spanAttrs = append(spanAttrs, requestMaxTokens.Int(options.MaxTokens))
+	}
+	if options.Temperature != nil {
+		spanAttrs = append(spanAttrs, requestTemp.Float64(*options.Temperature))
+	}
+	if options.TopP != nil {
+		spanAttrs = append(spanAttrs, requestTopP.Float64(*options.TopP))
+	}
+
+	ctx, span := c.telemetry.tracer.Start(ctx, operationChat+" "+model, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(spanAttrs...))
+	cl := &call{telemetry: c.telemetry, span: span, start: time.Now(), attrs: attrs}
+
+	rsp, err := c.next.SendMessage(ctx, messages, system, opts...)
+	if err != nil {
+		cl.end(ctx, nil, err)
+		return nil, err
+	}
+
+	span.SetAttributes(httpStatusCode.Int(rsp.StatusCode))
+	if rsp.StatusCode != http.StatusOK {
+		// The caller still gets to read the error body
+		body, _ := io.ReadAll(rsp.Body)
+		if closer, ok := rsp.Body.(io.Closer); ok {
+			closer.Close()
+		}
+		cl.end(ctx, nil, wire.NewAPIError(rsp.StatusCode, bytes.NewReader(body)))
+		return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: bytes.NewReader(body)}, nil
+	}
+
+	return &wire.Response{StatusCode: rsp.StatusCode, Header: rsp.Header, Body: &instrumentedBody{Reader: rsp.Body, call: cl}}, nil
+}
+
+func (c *instrumentedClient) ReadBody(body io.Reader, handler wire.EventHandler) (*wire.Completion, error) {
+	b, ok := body.(*instrumentedBody)
+	if !ok {
+		return c.next.ReadBody(body, handler)
+	}
+
+	first := true
+	completion, err := c.next.ReadBody(b.Reader, func(event wire.Event) error {
+		if first && event.Type == wire.EventText {
+			first = false
+			b.call.firstToken()
+		}
+		return handler.Emit(event)
+	})
+	b.call.end(context.Background(), completion, err)
+
+	return completion, err
+}
+
+func (cl *call) firstToken() {
+	elapsed := time.Since(cl.start)
+	cl.span.AddEvent("gen_ai.first_token")
+	cl.span.SetAttributes(timeToFirstToken.Float64(elapsed.Seconds()))
+	cl.telemetry.timeToFirstToken.Record(context.Background(), elapsed.Seconds(), metric.WithAttributes(cl.attrs...))
+}
+
+// end records the outcome of the call, only the first outcome counts
+func (cl *call) end(ctx context.Context, completion *wire.Completion, err error) {
+	cl.once.Do(func() {
+		defer cl.span.End()
+
+		attrs := cl.attrs
+		if completion != nil {
+			if completion.Model != "" {
+				attrs = append(attrs, responseModel.String(completion.Model))
+				cl.span.SetAttributes(responseModel.String(completion.Model))
+			}
+			cl.span.SetAttributes(
+				inputTokens.Int(completion.Usage.InputTokens),
+				outputTokens.Int(completion.Usage.OutputTokens),
+			)
+			if completion.StopReason != "" {
+				cl.span.SetAttributes(finishReasons.StringSlice([]string{completion.StopReason}))
+			}
+			cl.telemetry.tokens.Record(ctx, int64(completion.Usage.InputTokens), metric.WithAttributes(append(attrs, tokenType.String("input"))...))
+			cl.telemetry.tokens.Record(ctx, int64(completion.Usage.OutputTokens), metric.WithAttributes(append(attrs, tokenType.String("output"))...))
+		}
+
+		if err != nil {
+			errType := errorType(err, completion != nil)
+			attrs = append(attrs, errorTypeKey.String(errType))
+			cl.span.SetAttributes(errorTypeKey.String(errType))
+			cl.span.RecordError(err)
+			cl.span.SetStatus(codes.Error, err.Error())
+			cl.telemetry.errors.Add(ctx, 1, metric.WithAttributes(attrs...))
+		}
+
+		cl.telemetry.duration.Record(ctx, time.Since(cl.start).Seconds(), metric.WithAttributes(attrs...))
+	})
+}
+
+// errorType names the kind of failure, the provider's error type when it gave one
+func errorType(err error, streaming bool) string {
+	var apiErr *wire.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Type != "":
+		return apiErr.Type
+	case errors.As(err, &apiErr):
+		return fmt.Sprint(apiErr.StatusCode)
+	case errors.Is(err, context.Canceled):
+		return errorTypeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return errorTypeTimeout
+	case streaming:
+		return errorTypeStream
+	default:
+		return errorTypeOther
+	}
+}
@@ -0,0 +1,189 @@
+package telemetry_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/davidhbaek/llm/internal/fake"
+	"github.com/davidhbaek/llm/internal/middleware"
+	"github.com/davidhbaek/llm/internal/telemetry"
+	"github.com/davidhbaek/llm/internal/wire"
+)
+
+// setup instruments a fake client, recording its spans and metrics in memory
+func setup(t *testing.T, client *fake.Client) (middleware.Client, *tracetest.InMemoryExporter, *sdkmetric.ManualReader) {
+	spans := tracetest.NewInMemoryExporter()
+	reader := sdkmetric.NewManualReader()
+
+	tel, err := telemetry.New(
+		sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)),
+		sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	)
+	require.NoError(t, err)
+
+	return middleware.Chain(client, tel.Middleware("fake")), spans, reader
+}
+
+// send sends a request and reads the whole response
+func send(client middleware.Client) error {
+	messages := []wire.Message{{Role: "user", Content: []wire.Content{&wire.Text{Type: "text", Text: "Hello there"}}}}
+	rsp, err := client.SendMessage(context.Background(), messages, nil, wire.WithMaxTokens(100), wire.WithTemperature(0.5))
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return wire.NewAPIError(rsp.StatusCode, rsp.Body)
+	}
+	_, err = client.ReadBody(rsp.Body, nil)
+	return err
+}
+
+func attributes(kvs []attribute.KeyValue) map[string]any {
+	m := map[string]any{}
+	for _, kv := range kvs {
+		m[string(kv.Key)] = kv.Value.AsInterface()
+	}
+	return m
+}
+
+// metrics collects the recorded metrics by name
+func metrics(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	rm := metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	m := map[string]metricdata.Aggregation{}
+	for _, scope := range rm.ScopeMetrics {
+		for _, metric := range scope.Metrics {
+			m[metric.Name] = metric.Data
+		}
+	}
+	return m
+}
+
+func TestSpan(t *testing.T) {
+	client, spans, reader := setup(t, fake.NewClient("fake:General Kenobi", fake.WithDelay(5*time.Millisecond)))
+	require.NoError(t, send(client))
+
+	recorded := spans.GetSpans()
+	require.Len(t, recorded, 1)
+	span := recorded[0]
+	require.Equal(t, "chat fake:General Kenobi", span.Name)
+	require.Equal(t, trace.SpanKindClient, span.SpanKind)
+
+	attrs := attributes(span.Attributes)
+	require.Equal(t, "chat", attrs["gen_ai.operation.name"])
+	require.Equal(t, "fake", attrs["gen_ai.system"])
+	require.Equal(t, "fake:General Kenobi", attrs["gen_ai.request.model"])
+	require.Equal(t, "fake:General Kenobi", attrs["gen_ai.response.model"])
+	require.Equal(t, int64(100), attrs["gen_ai.request.max_tokens"])
+	require.Equal(t, 0.5, attrs["gen_ai.request.temperature"])
+	require.Equal(t, int64(3), attrs["gen_ai.usage.input_tokens"])
+	require.Equal(t, int64(4), attrs["gen_ai.usage.output_tokens"])
+	require.Equal(t, []string{"end_turn"}, attrs["gen_ai.response.finish_reasons"])
+	require.Greater(t, attrs["llm.time_to_first_token"], 0.0)
+	require.Len(t, span.Events, 1)
+	require.Equal(t, "gen_ai.first_token", span.Events[0].Name)
+
+	m := metrics(t, reader)
+	duration := m["gen_ai.client.operation.duration"].(metricdata.Histogram[float64])
+	require.Len(t, duration.DataPoints, 1)
+	require.Equal(t, uint64(1), duration.DataPoints[0].Count)
+
+	ttft := m["llm.client.time_to_first_token"].(metricdata.Histogram[float64])
+	require.Less(t, ttft.DataPoints[0].Sum, duration.DataPoints[0].Sum)
+
+	tokens := m["gen_ai.client.token.usage"].(metricdata.Histogram[int64])
+	byType := map[string]int64{}
+	for _, dp := range tokens.DataPoints {
+		tokenType, _ := dp.Attributes.Value("gen_ai.token.type")
+		byType[tokenType.AsString()] = dp.Sum
+	}
+	require.Equal(t, map[string]int64{"input": 3, "output": 4}, byType)
+	require.NotContains(t, m, "llm.client.errors")
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		model     string
+		errorType string
+	}{
+		{model: fake.RateLimited, errorType: "rate_limit_error"},
+		{model: fake.Overloaded, errorType: "overloaded_error"},
+		{model: fake.Disconnect, errorType: "stream_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			client, spans, reader := setup(t, fake.NewClient(tt.model))
+			require.Error(t, send(client))
+			require.Error(t, send(client))
+
+			recorded := spans.GetSpans()
+			require.Len(t, recorded, 2)
+			require.Equal(t, codes.Error, recorded[0].Status.Code)
+			require.Equal(t, tt.errorType, attributes(recorded[0].Attributes)["error.type"])
+
+			errors := metrics(t, reader)["llm.client.errors"].(metricdata.Sum[int64])
+			require.Len(t, errors.DataPoints, 1)
+			require.Equal(t, int64(2), errors.DataPoints[0].Value)
+			errType, _ := errors.DataPoints[0].Attributes.Value("error.type")
+			require.Equal(t, tt.errorType, errType.AsString())
+		})
+	}
+}
+
+func TestSetup(t *testing.T) {
+	var mu sync.Mutex
+	paths := map[string]int{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	tracerProvider, meterProvider := otel.GetTracerProvider(), otel.GetMeterProvider()
+	defer func() {
+		otel.SetTracerProvider(tracerProvider)
+		otel.SetMeterProvider(meterProvider)
+	}()
+
+	// Nothing is exported without an endpoint
+	shutdown, err := telemetry.Setup(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+	require.Equal(t, tracerProvider, otel.GetTracerProvider())
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc")
+	_, err = telemetry.Setup(context.Background())
+	require.Error(t, err)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "")
+	shutdown, err = telemetry.Setup(context.Background())
+	require.NoError(t, err)
+
+	tel, err := telemetry.New(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, send(middleware.Chain(fake.NewClient("fake:echo"), tel.Middleware("fake"))))
+
+	// Shutting down flushes what's been recorded
+	require.NoError(t, shutdown(context.Background()))
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, map[string]int{"/v1/traces": 1, "/v1/metrics": 1}, paths)
+}
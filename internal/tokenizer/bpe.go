@@ -0,0 +1,254 @@
+// Package tokenizer counts tokens locally with the byte pair encodings used by OpenAI models,
+// once their vocabularies are downloaded, and estimates them from the length of text otherwise
+//
+// The vocabularies aren't bundled, they're read from tiktoken's file format
+// (one base64 encoded token and its rank per line) in the directory set by
+// TIKTOKEN_CACHE_DIR, or <user cache dir>/llm/tokenizers when it's unset
+// e.g. https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	CL100K = "cl100k_base"
+	O200K  = "o200k_base"
+)
+
+var ErrNoVocabulary = errors.New("tokenizer vocabulary not found")
+
+// Pre-tokenization patterns from tiktoken, without the trailing \s+(?!\S)|\s+
+// alternatives since Go's regexp doesn't support lookaheads. Those are handled in split
+var patterns = map[string]*regexp.Regexp{
+	CL100K: regexp.MustCompile(`^(?:(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+)`),
+	O200K: regexp.MustCompile(`^(?:[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+)`),
+}
+
+// BPE is a byte pair encoding tokenizer
+type BPE struct {
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+// NewBPE creates a tokenizer from a vocabulary of byte sequences and their merge ranks
+func NewBPE(encoding string, ranks map[string]int) (*BPE, error) {
+	pattern, ok := patterns[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+
+	return &BPE{ranks: ranks, pattern: pattern}, nil
+}
+
+var (
+	mu     sync.Mutex
+	loaded = map[string]*BPE{}
+)
+
+// Load reads an encoding's vocabulary from disk, it's only read once per process
+func Load(encoding string) (*BPE, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if bpe, ok := loaded[encoding]; ok {
+		return bpe, nil
+	}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoVocabulary, err)
+	}
+
+	file, err := os.Open(filepath.Join(dir, encoding+".tiktoken"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s.tiktoken in %s", ErrNoVocabulary, encoding, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranks, err := ReadRanks(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s vocabulary: %w", encoding, err)
+	}
+
+	bpe, err := NewBPE(encoding, ranks)
+	if err != nil {
+		return nil, err
+	}
+	loaded[encoding] = bpe
+
+	return bpe, nil
+}
+
+// Dir is where vocabularies are read from, TIKTOKEN_CACHE_DIR or <user cache dir>/llm/tokenizers
+func Dir() (string, error) {
+	if dir := os.Getenv("TIKTOKEN_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "llm", "tokenizers"), nil
+}
+
+// URL is where OpenAI publishes an encoding's vocabulary
+func URL(encoding string) string {
+	return "https://openaipublic.blob.core.windows.net/encodings/" + encoding + ".tiktoken"
+}
+
+// ReadRanks parses a vocabulary in tiktoken's format
+func ReadRanks(r io.Reader) (map[string]int, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed line: %q", scanner.Text())
+		}
+
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("decoding token %q: %w", fields[0], err)
+		}
+
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing rank %q: %w", fields[1], err)
+		}
+		ranks[string(token)] = rank
+	}
+
+	return ranks, scanner.Err()
+}
+
+// Encode returns the token IDs for text
+func (b *BPE) Encode(text string) []int {
+	var tokens []int
+	for _, piece := range b.split(text) {
+		tokens = append(tokens, b.encodePiece(piece)...)
+	}
+	return tokens
+}
+
+// Count returns the number of tokens in text
+func (b *BPE) Count(text string) int {
+	return len(b.Encode(text))
+}
+
+// split breaks text into the pieces that are encoded independently
+func (b *BPE) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		if loc := b.pattern.FindStringIndex(text); loc != nil && loc[1] > 0 {
+			pieces = append(pieces, text[:loc[1]])
+			text = text[loc[1]:]
+			continue
+		}
+
+		// Anything the pattern didn't match starts with whitespace that isn't followed by a newline
+		// \s+(?!\S) leaves the last whitespace character to prefix the word that follows it
+		end := 0
+		for end < len(text) {
+			r, size := utf8.DecodeRuneInString(text[end:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			end += size
+		}
+		if end == 0 {
+			// Not whitespace either, take the rune on its own so we always make progress
+			_, end = utf8.DecodeRuneInString(text)
+		} else if end < len(text) {
+			_, last := utf8.DecodeLastRuneInString(text[:end])
+			if end-last > 0 {
+				end -= last
+			}
+		}
+
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+
+	return pieces
+}
+
+// encodePiece repeatedly merges the adjacent pair of parts with the lowest rank
+func (b *BPE) encodePiece(piece string) []int {
+	if rank, ok := b.ranks[piece]; ok {
+		return []int{rank}
+	}
+
+	parts := make([]string, len(piece))
+	for i := range piece {
+		parts[i] = piece[i : i+1]
+	}
+
+	for len(parts) > 1 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i < len(parts)-1; i++ {
+			if rank, ok := b.ranks[parts[i]+parts[i+1]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		parts[best] += parts[best+1]
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	tokens := make([]int, 0, len(parts))
+	for _, part := range parts {
+		rank, ok := b.ranks[part]
+		if !ok {
+			// Every single byte is in a complete vocabulary, this only happens with partial ones
+			rank = -1
+		}
+		tokens = append(tokens, rank)
+	}
+
+	return tokens
+}
+
+// ForModel returns the encoding used by an OpenAI model
+func ForModel(model string) string {
+	if strings.HasPrefix(model, "gpt-4o") || strings.HasPrefix(model, "o1") || strings.HasPrefix(model, "o3") || strings.HasPrefix(model, "o4") {
+		return O200K
+	}
+	return CL100K
+}
+
+// Rough number of characters per token in English text
+const charsPerToken = 4
+
+// Estimate approximates the tokens in text when no vocabulary is available
+func Estimate(text string) int {
+	if text == "" {
+		return 0
+	}
+	return max(1, (utf8.RuneCountInString(text)+charsPerToken-1)/charsPerToken)
+}
@@ -0,0 +1,74 @@
+package tokenizer_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/davidhbaek/llm/internal/tokenizer"
+	"github.com/stretchr/testify/require"
+)
+
+// vocabulary builds a tiktoken file with every lowercase letter, space and newline
+// followed by the merges given, ranked in order
+func vocabulary(merges ...string) string {
+	var sb strings.Builder
+	rank := 0
+	add := func(token string) {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+		rank++
+	}
+
+	for c := 'a'; c <= 'z'; c++ {
+		add(string(c))
+	}
+	add(" ")
+	add("\n")
+	for _, merge := range merges {
+		add(merge)
+	}
+
+	return sb.String()
+}
+
+func TestEncode(t *testing.T) {
+	ranks, err := tokenizer.ReadRanks(strings.NewReader(vocabulary("he", "ll", "hell", "hello", " w", "or", " wor", " world")))
+	require.NoError(t, err)
+
+	bpe, err := tokenizer.NewBPE(tokenizer.CL100K, ranks)
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name     string
+		Text     string
+		Expected []int
+	}{
+		{Name: "whole words are merged", Text: "hello world", Expected: []int{31, 35}},
+		{Name: "partial merges", Text: "hell", Expected: []int{30}},
+		{Name: "unmerged bytes", Text: "abc", Expected: []int{0, 1, 2}},
+		// The last space of a run prefixes the next word
+		{Name: "whitespace runs", Text: "hello  world", Expected: []int{31, 26, 35}},
+		{Name: "trailing whitespace", Text: "hello \n", Expected: []int{31, 26, 27}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.Equal(t, test.Expected, bpe.Encode(test.Text))
+			require.Equal(t, len(test.Expected), bpe.Count(test.Text))
+		})
+	}
+}
+
+func TestLoadMissingVocabulary(t *testing.T) {
+	t.Setenv("TIKTOKEN_CACHE_DIR", t.TempDir())
+
+	_, err := tokenizer.Load(tokenizer.O200K)
+	require.ErrorIs(t, err, tokenizer.ErrNoVocabulary)
+}
+
+func TestEstimate(t *testing.T) {
+	require.Equal(t, 0, tokenizer.Estimate(""))
+	require.Equal(t, 1, tokenizer.Estimate("hi"))
+	require.Equal(t, 3, tokenizer.Estimate("hello world"))
+}
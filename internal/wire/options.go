@@ -0,0 +1,47 @@
+package wire
+
+// Options are the generation parameters of a request
+// Zero values leave the provider's defaults
+type Options struct {
+	MaxTokens   int
+	Temperature *float64
+	TopP        *float64
+	// Sequences that stop generation when the model outputs them
+	Stop []string
+}
+
+// Option sets one of a request's Options
+type Option func(*Options)
+
+func WithMaxTokens(maxTokens int) Option {
+	return func(o *Options) {
+		o.MaxTokens = maxTokens
+	}
+}
+
+func WithTemperature(temperature float64) Option {
+	return func(o *Options) {
+		o.Temperature = &temperature
+	}
+}
+
+func WithTopP(topP float64) Option {
+	return func(o *Options) {
+		o.TopP = &topP
+	}
+}
+
+func WithStop(stop ...string) Option {
+	return func(o *Options) {
+		o.Stop = stop
+	}
+}
+
+// NewOptions applies opts in order
+func NewOptions(opts ...Option) Options {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
@@ -0,0 +1,66 @@
+package wire
+
+// EventType identifies what a stream Event carries
+type EventType string
+
+const (
+	// The provider accepted the request and started streaming its reply
+	// Carries the input token usage when the provider reports it up front
+	EventStart EventType = "start"
+	// A chunk of generated text
+	EventText EventType = "text"
+	// A source cited for the block of text that was just streamed
+	EventCitation EventType = "citation"
+	// The model finished generating, carries the stop reason and token usage
+	EventStop EventType = "stop"
+)
+
+// Event is a provider agnostic piece of a streamed response
+type Event struct {
+	Type       EventType `json:"type"`
+	Model      string    `json:"model,omitempty"`
+	Text       string    `json:"text,omitempty"`
+	StopReason string    `json:"stop_reason,omitempty"`
+	Usage      *Usage    `json:"usage,omitempty"`
+	Citation   *Citation `json:"citation,omitempty"`
+}
+
+// EventHandler is called for every event read from a streamed response
+// Returning an error stops reading the stream
+type EventHandler func(Event) error
+
+// Emit calls h with event, a nil handler ignores every event
+func (h EventHandler) Emit(event Event) error {
+	if h == nil {
+		return nil
+	}
+	return h(event)
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	// Tokens written to and read from the provider's prompt cache
+	// These aren't counted in InputTokens
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
+
+// Completion is everything read from a streamed response
+type Completion struct {
+	Model      string `json:"model"`
+	Text       string `json:"text"`
+	StopReason string `json:"stop_reason"`
+	Usage      Usage  `json:"usage"`
+	// Sources the model cited for its answer, in the order they were cited
+	Citations []Citation `json:"citations,omitempty"`
+	// How long the response took, nil when it wasn't streamed from the provider, like a cached response
+	Timing *Timing `json:"timing,omitempty"`
+}
+
+// Embeddings are the vectors for a list of inputs, in the same order
+type Embeddings struct {
+	Model   string      `json:"model"`
+	Vectors [][]float32 `json:"vectors"`
+	Usage   Usage       `json:"usage"`
+}
@@ -0,0 +1,77 @@
+package wire
+
+import (
+	"io"
+	"time"
+)
+
+// Timing is how long a streamed response took, measured from sending its request
+type Timing struct {
+	// Until the response headers arrived
+	TimeToFirstByte time.Duration `json:"time_to_first_byte"`
+	// Until the first chunk of text arrived, zero if there was none
+	TimeToFirstToken time.Duration `json:"time_to_first_token"`
+	// Until the whole response was read
+	Total time.Duration `json:"total"`
+	// Output tokens generated per second once the first one arrived
+	OutputTokensPerSecond float64 `json:"output_tokens_per_second"`
+}
+
+// TimedBody is the body of a response, carrying when its request was sent and its headers arrived to ReadBody
+type TimedBody struct {
+	io.Reader
+	Sent     time.Time
+	Received time.Time
+}
+
+func (b *TimedBody) Close() error {
+	if closer, ok := b.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Stopwatch times the events of a response as they're read
+type Stopwatch struct {
+	sent       time.Time
+	received   time.Time
+	firstToken time.Time
+}
+
+// StartStopwatch starts timing the response body, from when its request was sent if it's a TimedBody and from now otherwise
+func StartStopwatch(body io.Reader) *Stopwatch {
+	if b, ok := body.(*TimedBody); ok {
+		return &Stopwatch{sent: b.Sent, received: b.Received}
+	}
+	now := time.Now()
+	return &Stopwatch{sent: now, received: now}
+}
+
+// Handler records when the first text event passes through to next
+func (s *Stopwatch) Handler(next EventHandler) EventHandler {
+	return func(event Event) error {
+		if event.Type == EventText && s.firstToken.IsZero() {
+			s.firstToken = time.Now()
+		}
+		return next.Emit(event)
+	}
+}
+
+// Timing stops the stopwatch, outputTokens is the response's final output token count
+func (s *Stopwatch) Timing(outputTokens int) *Timing {
+	end := time.Now()
+	timing := &Timing{
+		TimeToFirstByte: s.received.Sub(s.sent),
+		Total:           end.Sub(s.sent),
+	}
+	if s.firstToken.IsZero() {
+		return timing
+	}
+
+	timing.TimeToFirstToken = s.firstToken.Sub(s.sent)
+	// A response streamed in a single chunk has no generation time to speak of
+	if generating := end.Sub(s.firstToken); generating > 0 && outputTokens > 0 {
+		timing.OutputTokensPerSecond = float64(outputTokens) / generating.Seconds()
+	}
+	return timing
+}
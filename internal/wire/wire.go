@@ -2,7 +2,12 @@
 // Think I/O operations
 package wire
 
-import "io"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
 
 type Message struct {
 	Role    string    `json:"role"`
@@ -16,6 +21,27 @@ type Content interface {
 type Text struct {
 	Type string `json:"type"`
 	Text string `json:"text"`
+	// Only supported by Anthropic, other providers drop it
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+// CacheControl marks the end of a prompt prefix the provider should cache
+// Everything up to and including the block it's set on is reused by later requests
+type CacheControl struct {
+	Type string `json:"type"`
+}
+
+// Ephemeral returns the cache control for Anthropic's default 5 minute cache
+func Ephemeral() *CacheControl {
+	return &CacheControl{Type: "ephemeral"}
+}
+
+// SystemPrompt returns text as a single system prompt block, or none if text is empty
+func SystemPrompt(text string) []Text {
+	if text == "" {
+		return nil
+	}
+	return []Text{{Type: "text", Text: text}}
 }
 
 var _ Content = &Text{}
@@ -38,12 +64,15 @@ func (I *OpenAIImage) GetType() string {
 }
 
 type AnthropicImage struct {
-	Type   string `json:"type"`
+	Type string `json:"type"`
+	// A base64 encoded image, or a URL for Anthropic to fetch
 	Source struct {
 		Type      string `json:"type"`
-		MediaType string `json:"media_type"`
-		Data      string `json:"data"`
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+		URL       string `json:"url,omitempty"`
 	} `json:"source"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
 }
 
 var _ Content = &AnthropicImage{}
@@ -52,7 +81,93 @@ func (I *AnthropicImage) GetType() string {
 	return "image"
 }
 
+// Document is a file sent to the model as its own content block, only supported by Anthropic
+type Document struct {
+	Type         string           `json:"type"`
+	Source       DocumentSource   `json:"source"`
+	Title        string           `json:"title,omitempty"`
+	Citations    *CitationsConfig `json:"citations,omitempty"`
+	CacheControl *CacheControl    `json:"cache_control,omitempty"`
+}
+
+// DocumentSource is either a base64 encoded PDF or plain text
+type DocumentSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type CitationsConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Citation points to the part of a document that supports a piece of the model's answer
+// Page numbers are set for PDFs and character indexes for plain text, the ends are exclusive
+type Citation struct {
+	Type            string `json:"type"`
+	CitedText       string `json:"cited_text"`
+	DocumentIndex   int    `json:"document_index"`
+	DocumentTitle   string `json:"document_title,omitempty"`
+	StartPageNumber int    `json:"start_page_number,omitempty"`
+	EndPageNumber   int    `json:"end_page_number,omitempty"`
+	StartCharIndex  int    `json:"start_char_index,omitempty"`
+	EndCharIndex    int    `json:"end_char_index,omitempty"`
+}
+
+// Location describes where the citation is in its document, e.g. "p. 3" or "chars 10-52"
+func (c Citation) Location() string {
+	switch {
+	case c.StartPageNumber > 0 && c.EndPageNumber-c.StartPageNumber > 1:
+		return fmt.Sprintf("pp. %d-%d", c.StartPageNumber, c.EndPageNumber-1)
+	case c.StartPageNumber > 0:
+		return fmt.Sprintf("p. %d", c.StartPageNumber)
+	default:
+		return fmt.Sprintf("chars %d-%d", c.StartCharIndex, c.EndCharIndex)
+	}
+}
+
+var _ Content = &Document{}
+
+func (d *Document) GetType() string {
+	return "document"
+}
+
 type Response struct {
 	StatusCode int
-	Body       io.Reader
+	// The provider's response headers, like its rate limits, nil when there weren't any
+	Header http.Header
+	Body   io.Reader
+}
+
+// APIError is an error returned by an LLM provider's API
+// Both Anthropic and OpenAI nest the error details under an "error" key
+type APIError struct {
+	StatusCode int
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("error from API: status=%d type=%s message=%s", e.StatusCode, e.Type, e.Message)
+}
+
+// NewAPIError decodes the error body of a non-200 response
+func NewAPIError(statusCode int, body io.Reader) *APIError {
+	apiErr := &APIError{StatusCode: statusCode}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		apiErr.Message = fmt.Sprintf("reading error body: %v", err)
+		return apiErr
+	}
+
+	errRsp := struct {
+		Error *APIError `json:"error"`
+	}{Error: apiErr}
+
+	if err := json.Unmarshal(raw, &errRsp); err != nil {
+		apiErr.Message = string(raw)
+	}
+
+	return apiErr
 }
@@ -0,0 +1,10 @@
+// Package prompts embeds the prompt templates so they can be used without a path on disk
+package prompts
+
+import _ "embed"
+
+//go:embed summary/system.txt
+var SummarySystem string
+
+//go:embed summary/user.txt
+var SummaryUser string